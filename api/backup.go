@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/ipfs/go-cid"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+)
+
+// How often progress is reported while a backup runs
+const progressInterval = 500 * time.Millisecond
+
+// PerformBackup performs a backup of a device and streams its progress.
+// The backup is cancelled if the caller goes away or progress can not be sent to it
+func (s *Service) PerformBackup(req *pb.PerformBackupRequest, stream pb.API_PerformBackupServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	// Progress is reported from more than one goroutine
+	var lock sync.Mutex
+	var sendErr error
+
+	_, err := s.RunBackup(ctx, idevice.DeviceID(req.DeviceID), func(event *pb.PerformBackupEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if sendErr != nil {
+			return
+		}
+
+		if sendErr = stream.Send(event); sendErr != nil {
+			cancel()
+		}
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return err
+}
+
+// RunBackup performs a backup of a device, adds it to IPFS and saves it as the latest backup.
+// Only one backup runs at a time. Progress is reported to progress, which may be nil.
+// The backup is aborted if ctx is done, including while it waits for another backup to finish
+func (s *Service) RunBackup(ctx context.Context, deviceID idevice.DeviceID, progress func(*pb.PerformBackupEvent)) (*pb.Snapshot, error) {
+	if progress == nil {
+		progress = func(*pb.PerformBackupEvent) {}
+	}
+
+	// The backup could not be saved afterwards
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	progress(&pb.PerformBackupEvent{Phase: pb.BackupPhase_STARTING})
+
+	select {
+	case s.backupLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.backupLock }()
+
+	// Perform backup
+	progress(&pb.PerformBackupEvent{Phase: pb.BackupPhase_BACKING_UP})
+	if err := s.provider.PerformBackup(ctx, deviceID, s.backupDir, deviceProgress(progress)); err != nil {
+		return nil, err
+	}
+
+	// Add backup to IPFS. devicebackup2 writes each device to its own directory
+	deviceDir := filepath.Join(s.backupDir, string(deviceID))
+	totalBytes, err := dirSize(deviceDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find backup: %s", err)
+	}
+
+	progress(&pb.PerformBackupEvent{
+		Phase:      pb.BackupPhase_ADDING_TO_IPFS,
+		TotalBytes: totalBytes,
+	})
+	backupCid, err := s.addBackupWithProgress(ctx, deviceDir, totalBytes, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save latest backup
+	progress(&pb.PerformBackupEvent{
+		Phase:      pb.BackupPhase_SAVING,
+		Percent:    100,
+		Bytes:      totalBytes,
+		TotalBytes: totalBytes,
+	})
+	// Backups that can not be summarized are still saved
+	summary, _ := manifest.Summarize(manifest.Dir(deviceDir), s.backupPassword)
+	_, snapshot, err := s.updateLatestBackup(ctx, deviceID, backupCid.String(), summary)
+	if err != nil {
+		return nil, err
+	}
+
+	pbSnapshot, err := snapshotToPb(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	progress(&pb.PerformBackupEvent{
+		Phase:      pb.BackupPhase_DONE,
+		Percent:    100,
+		Bytes:      totalBytes,
+		TotalBytes: totalBytes,
+		Snapshot:   pbSnapshot,
+	})
+
+	return pbSnapshot, nil
+}
+
+// WaitForBackup waits for a running backup to finish
+func (s *Service) WaitForBackup() {
+	s.backupLock <- struct{}{}
+	<-s.backupLock
+}
+
+// deviceProgress reports the progress of a device backup as BACKING_UP events
+func deviceProgress(progress func(*pb.PerformBackupEvent)) idevice.BackupProgressFunc {
+	var files uint64
+	var file, status string
+	var lastReport time.Time
+
+	return func(p idevice.BackupProgress) {
+		if p.File != file {
+			file = p.File
+			files++
+		}
+
+		// Always report when the device starts doing something else
+		if p.Phase == status && time.Since(lastReport) < progressInterval {
+			return
+		}
+		status = p.Phase
+		lastReport = time.Now()
+
+		progress(&pb.PerformBackupEvent{
+			Phase:      pb.BackupPhase_BACKING_UP,
+			Percent:    p.Percent,
+			Bytes:      p.BytesReceived,
+			TotalBytes: p.TotalBytes,
+			Files:      files,
+			Status:     p.Phase,
+			File:       p.File,
+		})
+	}
+}
+
+// addBackupWithProgress adds a backup to IPFS, reporting how many bytes and files have been added
+func (s *Service) addBackupWithProgress(ctx context.Context, backupDir string, totalBytes uint64, progress func(*pb.PerformBackupEvent)) (cid.Cid, error) {
+	events := make(chan interface{}, 16)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var addedBytes, fileBytes int64
+		var files uint64
+		var fileName string
+		var lastReport time.Time
+
+		for e := range events {
+			event, ok := e.(*icore.AddEvent)
+			if !ok {
+				continue
+			}
+
+			// Events with a path are sent once a file or directory has been added
+			if event.Path != nil {
+				files++
+				continue
+			}
+
+			// Progress events report the bytes added of the current file
+			if event.Name != fileName {
+				addedBytes += fileBytes
+				fileName = event.Name
+			}
+			fileBytes = event.Bytes
+
+			if time.Since(lastReport) < progressInterval {
+				continue
+			}
+			lastReport = time.Now()
+
+			bytes := uint64(addedBytes + fileBytes)
+			progress(&pb.PerformBackupEvent{
+				Phase:      pb.BackupPhase_ADDING_TO_IPFS,
+				Percent:    percent(bytes, totalBytes),
+				Bytes:      bytes,
+				TotalBytes: totalBytes,
+				Files:      files,
+			})
+		}
+	}()
+
+	backupCid, err := s.addBackupToIpfs(ctx, backupDir, events)
+	close(events)
+	<-done
+
+	return backupCid, err
+}
+
+// dirSize returns the total size of the files in a directory
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func percent(bytes uint64, totalBytes uint64) float64 {
+	if totalBytes == 0 {
+		return 0
+	}
+
+	p := float64(bytes) / float64(totalBytes) * 100
+	if p > 100 {
+		return 100
+	}
+
+	return p
+}
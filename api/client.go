@@ -30,6 +30,13 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// PerformBackup performs a backup of a device in the daemon and streams its progress
+func (c *Client) PerformBackup(ctx context.Context, deviceID string) (pb.API_PerformBackupClient, error) {
+	return c.c.PerformBackup(ctx, &pb.PerformBackupRequest{
+		DeviceID: deviceID,
+	})
+}
+
 // AddBackup adds a new backup to IPFS
 func (c *Client) AddBackup(ctx context.Context, backupDir string) (*pb.AddBackupReply, error) {
 	return c.c.AddBackup(ctx, &pb.AddBackupRequest{
@@ -37,6 +44,15 @@ func (c *Client) AddBackup(ctx context.Context, backupDir string) (*pb.AddBackup
 	})
 }
 
+// StageBackup writes a backup from IPFS to a local directory so it can be restored
+func (c *Client) StageBackup(ctx context.Context, deviceID string, backupCid string, stagingDir string) (*pb.StageBackupReply, error) {
+	return c.c.StageBackup(ctx, &pb.StageBackupRequest{
+		DeviceID:   deviceID,
+		BackupCid:  backupCid,
+		StagingDir: stagingDir,
+	})
+}
+
 // UpdateLatestBackup saves a reference to the latest backup
 func (c *Client) UpdateLatestBackup(ctx context.Context, deviceID string, backupCid string) (*pb.UpdateLatestBackupReply, error) {
 	return c.c.UpdateLatestBackup(ctx, &pb.UpdateLatestBackupRequest{
@@ -50,7 +66,128 @@ func (c *Client) ListBackups(ctx context.Context) (*pb.ListBackupsReply, error)
 	return c.c.ListBackups(ctx, &pb.ListBackupsRequest{})
 }
 
+// ListBackupHistory lists all snapshots of a device, newest first
+func (c *Client) ListBackupHistory(ctx context.Context, deviceID string) (*pb.ListBackupHistoryReply, error) {
+	return c.c.ListBackupHistory(ctx, &pb.ListBackupHistoryRequest{
+		DeviceID: deviceID,
+	})
+}
+
+// GetBackup gets a single snapshot by ID
+func (c *Client) GetBackup(ctx context.Context, id string) (*pb.GetBackupReply, error) {
+	return c.c.GetBackup(ctx, &pb.GetBackupRequest{
+		Id: id,
+	})
+}
+
+// PruneBackups removes the snapshots of a device that are not kept by a retention policy and unpins their backups
+func (c *Client) PruneBackups(ctx context.Context, deviceID string, policy *pb.RetentionPolicy, dryRun bool) (*pb.PruneBackupsReply, error) {
+	return c.c.PruneBackups(ctx, &pb.PruneBackupsRequest{
+		DeviceID: deviceID,
+		Policy:   policy,
+		DryRun:   dryRun,
+	})
+}
+
+// VerifyBackup checks that every block of a backup is stored locally and that the files needed to restore it can be read.
+// If a password is given, Manifest.db of an encrypted backup is decrypted too
+func (c *Client) VerifyBackup(ctx context.Context, deviceID string, backupCid string, password string) (*pb.VerifyBackupReply, error) {
+	return c.c.VerifyBackup(ctx, &pb.VerifyBackupRequest{
+		DeviceID:  deviceID,
+		BackupCid: backupCid,
+		Password:  password,
+	})
+}
+
+// ListBackupFiles lists the files in a backup below a "Domain/relative/path".
+// The password is only needed for encrypted backups
+func (c *Client) ListBackupFiles(ctx context.Context, deviceID string, backupCid string, path string, recursive bool, password string) (*pb.ListBackupFilesReply, error) {
+	return c.c.ListBackupFiles(ctx, &pb.ListBackupFilesRequest{
+		DeviceID:  deviceID,
+		BackupCid: backupCid,
+		Path:      path,
+		Recursive: recursive,
+		Password:  password,
+	})
+}
+
+// ExtractBackupFile streams a single file from a backup, decrypting it with password if the backup is encrypted
+func (c *Client) ExtractBackupFile(ctx context.Context, deviceID string, backupCid string, path string, password string) (pb.API_ExtractBackupFileClient, error) {
+	return c.c.ExtractBackupFile(ctx, &pb.ExtractBackupFileRequest{
+		DeviceID:  deviceID,
+		BackupCid: backupCid,
+		Path:      path,
+		Password:  password,
+	})
+}
+
+// DiffBackups compares two backups of a device. Individual files are only listed if listFiles is set
+func (c *Client) DiffBackups(ctx context.Context, deviceID string, backupCidA string, backupCidB string, listFiles bool, password string) (*pb.DiffBackupsReply, error) {
+	return c.c.DiffBackups(ctx, &pb.DiffBackupsRequest{
+		DeviceID:   deviceID,
+		BackupCidA: backupCidA,
+		BackupCidB: backupCidB,
+		Password:   password,
+		ListFiles:  listFiles,
+	})
+}
+
+// ListRuns lists the runs of schedules, newest first. Empty filters match every run and a limit of 0 returns all runs
+func (c *Client) ListRuns(ctx context.Context, deviceID string, schedule string, limit uint32) (*pb.ListRunsReply, error) {
+	return c.c.ListRuns(ctx, &pb.ListRunsRequest{
+		DeviceID: deviceID,
+		Schedule: schedule,
+		Limit:    limit,
+	})
+}
+
+// ListSchedules lists the schedules in the config file and the schedules created through the API
+func (c *Client) ListSchedules(ctx context.Context) (*pb.ListSchedulesReply, error) {
+	return c.c.ListSchedules(ctx, &pb.ListSchedulesRequest{})
+}
+
+// CreateSchedule creates a schedule that runs on every node
+func (c *Client) CreateSchedule(ctx context.Context, schedule *pb.Schedule) (*pb.CreateScheduleReply, error) {
+	return c.c.CreateSchedule(ctx, &pb.CreateScheduleRequest{
+		Schedule: schedule,
+	})
+}
+
+// UpdateSchedule replaces the settings of a schedule created through the API
+func (c *Client) UpdateSchedule(ctx context.Context, schedule *pb.Schedule) (*pb.UpdateScheduleReply, error) {
+	return c.c.UpdateSchedule(ctx, &pb.UpdateScheduleRequest{
+		Schedule: schedule,
+	})
+}
+
+// DeleteSchedule deletes a schedule created through the API
+func (c *Client) DeleteSchedule(ctx context.Context, name string) (*pb.DeleteScheduleReply, error) {
+	return c.c.DeleteSchedule(ctx, &pb.DeleteScheduleRequest{
+		Name: name,
+	})
+}
+
+// TriggerSchedule starts a backup of a schedule now
+func (c *Client) TriggerSchedule(ctx context.Context, name string) (*pb.TriggerScheduleReply, error) {
+	return c.c.TriggerSchedule(ctx, &pb.TriggerScheduleRequest{
+		Name: name,
+	})
+}
+
+// ReloadConfig reloads the config of the daemon
+func (c *Client) ReloadConfig(ctx context.Context) (*pb.ReloadConfigReply, error) {
+	return c.c.ReloadConfig(ctx, &pb.ReloadConfigRequest{})
+}
+
 // Export returns the information needed to share backups with another device
 func (c *Client) Export(ctx context.Context) (*pb.ExportReply, error) {
 	return c.c.Export(ctx, &pb.ExportRequest{})
 }
+
+// Invite creates an invite for a new node. The first event has the code, and the next one is sent once a node joined
+func (c *Client) Invite(ctx context.Context, ttlMinutes uint64, storageOnly bool) (pb.API_InviteClient, error) {
+	return c.c.Invite(ctx, &pb.InviteRequest{
+		TtlMinutes:  ttlMinutes,
+		StorageOnly: storageOnly,
+	})
+}
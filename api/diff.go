@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// diffBackup is one of the backups being compared
+type diffBackup struct {
+	path     path.Path
+	deviceID string
+	// files are the files in Manifest.db by file ID
+	files map[string]manifest.File
+	// contents are the CIDs of the files in the DAG by file ID
+	contents map[string]cid.Cid
+}
+
+// DiffBackups compares two backups of a device. Files are compared by the CIDs of their contents,
+// so a file is only reported as changed if its contents changed
+func (s *Service) DiffBackups(ctx context.Context, req *pb.DiffBackupsRequest) (*pb.DiffBackupsReply, error) {
+	a, err := s.openDiffBackup(ctx, req.BackupCidA, idevice.DeviceID(req.DeviceID), req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.openDiffBackup(ctx, req.BackupCidB, idevice.DeviceID(req.DeviceID), req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.deviceID != "" && b.deviceID != "" && a.deviceID != b.deviceID {
+		return nil, status.Errorf(codes.InvalidArgument, "Backups are of different devices: %s and %s", a.deviceID, b.deviceID)
+	}
+
+	domains := map[string]*pb.DomainDiff{}
+	domain := func(name string) *pb.DomainDiff {
+		d, ok := domains[name]
+		if !ok {
+			d = &pb.DomainDiff{Domain: name}
+			domains[name] = d
+		}
+		return d
+	}
+
+	for fileID, f := range b.files {
+		previous, ok := a.files[fileID]
+		switch {
+		case !ok:
+			d := domain(f.Domain)
+			d.AddedFiles++
+			d.AddedBytes += f.Size
+			if req.ListFiles {
+				if d.Added, err = appendBackupFile(d.Added, f); err != nil {
+					return nil, err
+				}
+			}
+		case !a.contents[fileID].Equals(b.contents[fileID]):
+			d := domain(f.Domain)
+			d.ChangedFiles++
+			d.ChangedBytes += f.Size
+			d.PreviousChangedBytes += previous.Size
+			if req.ListFiles {
+				if d.Changed, err = appendBackupFile(d.Changed, f); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for fileID, f := range a.files {
+		if _, ok := b.files[fileID]; ok {
+			continue
+		}
+
+		d := domain(f.Domain)
+		d.RemovedFiles++
+		d.RemovedBytes += f.Size
+		if req.ListFiles {
+			if d.Removed, err = appendBackupFile(d.Removed, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	reply := &pb.DiffBackupsReply{}
+	for _, d := range domains {
+		for _, files := range [][]*pb.BackupFile{d.Added, d.Removed, d.Changed} {
+			sortBackupFiles(files)
+		}
+		reply.Domains = append(reply.Domains, d)
+	}
+	sort.Slice(reply.Domains, func(i, j int) bool {
+		return reply.Domains[i].Domain < reply.Domains[j].Domain
+	})
+
+	// Count the blocks that are stored once for both backups
+	blocksA, err := s.dagBlocks(ctx, a.path)
+	if err != nil {
+		return nil, err
+	}
+
+	blocksB, err := s.dagBlocks(ctx, b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for c, size := range blocksA {
+		reply.BlocksA++
+		reply.BytesA += size
+		if _, ok := blocksB[c]; ok {
+			reply.SharedBlocks++
+			reply.SharedBytes += size
+		}
+	}
+	for _, size := range blocksB {
+		reply.BlocksB++
+		reply.BytesB += size
+	}
+
+	return reply, nil
+}
+
+// openDiffBackup reads the files of a backup from Manifest.db and its DAG
+func (s *Service) openDiffBackup(ctx context.Context, backupCid string, deviceID idevice.DeviceID, password string) (*diffBackup, error) {
+	c, err := cid.Decode(backupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &diffBackup{
+		path:     s.deviceBackupPath(ctx, c, deviceID),
+		files:    map[string]manifest.File{},
+		contents: map[string]cid.Cid{},
+	}
+
+	src := &ipfsBackup{
+		ctx:  ctx,
+		ipfs: s.ipfs,
+		path: b.path,
+	}
+
+	info, err := manifest.ReadInfo(src)
+	if err != nil {
+		return nil, err
+	}
+	b.deviceID = info.UniqueIdentifier
+
+	db, err := manifest.OpenDB(src, password)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	backupFiles, err := db.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range backupFiles {
+		if f.Flags == manifest.FlagFile {
+			b.files[f.FileID] = f
+		}
+	}
+
+	// Files are stored in directories named after the first two characters of their ID
+	dirs, err := s.ipfs.Unixfs().Ls(ctx, b.path, options.Unixfs.ResolveChildren(false))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list backup: %s", err)
+	}
+
+	var prefixes []string
+	for entry := range dirs {
+		if entry.Err != nil {
+			return nil, fmt.Errorf("Failed to list backup: %s", entry.Err)
+		}
+
+		if len(entry.Name) == 2 {
+			prefixes = append(prefixes, entry.Name)
+		}
+	}
+
+	for _, prefix := range prefixes {
+		entries, err := s.ipfs.Unixfs().Ls(ctx, path.Join(b.path, prefix), options.Unixfs.ResolveChildren(false))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list backup: %s", err)
+		}
+
+		for entry := range entries {
+			if entry.Err != nil {
+				return nil, fmt.Errorf("Failed to list backup: %s", entry.Err)
+			}
+
+			b.contents[entry.Name] = entry.Cid
+		}
+	}
+
+	return b, nil
+}
+
+// dagBlocks returns the size of every block of a DAG by CID
+func (s *Service) dagBlocks(ctx context.Context, p path.Path) (map[cid.Cid]uint64, error) {
+	root, err := s.ipfs.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find backup: %s", err)
+	}
+
+	blocks := map[cid.Cid]uint64{}
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if _, ok := blocks[c]; ok {
+			return nil
+		}
+
+		node, err := s.ipfs.Dag().Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		blocks[c] = uint64(len(node.RawData()))
+
+		for _, link := range node.Links() {
+			if err := walk(link.Cid); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(root.Cid()); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+func appendBackupFile(files []*pb.BackupFile, f manifest.File) ([]*pb.BackupFile, error) {
+	pbFile, err := backupFileToPb(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(files, pbFile), nil
+}
+
+func sortBackupFiles(files []*pb.BackupFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelativePath < files[j].RelativePath
+	})
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/invite"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/textileio/go-threads/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryErrorInterceptor converts errors returned by the service to gRPC status errors
+func UnaryErrorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, statusFromError(err)
+}
+
+// StreamErrorInterceptor converts errors returned by the service to gRPC status errors
+func StreamErrorInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return statusFromError(handler(srv, ss))
+}
+
+// IsRetryable returns true if a request that failed with err may succeed if it is tried again later
+func IsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+
+	return false
+}
+
+// statusFromError derives the gRPC status code of an error from the errors it wraps
+func statusFromError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Error(codeFromError(err), err.Error())
+}
+
+func codeFromError(err error) codes.Code {
+	switch {
+	case errors.Is(err, idevice.ErrDeviceNotFound), errors.Is(err, idevice.ErrTransportLost):
+		return codes.Unavailable
+	case errors.Is(err, idevice.ErrBackupInProgress):
+		return codes.Aborted
+	case errors.Is(err, idevice.ErrPasscodeLocked):
+		// The device can be unlocked and the request tried again
+		return codes.Unavailable
+	case errors.Is(err, idevice.ErrNotPaired), errors.Is(err, idevice.ErrEncryptionRequired):
+		return codes.FailedPrecondition
+	case errors.Is(err, idevice.ErrUserDeniedTrust), errors.Is(err, invite.ErrTooManyAttempts):
+		return codes.PermissionDenied
+	case errors.Is(err, idevice.ErrDiskFull):
+		return codes.ResourceExhausted
+	case errors.Is(err, manifest.ErrEncrypted), errors.Is(err, ErrNoMetadataKey):
+		return codes.FailedPrecondition
+	case errors.Is(err, manifest.ErrWrongPassword):
+		return codes.Unauthenticated
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, manifest.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+
+	return codes.Unknown
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Size of the chunks a file is streamed in, well below the default gRPC message limit
+const extractChunkSize = 256 * 1024
+
+// ListBackupFiles lists the files in a backup by their path on the device
+func (s *Service) ListBackupFiles(ctx context.Context, req *pb.ListBackupFilesRequest) (*pb.ListBackupFilesReply, error) {
+	backupCid, err := cid.Decode(req.BackupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := s.openManifestDB(ctx, s.deviceBackupPath(ctx, backupCid, idevice.DeviceID(req.DeviceID)), req.Password)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	backupFiles, err := db.List(req.Path, req.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	var pbFiles []*pb.BackupFile
+	for _, f := range backupFiles {
+		pbFile, err := backupFileToPb(f)
+		if err != nil {
+			return nil, err
+		}
+
+		pbFiles = append(pbFiles, pbFile)
+	}
+
+	return &pb.ListBackupFilesReply{
+		Files: pbFiles,
+	}, nil
+}
+
+// ExtractBackupFile streams a single file from a backup.
+// The first message describes the file and the following messages contain its data.
+// Only the blocks of Manifest.db and the file are fetched from IPFS.
+// Files of encrypted backups are decrypted while they are streamed
+func (s *Service) ExtractBackupFile(req *pb.ExtractBackupFileRequest, stream pb.API_ExtractBackupFileServer) error {
+	ctx := stream.Context()
+
+	backupCid, err := cid.Decode(req.BackupCid)
+	if err != nil {
+		return err
+	}
+
+	backupPath := s.deviceBackupPath(ctx, backupCid, idevice.DeviceID(req.DeviceID))
+	db, err := s.openManifestDB(ctx, backupPath, req.Password)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := db.Find(req.Path)
+	if err != nil {
+		return err
+	}
+
+	if f.Flags != manifest.FlagFile {
+		return fmt.Errorf("%s is not a file", f.Path())
+	}
+
+	node, err := s.ipfs.Unixfs().Get(ctx, path.Join(backupPath, f.ContentPath()))
+	if err != nil {
+		return fmt.Errorf("Failed to get %s from IPFS: %s", f.Path(), err)
+	}
+	defer node.Close()
+
+	contents, ok := node.(files.File)
+	if !ok {
+		return fmt.Errorf("%s is not a file", f.ContentPath())
+	}
+
+	r, err := db.Decrypt(*f, contents)
+	if err != nil {
+		return err
+	}
+
+	pbFile, err := backupFileToPb(*f)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&pb.ExtractBackupFileReply{File: pbFile}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, extractChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&pb.ExtractBackupFileReply{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", f.Path(), err)
+		}
+	}
+}
+
+// openManifestDB opens Manifest.db of a backup in IPFS. The password is only needed for encrypted backups
+func (s *Service) openManifestDB(ctx context.Context, backupPath path.Path, password string) (*manifest.DB, error) {
+	return manifest.OpenDB(&ipfsBackup{
+		ctx:  ctx,
+		ipfs: s.ipfs,
+		path: backupPath,
+	}, password)
+}
+
+func backupFileToPb(f manifest.File) (*pb.BackupFile, error) {
+	pbFile := &pb.BackupFile{
+		Domain:       f.Domain,
+		RelativePath: f.RelativePath,
+		FileID:       f.FileID,
+		Flags:        uint32(f.Flags),
+		Size:         f.Size,
+		Mode:         f.Mode,
+	}
+
+	if !f.LastModified.IsZero() {
+		t, err := ptypes.TimestampProto(f.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		pbFile.LastModified = t
+	}
+
+	return pbFile, nil
+}
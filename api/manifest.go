@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// ipfsBackup is a manifest.Source that reads a backup from IPFS
+type ipfsBackup struct {
+	ctx  context.Context
+	ipfs icore.CoreAPI
+	path path.Path
+}
+
+// ReadFile reads a file at the root of the backup
+func (b *ipfsBackup) ReadFile(name string) ([]byte, error) {
+	node, err := b.ipfs.Unixfs().Get(b.ctx, path.Join(b.path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer node.Close()
+
+	f, ok := node.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a file", name)
+	}
+
+	return ioutil.ReadAll(f)
+}
+
+// summarizeBackup reads the metadata of a backup from IPFS
+func (s *Service) summarizeBackup(ctx context.Context, backupCid cid.Cid, deviceID idevice.DeviceID) (*manifest.Summary, error) {
+	return manifest.Summarize(&ipfsBackup{
+		ctx:  ctx,
+		ipfs: s.ipfs,
+		path: s.deviceBackupPath(ctx, backupCid, deviceID),
+	}, s.backupPassword)
+}
+
+// SetBackupPassword sets the password used to count the files of encrypted backups when they are summarized
+func (s *Service) SetBackupPassword(password string) {
+	s.backupPassword = password
+}
+
+func summaryToPb(summary *manifest.Summary) (*pb.BackupSummary, error) {
+	if summary == nil {
+		return nil, nil
+	}
+
+	t, err := ptypes.TimestampProto(summary.BackupDate)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []*pb.DomainFileCount
+	for domain, count := range summary.DomainFileCounts {
+		domains = append(domains, &pb.DomainFileCount{
+			Domain: domain,
+			Files:  count,
+		})
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Domain < domains[j].Domain
+	})
+
+	return &pb.BackupSummary{
+		DeviceName:     summary.DeviceName,
+		ProductType:    summary.ProductType,
+		ProductVersion: summary.ProductVersion,
+		BuildVersion:   summary.BuildVersion,
+		BackupDate:     t,
+		IsEncrypted:    summary.IsEncrypted,
+		IsFullBackup:   summary.IsFullBackup,
+		Applications:   summary.Applications,
+		Domains:        domains,
+	}, nil
+}
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/db"
+	"github.com/textileio/go-threads/util"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MetadataKeySize is the size of the secret metadata keys are derived from
+const MetadataKeySize = 32
+
+// ErrNoMetadataKey is returned when a node without the metadata key reads or writes metadata
+var ErrNoMetadataKey = errors.New("This node does not have the metadata key")
+
+// MetadataKey encrypts the metadata of backups before it is written to the thread, so a node that replicates
+// the thread without the key can not tell which devices are backed up
+type MetadataKey struct {
+	aead  cipher.AEAD
+	idKey []byte
+}
+
+// NewMetadataKey derives the keys that encrypt metadata and hide instance IDs from a secret
+func NewMetadataKey(secret []byte) (*MetadataKey, error) {
+	if len(secret) < MetadataKeySize {
+		return nil, fmt.Errorf("Metadata key must be at least %d bytes", MetadataKeySize)
+	}
+
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("ipfs-ios-backup metadata"))
+
+	encKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, encKey); err != nil {
+		return nil, err
+	}
+
+	idKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, idKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetadataKey{
+		aead:  aead,
+		idKey: idKey,
+	}, nil
+}
+
+// instanceID returns an instance ID for a value that only nodes with the key can compute, e.g. a device ID
+func (k *MetadataKey) instanceID(kind string, value string) core.InstanceID {
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write([]byte(kind + "/" + value))
+
+	return core.InstanceID(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// seal encrypts v as JSON. The instance ID is authenticated, so sealed data can not be moved to another instance
+func (k *MetadataKey) seal(id core.InstanceID, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := k.aead.Seal(nonce, nonce, plaintext, []byte(id))
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts data sealed by seal into v
+func (k *MetadataKey) open(id core.InstanceID, sealed string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt metadata: %s", err)
+	}
+
+	if len(b) < k.aead.NonceSize() {
+		return fmt.Errorf("Failed to decrypt metadata: too short")
+	}
+
+	plaintext, err := k.aead.Open(nil, b[:k.aead.NonceSize()], b[k.aead.NonceSize():], []byte(id))
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt metadata: %s", err)
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
+
+// OpenBackup reads a backup from the thread by its instance ID
+func (s *Service) OpenBackup(id core.InstanceID) (*Backup, error) {
+	v, err := s.backupCollection.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := &SealedBackup{}
+	util.InstanceFromJSON(v, sealed)
+
+	return s.openBackup(sealed)
+}
+
+// MigrateLegacyBackups seals the backups written in plain text by older versions, and removes the plain text.
+// Backups that are already sealed are only replaced by newer ones
+func (s *Service) MigrateLegacyBackups() error {
+	return s.migrateLegacy("Backup", func(v []byte) (core.InstanceID, error) {
+		legacy := &LegacyBackup{}
+		util.InstanceFromJSON(v, legacy)
+
+		backup := &Backup{
+			DeviceID:        legacy.ID.String(),
+			LatestBackupCid: legacy.LatestBackupCid,
+			UpdatedAt:       legacy.UpdatedAt,
+			Summary:         legacy.Summary,
+		}
+
+		existing, err := s.OpenBackup(s.backupID(backup.DeviceID))
+		if err != nil && err != db.ErrNotFound {
+			return "", err
+		}
+
+		if existing == nil || existing.UpdatedAt.Before(backup.UpdatedAt) {
+			if err := s.saveBackup(backup); err != nil {
+				return "", err
+			}
+		}
+
+		return legacy.ID, nil
+	})
+}
+
+// MigrateLegacyRecords seals the snapshots, runs, schedules and remote pins written in plain text by older versions,
+// and removes the plain text. Records that are already sealed are only replaced by newer ones
+func (s *Service) MigrateLegacyRecords() error {
+	err := s.migrateLegacy("Snapshot", func(v []byte) (core.InstanceID, error) {
+		snapshot := &Snapshot{}
+		util.InstanceFromJSON(v, snapshot)
+
+		// Snapshots keep their random IDs, which do not reveal anything
+		exists, err := s.snapshotCollection.Has(snapshot.ID)
+		if err != nil || exists {
+			return snapshot.ID, err
+		}
+
+		return snapshot.ID, s.saveRecord(s.snapshotCollection, snapshot.ID, snapshot)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.migrateLegacy("Run", func(v []byte) (core.InstanceID, error) {
+		run := &Run{}
+		util.InstanceFromJSON(v, run)
+
+		exists, err := s.runCollection.Has(run.ID)
+		if err != nil || exists {
+			return run.ID, err
+		}
+
+		return run.ID, s.saveRecord(s.runCollection, run.ID, run)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.migrateLegacy("Schedule", func(v []byte) (core.InstanceID, error) {
+		legacy := &LegacySchedule{}
+		util.InstanceFromJSON(v, legacy)
+
+		schedule := &Schedule{
+			Name:      legacy.ID.String(),
+			Settings:  legacy.Settings,
+			CreatedAt: legacy.CreatedAt,
+			UpdatedAt: legacy.UpdatedAt,
+		}
+
+		id := s.scheduleID(schedule.Name)
+		existing := &Schedule{}
+		err := s.findRecord(s.scheduleCollection, id, existing)
+		if err != nil && err != db.ErrNotFound {
+			return "", err
+		}
+
+		if err == db.ErrNotFound || existing.UpdatedAt.Before(schedule.UpdatedAt) {
+			if err := s.saveRecord(s.scheduleCollection, id, schedule); err != nil {
+				return "", err
+			}
+		}
+
+		return legacy.ID, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.migrateLegacy("RemotePin", func(v []byte) (core.InstanceID, error) {
+		pin := &RemotePin{}
+		util.InstanceFromJSON(v, pin)
+		legacyID := pin.ID
+
+		pin.ID = s.remotePinID(pin.Service, pin.BackupCid)
+		existing := &RemotePin{}
+		err := s.findRecord(s.remotePinCollection, pin.ID, existing)
+		if err != nil && err != db.ErrNotFound {
+			return "", err
+		}
+
+		if err == db.ErrNotFound || existing.UpdatedAt.Before(pin.UpdatedAt) {
+			if err := s.saveRecord(s.remotePinCollection, pin.ID, pin); err != nil {
+				return "", err
+			}
+		}
+
+		return legacyID, nil
+	})
+}
+
+// migrateLegacy seals every instance of a collection written in plain text by older versions with migrate, which
+// returns the ID of the instance, and deletes it
+func (s *Service) migrateLegacy(name string, migrate func(v []byte) (core.InstanceID, error)) error {
+	legacyCollection := s.d.GetCollection(name)
+	if legacyCollection == nil {
+		return nil
+	}
+
+	results, err := legacyCollection.Find(&db.Query{})
+	if err != nil || len(results) == 0 {
+		return err
+	}
+
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	for _, v := range results {
+		id, err := migrate(v)
+		if err != nil {
+			return err
+		}
+
+		if err := legacyCollection.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LegacyBackup is a Backup as older versions stored it in the thread, in plain text. Its collection is kept so
+// backups made by nodes that have not been upgraded yet are replicated and can be sealed
+type LegacyBackup struct {
+	ID              core.InstanceID `json:"_id"` // DeviceID
+	LatestBackupCid string
+	UpdatedAt       time.Time
+	Summary         *manifest.Summary
+}
+
+// backups returns the latest backup of every device
+func (s *Service) backups() ([]*Backup, error) {
+	results, err := s.backupCollection.Find(&db.Query{})
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []*Backup
+	for _, v := range results {
+		sealed := &SealedBackup{}
+		util.InstanceFromJSON(v, sealed)
+
+		backup, err := s.openBackup(sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, backup)
+	}
+
+	return backups, nil
+}
+
+// saveBackup seals a backup and saves it as the latest backup of its device
+func (s *Service) saveBackup(backup *Backup) error {
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	return s.saveRecord(s.backupCollection, s.backupID(backup.DeviceID), backup)
+}
+
+func (s *Service) openBackup(sealed *SealedBackup) (*Backup, error) {
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	backup := &Backup{}
+	if err := s.metadataKey.open(sealed.ID, sealed.Sealed, backup); err != nil {
+		return nil, err
+	}
+
+	return backup, nil
+}
+
+// backupID is the instance ID of the latest backup of a device
+func (s *Service) backupID(deviceID string) core.InstanceID {
+	return s.metadataKey.instanceID("backup", deviceID)
+}
+
+// saveRecord seals v and creates or replaces the instance of a collection with the ID
+func (s *Service) saveRecord(c *db.Collection, id core.InstanceID, v interface{}) error {
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	data, err := s.metadataKey.seal(id, v)
+	if err != nil {
+		return err
+	}
+
+	sealed := &SealedRecord{
+		ID:     id,
+		Sealed: data,
+	}
+
+	exists, err := c.Has(id)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return c.Save(util.JSONFromInstance(sealed))
+	}
+
+	_, err = c.Create(util.JSONFromInstance(sealed))
+
+	return err
+}
+
+// findRecord reads the instance of a collection with the ID into v. db.ErrNotFound is returned if there is none
+func (s *Service) findRecord(c *db.Collection, id core.InstanceID, v interface{}) error {
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	raw, err := c.FindByID(id)
+	if err != nil {
+		return err
+	}
+
+	sealed := &SealedRecord{}
+	util.InstanceFromJSON(raw, sealed)
+
+	return s.metadataKey.open(sealed.ID, sealed.Sealed, v)
+}
+
+// sealedRecords returns every instance of a collection. They are opened with the metadata key
+func (s *Service) sealedRecords(c *db.Collection) ([]*SealedRecord, error) {
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	results, err := c.Find(&db.Query{})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*SealedRecord
+	for _, v := range results {
+		sealed := &SealedRecord{}
+		util.InstanceFromJSON(v, sealed)
+		records = append(records, sealed)
+	}
+
+	return records, nil
+}
+
+// scheduleID is the instance ID of a schedule created through the API
+func (s *Service) scheduleID(name string) core.InstanceID {
+	return s.metadataKey.instanceID("schedule", name)
+}
+
+// remotePinID is the instance ID of the remote pin of a backup on a pinning service
+func (s *Service) remotePinID(service string, backupCid string) core.InstanceID {
+	return s.metadataKey.instanceID("remotePin", service+"/"+backupCid)
+}
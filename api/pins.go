@@ -0,0 +1,129 @@
+package api
+
+import (
+	"sort"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/pinning"
+	"github.com/golang/protobuf/ptypes"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/db"
+)
+
+// RemotePin is a request to a pinning service to pin a backup. There is one per service and backup,
+// shared with every node in the thread. It is sealed with the metadata key before it is written to the thread
+type RemotePin struct {
+	ID        core.InstanceID `json:"_id"` // Keyed hash of the Service and BackupCid
+	Service   string
+	BackupCid string
+	DeviceID  string
+	RequestID string
+	Status    pinning.Status
+	// Reason explains why pinning failed
+	Reason    string
+	NodeID    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetRemotePin returns the remote pin of a backup on a pinning service, or nil if it has not been requested
+func (s *Service) GetRemotePin(service string, backupCid string) (*RemotePin, error) {
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	pin := &RemotePin{}
+	err := s.findRecord(s.remotePinCollection, s.remotePinID(service, backupCid), pin)
+	if err == db.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pin, nil
+}
+
+// SaveRemotePin records a remote pin or updates its status
+func (s *Service) SaveRemotePin(pin *RemotePin) error {
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	pin.ID = s.remotePinID(pin.Service, pin.BackupCid)
+	pin.UpdatedAt = time.Now()
+	if pin.CreatedAt.IsZero() {
+		pin.CreatedAt = pin.UpdatedAt
+	}
+
+	return s.saveRecord(s.remotePinCollection, pin.ID, pin)
+}
+
+// DeleteRemotePin forgets a remote pin once it has been removed from its pinning service
+func (s *Service) DeleteRemotePin(pin *RemotePin) error {
+	if s.metadataKey == nil {
+		return ErrNoMetadataKey
+	}
+
+	err := s.remotePinCollection.Delete(s.remotePinID(pin.Service, pin.BackupCid))
+	if err == db.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// RemotePins returns the remote pins of a backup on every pinning service, or of every backup if backupCid is empty
+func (s *Service) RemotePins(backupCid string) ([]*RemotePin, error) {
+	records, err := s.sealedRecords(s.remotePinCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var pins []*RemotePin
+	for _, sealed := range records {
+		pin := &RemotePin{}
+		if err := s.metadataKey.open(sealed.ID, sealed.Sealed, pin); err != nil {
+			return nil, err
+		}
+
+		if backupCid == "" || pin.BackupCid == backupCid {
+			pins = append(pins, pin)
+		}
+	}
+
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Service < pins[j].Service
+	})
+
+	return pins, nil
+}
+
+func remotePinToPb(pin *RemotePin) (*pb.RemotePin, error) {
+	t, err := ptypes.TimestampProto(pin.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RemotePin{
+		Service:   pin.Service,
+		RequestID: pin.RequestID,
+		Status:    remotePinStatusToPb(pin.Status),
+		Reason:    pin.Reason,
+		UpdatedAt: t,
+	}, nil
+}
+
+func remotePinStatusToPb(status pinning.Status) pb.RemotePinStatus {
+	switch status {
+	case pinning.Pinning:
+		return pb.RemotePinStatus_PIN_PINNING
+	case pinning.Pinned:
+		return pb.RemotePinStatus_PIN_PINNED
+	case pinning.Failed:
+		return pb.RemotePinStatus_PIN_FAILED
+	}
+
+	return pb.RemotePinStatus_PIN_QUEUED
+}
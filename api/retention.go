@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/ipfs/go-cid"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// RetentionPolicy decides which snapshots of a device are kept.
+// A snapshot is kept if any of the keep rules match it. Snapshots older than MaxAge are always removed.
+// The latest snapshot of a device is never removed.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      time.Duration
+}
+
+// IsEmpty returns true if the policy keeps every snapshot
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.MaxAge == 0
+}
+
+// Apply splits snapshots, sorted newest first, into the ones to keep and the ones to remove
+func (p RetentionPolicy) Apply(snapshots []*Snapshot, now time.Time) (keep []*Snapshot, remove []*Snapshot) {
+	if p.IsEmpty() {
+		return snapshots, nil
+	}
+
+	// Only MaxAge is set, so every snapshot younger than it is kept
+	onlyMaxAge := p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	months := map[string]bool{}
+
+	for i, snapshot := range snapshots {
+		t := snapshot.CreatedAt.Local()
+		kept := i == 0 || i < p.KeepLast || onlyMaxAge
+
+		// Keep the newest snapshot of each period
+		day := t.Format("2006-01-02")
+		if !days[day] && len(days) < p.KeepDaily {
+			days[day] = true
+			kept = true
+		}
+
+		year, w := t.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+		if !weeks[week] && len(weeks) < p.KeepWeekly {
+			weeks[week] = true
+			kept = true
+		}
+
+		month := t.Format("2006-01")
+		if !months[month] && len(months) < p.KeepMonthly {
+			months[month] = true
+			kept = true
+		}
+
+		if i > 0 && p.MaxAge > 0 && now.Sub(snapshot.CreatedAt) > p.MaxAge {
+			kept = false
+		}
+
+		if kept {
+			keep = append(keep, snapshot)
+		} else {
+			remove = append(remove, snapshot)
+		}
+	}
+
+	return keep, remove
+}
+
+// BackupIsReferenced checks if a backup is the latest backup of a device or belongs to a snapshot that has not been pruned
+func (s *Service) BackupIsReferenced(backupCid string) (bool, error) {
+	backups, err := s.backups()
+	if err != nil {
+		return false, err
+	}
+
+	for _, backup := range backups {
+		if backup.LatestBackupCid == backupCid {
+			return true, nil
+		}
+	}
+
+	snapshots, err := s.allSnapshots()
+	if err != nil {
+		return false, err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.BackupCid == backupCid && snapshot.PrunedAt.IsZero() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// UnpinBackup removes the pin of a backup if it is pinned
+func UnpinBackup(ctx context.Context, ipfs icore.CoreAPI, backupCid cid.Cid) (bool, error) {
+	pins, err := ipfs.Pin().Ls(ctx, options.Pin.Type.Recursive())
+	if err != nil {
+		return false, err
+	}
+
+	for _, pin := range pins {
+		if pin.Path().Cid().Equals(backupCid) {
+			return true, ipfs.Pin().Rm(ctx, path.IpfsPath(backupCid))
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Service) pruneSnapshots(ctx context.Context, snapshots []*Snapshot) error {
+	// Mark snapshots as pruned so other nodes stop pinning them
+	prunedAt := time.Now()
+	for _, snapshot := range snapshots {
+		snapshot.PrunedAt = prunedAt
+		if err := s.saveRecord(s.snapshotCollection, snapshot.ID, snapshot); err != nil {
+			return err
+		}
+	}
+
+	unpinned := false
+	for _, snapshot := range snapshots {
+		referenced, err := s.BackupIsReferenced(snapshot.BackupCid)
+		if err != nil {
+			return err
+		}
+
+		if referenced {
+			continue
+		}
+
+		id, err := cid.Decode(snapshot.BackupCid)
+		if err != nil {
+			return err
+		}
+
+		wasPinned, err := UnpinBackup(ctx, s.ipfs, id)
+		if err != nil {
+			return fmt.Errorf("Failed to unpin backup: %s", err)
+		}
+		unpinned = unpinned || wasPinned
+	}
+
+	if !unpinned {
+		return nil
+	}
+
+	return s.gc(ctx)
+}
+
+func retentionPolicyFromPb(policy *pb.RetentionPolicy) RetentionPolicy {
+	if policy == nil {
+		return RetentionPolicy{}
+	}
+
+	return RetentionPolicy{
+		KeepLast:    int(policy.KeepLast),
+		KeepDaily:   int(policy.KeepDaily),
+		KeepWeekly:  int(policy.KeepWeekly),
+		KeepMonthly: int(policy.KeepMonthly),
+		MaxAge:      time.Duration(policy.MaxAgeInDays) * 24 * time.Hour,
+	}
+}
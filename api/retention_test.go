@@ -0,0 +1,117 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyApply(t *testing.T) {
+	// Apply groups snapshots by local day, week and month
+	day := func(month time.Month, d int, hour int) time.Time {
+		return time.Date(2020, month, d, hour, 0, 0, 0, time.Local)
+	}
+	now := day(time.June, 17, 13)
+
+	// Newest first, as Apply expects
+	snapshots := []*Snapshot{
+		{ID: "a", CreatedAt: day(time.June, 17, 12)}, // Wednesday, week 25
+		{ID: "b", CreatedAt: day(time.June, 16, 18)}, // Tuesday, week 25
+		{ID: "c", CreatedAt: day(time.June, 16, 9)},  // Tuesday, week 25
+		{ID: "d", CreatedAt: day(time.June, 15, 12)}, // Monday, week 25
+		{ID: "e", CreatedAt: day(time.June, 14, 12)}, // Sunday, week 24
+		{ID: "f", CreatedAt: day(time.June, 10, 12)}, // Wednesday, week 24
+		{ID: "g", CreatedAt: day(time.June, 3, 12)},  // Wednesday, week 23
+		{ID: "h", CreatedAt: day(time.May, 20, 12)},  // Wednesday, week 21
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		keep   []string
+	}{
+		{
+			name:   "empty policy keeps everything",
+			policy: RetentionPolicy{},
+			keep:   []string{"a", "b", "c", "d", "e", "f", "g", "h"},
+		},
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 3},
+			keep:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "keep daily keeps the newest snapshot of each day",
+			policy: RetentionPolicy{KeepDaily: 3},
+			keep:   []string{"a", "b", "d"},
+		},
+		{
+			name:   "keep weekly keeps the newest snapshot of each week",
+			policy: RetentionPolicy{KeepWeekly: 3},
+			keep:   []string{"a", "e", "g"},
+		},
+		{
+			name:   "keep daily and weekly overlap on the newest snapshot",
+			policy: RetentionPolicy{KeepDaily: 2, KeepWeekly: 2},
+			keep:   []string{"a", "b", "e"},
+		},
+		{
+			name:   "keep daily and weekly overlap on several days",
+			policy: RetentionPolicy{KeepDaily: 4, KeepWeekly: 4},
+			keep:   []string{"a", "b", "d", "e", "g", "h"},
+		},
+		{
+			name:   "keep last and daily overlap",
+			policy: RetentionPolicy{KeepLast: 2, KeepDaily: 2},
+			keep:   []string{"a", "b"},
+		},
+		{
+			name:   "keep last, daily and weekly",
+			policy: RetentionPolicy{KeepLast: 3, KeepDaily: 3, KeepWeekly: 3},
+			keep:   []string{"a", "b", "c", "d", "e", "g"},
+		},
+		{
+			name:   "keep monthly",
+			policy: RetentionPolicy{KeepMonthly: 2},
+			keep:   []string{"a", "h"},
+		},
+		{
+			name:   "max age removes snapshots that keep rules match",
+			policy: RetentionPolicy{KeepWeekly: 4, MaxAge: 7 * 24 * time.Hour},
+			keep:   []string{"a", "e"},
+		},
+		{
+			name:   "only max age keeps every snapshot younger than it",
+			policy: RetentionPolicy{MaxAge: 3 * 24 * time.Hour},
+			keep:   []string{"a", "b", "c", "d"},
+		},
+		{
+			name:   "the latest snapshot is never removed",
+			policy: RetentionPolicy{MaxAge: time.Minute},
+			keep:   []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, remove := test.policy.Apply(snapshots, now)
+
+			if got := snapshotIDs(keep); !reflect.DeepEqual(got, test.keep) {
+				t.Errorf("kept %v, want %v", got, test.keep)
+			}
+
+			if len(keep)+len(remove) != len(snapshots) {
+				t.Errorf("kept %d and removed %d of %d snapshots", len(keep), len(remove), len(snapshots))
+			}
+		})
+	}
+}
+
+func snapshotIDs(snapshots []*Snapshot) []string {
+	ids := []string{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.ID.String())
+	}
+
+	return ids
+}
@@ -0,0 +1,71 @@
+package api
+
+// CopyRecords copies every record of the thread to the thread of dst, e.g. when the secrets are rotated.
+// Records are sealed again with the metadata key of dst
+func (s *Service) CopyRecords(dst *Service) error {
+	if err := s.MigrateLegacyBackups(); err != nil {
+		return err
+	}
+	if err := s.MigrateLegacyRecords(); err != nil {
+		return err
+	}
+
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		if err := dst.saveBackup(backup); err != nil {
+			return err
+		}
+	}
+
+	// Records are sealed again, and the instance IDs derived from the metadata key change with it
+	snapshots, err := s.allSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if err := dst.saveRecord(dst.snapshotCollection, snapshot.ID, snapshot); err != nil {
+			return err
+		}
+	}
+
+	runs, err := s.findRuns(func(*Run) bool { return true })
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		if err := dst.saveRecord(dst.runCollection, run.ID, run); err != nil {
+			return err
+		}
+	}
+
+	schedules, err := s.StoredSchedules()
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		if err := dst.saveRecord(dst.scheduleCollection, dst.scheduleID(schedule.Name), schedule); err != nil {
+			return err
+		}
+	}
+
+	pins, err := s.RemotePins("")
+	if err != nil {
+		return err
+	}
+
+	for _, pin := range pins {
+		pin.ID = dst.remotePinID(pin.Service, pin.BackupCid)
+		if err := dst.saveRecord(dst.remotePinCollection, pin.ID, pin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
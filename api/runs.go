@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/golang/protobuf/ptypes"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// RunOutcome is how a scheduled backup ended
+type RunOutcome string
+
+const (
+	RunRunning   RunOutcome = "running"
+	RunSucceeded RunOutcome = "succeeded"
+	RunSkipped   RunOutcome = "skipped"
+	RunFailed    RunOutcome = "failed"
+	RunCancelled RunOutcome = "cancelled"
+)
+
+// Run is a single attempt of a schedule to back up a device. Runs are recorded when they start and updated when they end.
+// They are sealed with the metadata key before they are written to the thread
+type Run struct {
+	ID        core.InstanceID `json:"_id"`
+	Schedule  string
+	DeviceID  string
+	NodeID    string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Outcome   RunOutcome
+	// Reason explains why a run was skipped, failed or cancelled
+	Reason    string
+	BackupCid string
+}
+
+// ListRuns lists the runs of schedules, newest first
+func (s *Service) ListRuns(ctx context.Context, req *pb.ListRunsRequest) (*pb.ListRunsReply, error) {
+	runs, err := s.findRuns(func(run *Run) bool {
+		return (req.DeviceID == "" || run.DeviceID == req.DeviceID) && (req.Schedule == "" || run.Schedule == req.Schedule)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Limit > 0 && len(runs) > int(req.Limit) {
+		runs = runs[:req.Limit]
+	}
+
+	var results []*pb.Run
+	for _, run := range runs {
+		pbRun, err := runToPb(run)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, pbRun)
+	}
+
+	return &pb.ListRunsReply{
+		Runs: results,
+	}, nil
+}
+
+// StartRun records that this node started a run of a schedule
+func (s *Service) StartRun(ctx context.Context, schedule string, deviceID idevice.DeviceID) (*Run, error) {
+	self, err := s.ipfs.Key().Self(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{
+		ID:        core.NewInstanceID(),
+		Schedule:  schedule,
+		DeviceID:  string(deviceID),
+		NodeID:    self.ID().Pretty(),
+		StartedAt: time.Now(),
+		Outcome:   RunRunning,
+	}
+
+	if err := s.saveRecord(s.runCollection, run.ID, run); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// FinishRun records how a run ended
+func (s *Service) FinishRun(run *Run, outcome RunOutcome, reason string, backupCid string) error {
+	run.EndedAt = time.Now()
+	run.Outcome = outcome
+	run.Reason = reason
+	run.BackupCid = backupCid
+
+	return s.saveRecord(s.runCollection, run.ID, run)
+}
+
+// NodeRuns returns the runs of a schedule on this node, newest first
+func (s *Service) NodeRuns(ctx context.Context, schedule string) ([]*Run, error) {
+	self, err := s.ipfs.Key().Self(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Schedules are configured per node, so runs of a schedule with the same name on another node are unrelated
+	nodeID := self.ID().Pretty()
+	return s.findRuns(func(run *Run) bool {
+		return run.Schedule == schedule && run.NodeID == nodeID
+	})
+}
+
+// findRuns returns the runs match returns true for, newest first
+func (s *Service) findRuns(match func(*Run) bool) ([]*Run, error) {
+	records, err := s.sealedRecords(s.runCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*Run
+	for _, sealed := range records {
+		run := &Run{}
+		if err := s.metadataKey.open(sealed.ID, sealed.Sealed, run); err != nil {
+			return nil, err
+		}
+
+		if match(run) {
+			runs = append(runs, run)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+
+	return runs, nil
+}
+
+func runToPb(run *Run) (*pb.Run, error) {
+	startedAt, err := ptypes.TimestampProto(run.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	pbRun := &pb.Run{
+		Id:        run.ID.String(),
+		Schedule:  run.Schedule,
+		DeviceID:  run.DeviceID,
+		NodeID:    run.NodeID,
+		StartedAt: startedAt,
+		Outcome:   runOutcomeToPb(run.Outcome),
+		Reason:    run.Reason,
+		BackupCid: run.BackupCid,
+	}
+
+	if !run.EndedAt.IsZero() {
+		if pbRun.EndedAt, err = ptypes.TimestampProto(run.EndedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return pbRun, nil
+}
+
+func runOutcomeToPb(outcome RunOutcome) pb.RunOutcome {
+	switch outcome {
+	case RunSucceeded:
+		return pb.RunOutcome_SUCCEEDED
+	case RunSkipped:
+		return pb.RunOutcome_SKIPPED
+	case RunFailed:
+		return pb.RunOutcome_FAILED
+	case RunCancelled:
+		return pb.RunOutcome_CANCELLED
+	}
+
+	return pb.RunOutcome_RUNNING
+}
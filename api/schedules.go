@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Schedule is a backup schedule created through the API. It is shared with every node in the thread, sealed with
+// the metadata key. Settings have the same keys as a schedule in the config file
+type Schedule struct {
+	Name      string
+	Settings  map[string]interface{}
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// LegacySchedule is a Schedule as older versions stored it in the thread, in plain text
+type LegacySchedule struct {
+	ID        core.InstanceID `json:"_id"` // Name
+	Settings  map[string]interface{}
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Scheduler runs the schedules of the daemon
+type Scheduler interface {
+	// ValidateSchedule returns an error if the settings of a schedule are invalid
+	ValidateSchedule(name string, settings map[string]interface{}) error
+	// ConfigSchedules returns the settings of the schedules in the config file by name
+	ConfigSchedules() map[string]map[string]interface{}
+	// ReloadSchedules applies changes to the schedules
+	ReloadSchedules() error
+	// TriggerSchedule starts a backup of a schedule now, even if it is not due yet
+	TriggerSchedule(ctx context.Context, name string) (*Run, error)
+}
+
+// SetScheduler sets the scheduler that runs the schedules managed by the API
+func (s *Service) SetScheduler(scheduler Scheduler) {
+	s.scheduler = scheduler
+}
+
+// ListSchedules lists the schedules in the config file and the schedules created through the API
+func (s *Service) ListSchedules(ctx context.Context, req *pb.ListSchedulesRequest) (*pb.ListSchedulesReply, error) {
+	if s.scheduler == nil {
+		return nil, status.Error(codes.Unimplemented, "Schedules are not supported")
+	}
+
+	config := s.scheduler.ConfigSchedules()
+
+	var results []*pb.Schedule
+	for name, settings := range config {
+		sch, err := scheduleToPb(name, settings)
+		if err != nil {
+			return nil, err
+		}
+		sch.ReadOnly = true
+
+		results = append(results, sch)
+	}
+
+	stored, err := s.StoredSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range stored {
+		// Schedules in the config file take precedence
+		if _, ok := config[v.Name]; ok {
+			continue
+		}
+
+		sch, err := scheduleToPb(v.Name, v.Settings)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, sch)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	return &pb.ListSchedulesReply{
+		Schedules: results,
+	}, nil
+}
+
+// CreateSchedule creates a schedule and starts running it on every node
+func (s *Service) CreateSchedule(ctx context.Context, req *pb.CreateScheduleRequest) (*pb.CreateScheduleReply, error) {
+	settings, err := s.validateSchedule(req.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	id := s.scheduleID(req.Schedule.Name)
+	exists, err := s.scheduleCollection.Has(id)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Schedule %s already exists", req.Schedule.Name)
+	}
+
+	now := time.Now()
+	schedule := &Schedule{
+		Name:      req.Schedule.Name,
+		Settings:  settings,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := s.saveRecord(s.scheduleCollection, id, schedule); err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduler.ReloadSchedules(); err != nil {
+		return nil, err
+	}
+
+	pbSchedule, err := scheduleToPb(req.Schedule.Name, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateScheduleReply{
+		Schedule: pbSchedule,
+	}, nil
+}
+
+// UpdateSchedule replaces the settings of a schedule created through the API
+func (s *Service) UpdateSchedule(ctx context.Context, req *pb.UpdateScheduleRequest) (*pb.UpdateScheduleReply, error) {
+	settings, err := s.validateSchedule(req.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := s.getSchedule(req.Schedule.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule.Settings = settings
+	schedule.UpdatedAt = time.Now()
+	if err := s.saveRecord(s.scheduleCollection, s.scheduleID(schedule.Name), schedule); err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduler.ReloadSchedules(); err != nil {
+		return nil, err
+	}
+
+	pbSchedule, err := scheduleToPb(req.Schedule.Name, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateScheduleReply{
+		Schedule: pbSchedule,
+	}, nil
+}
+
+// DeleteSchedule deletes a schedule created through the API. A backup it is running is not interrupted
+func (s *Service) DeleteSchedule(ctx context.Context, req *pb.DeleteScheduleRequest) (*pb.DeleteScheduleReply, error) {
+	if s.scheduler == nil {
+		return nil, status.Error(codes.Unimplemented, "Schedules are not supported")
+	}
+
+	if _, ok := s.scheduler.ConfigSchedules()[req.Name]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "Schedule %s is in the config file and can only be removed from there", req.Name)
+	}
+
+	if _, err := s.getSchedule(req.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduleCollection.Delete(s.scheduleID(req.Name)); err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduler.ReloadSchedules(); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteScheduleReply{}, nil
+}
+
+// TriggerSchedule starts a backup of a schedule on this node now, even if it is not due yet.
+// It returns once the backup has started
+func (s *Service) TriggerSchedule(ctx context.Context, req *pb.TriggerScheduleRequest) (*pb.TriggerScheduleReply, error) {
+	if s.scheduler == nil {
+		return nil, status.Error(codes.Unimplemented, "Schedules are not supported")
+	}
+
+	run, err := s.scheduler.TriggerSchedule(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	pbRun, err := runToPb(run)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.TriggerScheduleReply{
+		Run: pbRun,
+	}, nil
+}
+
+// StoredSchedules returns the schedules created through the API
+func (s *Service) StoredSchedules() ([]*Schedule, error) {
+	records, err := s.sealedRecords(s.scheduleCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []*Schedule
+	for _, sealed := range records {
+		schedule := &Schedule{}
+		if err := s.metadataKey.open(sealed.ID, sealed.Sealed, schedule); err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+func (s *Service) getSchedule(name string) (*Schedule, error) {
+	if s.metadataKey == nil {
+		return nil, ErrNoMetadataKey
+	}
+
+	schedule := &Schedule{}
+	err := s.findRecord(s.scheduleCollection, s.scheduleID(name), schedule)
+	if err == db.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "Schedule %s not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return schedule, nil
+}
+
+// validateSchedule returns the settings of a schedule to create or update, if they are valid
+func (s *Service) validateSchedule(sch *pb.Schedule) (map[string]interface{}, error) {
+	if s.scheduler == nil {
+		return nil, status.Error(codes.Unimplemented, "Schedules are not supported")
+	}
+
+	if sch == nil || sch.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Schedule needs a name")
+	}
+
+	if _, ok := s.scheduler.ConfigSchedules()[sch.Name]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "Schedule %s is in the config file and can only be changed there", sch.Name)
+	}
+
+	settings, err := ScheduleSettings(sch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduler.ValidateSchedule(sch.Name, settings); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return settings, nil
+}
+
+// ScheduleSettings converts a schedule to settings with the keys of the config file. Unset fields are left out
+func ScheduleSettings(sch *pb.Schedule) (map[string]interface{}, error) {
+	b, err := json.Marshal(sch)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, err
+	}
+
+	delete(settings, "name")
+	delete(settings, "readOnly")
+
+	return settings, nil
+}
+
+// scheduleToPb converts the settings of a schedule to a schedule. Keys are matched case-insensitively,
+// as settings read from the config file are lower case
+func scheduleToPb(name string, settings map[string]interface{}) (*pb.Schedule, error) {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	sch := &pb.Schedule{}
+	if err := json.Unmarshal(b, sch); err != nil {
+		return nil, err
+	}
+	sch.Name = name
+
+	return sch, nil
+}
@@ -4,45 +4,110 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
 	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
+	ipfscore "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/corerepo"
 	icore "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
 	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/db"
-	"github.com/textileio/go-threads/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Backup is the latest backup of a device. It is sealed with the metadata key before it is written to the thread
 type Backup struct {
-	ID              core.InstanceID `json:"_id"` // DeviceID
+	DeviceID        string
 	LatestBackupCid string
 	UpdatedAt       time.Time
+	Summary         *manifest.Summary
+}
+
+// SealedBackup is a Backup as it is stored in the thread
+type SealedBackup struct {
+	ID     core.InstanceID `json:"_id"` // Keyed hash of the DeviceID
+	Sealed string
+}
+
+// SealedRecord is a Snapshot, Run, Schedule or RemotePin as it is stored in the thread
+type SealedRecord struct {
+	ID     core.InstanceID `json:"_id"`
+	Sealed string
+}
+
+// Snapshot is a single backup of a device. A new snapshot is recorded every time a backup is performed.
+// It is sealed with the metadata key before it is written to the thread
+type Snapshot struct {
+	ID        core.InstanceID `json:"_id"`
+	DeviceID  string
+	BackupCid string
+	Size      uint64
+	NodeID    string
+	CreatedAt time.Time
+	PrunedAt  time.Time
+	Summary   *manifest.Summary
 }
 
 // Service is a gRPC service
 type Service struct {
-	ipfs             icore.CoreAPI
-	d                *db.DB
-	backupCollection *db.Collection
+	node                *ipfscore.IpfsNode
+	ipfs                icore.CoreAPI
+	d                   *db.DB
+	metadataKey         *MetadataKey
+	backupCollection    *db.Collection
+	snapshotCollection  *db.Collection
+	runCollection       *db.Collection
+	scheduleCollection  *db.Collection
+	remotePinCollection *db.Collection
+	provider            idevice.Provider
+	backupDir           string
+	stagingDir          string
+	backupPassword      string
+	reloadConfig        func() (*pb.ReloadConfigReply, error)
+	invite              func(*pb.InviteRequest, pb.API_InviteServer) error
+	scheduler           Scheduler
+	// Only one backup is performed at a time
+	backupLock chan struct{}
 }
 
-func NewService(ipfs icore.CoreAPI, d *db.DB) (*Service, error) {
-	collection := d.GetCollection("Backup")
+// NewService creates the service. Without a metadata key, backups of devices can not be read or performed
+func NewService(node *ipfscore.IpfsNode, ipfs icore.CoreAPI, d *db.DB, metadataKey *MetadataKey, provider idevice.Provider, backupDir string, stagingDir string) (*Service, error) {
+	collection := d.GetCollection("SealedBackup")
+	snapshotCollection := d.GetCollection("SealedSnapshot")
+	runCollection := d.GetCollection("SealedRun")
+	scheduleCollection := d.GetCollection("SealedSchedule")
+	remotePinCollection := d.GetCollection("SealedRemotePin")
 	return &Service{
-		ipfs:             ipfs,
-		d:                d,
-		backupCollection: collection,
+		node:                node,
+		ipfs:                ipfs,
+		d:                   d,
+		metadataKey:         metadataKey,
+		backupCollection:    collection,
+		snapshotCollection:  snapshotCollection,
+		runCollection:       runCollection,
+		scheduleCollection:  scheduleCollection,
+		remotePinCollection: remotePinCollection,
+		provider:            provider,
+		backupDir:           backupDir,
+		stagingDir:          stagingDir,
+		backupLock:          make(chan struct{}, 1),
 	}, nil
 }
 
 // AddBackup adds a new backup to IPFS
 func (s *Service) AddBackup(ctx context.Context, req *pb.AddBackupRequest) (*pb.AddBackupReply, error) {
-	backupCid, err := s.addBackupToIpfs(ctx, req.BackupDir)
+	backupCid, err := s.addBackupToIpfs(ctx, req.BackupDir, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -52,77 +117,184 @@ func (s *Service) AddBackup(ctx context.Context, req *pb.AddBackupRequest) (*pb.
 	}, nil
 }
 
+// StageBackup writes a backup from IPFS to a local directory so it can be restored
+func (s *Service) StageBackup(ctx context.Context, req *pb.StageBackupRequest) (*pb.StageBackupReply, error) {
+	backupCid, err := cid.Decode(req.BackupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The staging directory is removed before the backup is written to it
+	if err := s.checkStagingDir(req.StagingDir, req.DeviceID); err != nil {
+		return nil, err
+	}
+
+	if err := s.getBackupFromIpfs(ctx, backupCid, idevice.DeviceID(req.DeviceID), req.StagingDir); err != nil {
+		return nil, err
+	}
+
+	if err := checkStagedBackup(req.StagingDir, idevice.DeviceID(req.DeviceID)); err != nil {
+		return nil, err
+	}
+
+	return &pb.StageBackupReply{}, nil
+}
+
 // UpdateLatestBackup saves a reference to the latest backup
 func (s *Service) UpdateLatestBackup(ctx context.Context, req *pb.UpdateLatestBackupRequest) (*pb.UpdateLatestBackupReply, error) {
+	backupCid, err := cid.Decode(req.BackupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backups that can not be summarized are still saved
 	deviceID := idevice.DeviceID(req.DeviceID)
+	summary, _ := s.summarizeBackup(ctx, backupCid, deviceID)
 
-	backup := &Backup{
-		ID:              core.InstanceID(deviceID),
-		LatestBackupCid: req.BackupCid,
-		UpdatedAt:       time.Now(),
+	backup, snapshot, err := s.updateLatestBackup(ctx, deviceID, req.BackupCid, summary)
+	if err != nil {
+		return nil, err
 	}
 
-	backupExists, err := s.backupExistsForDevice(deviceID)
+	pbBackup, err := backupToPb(backup)
 	if err != nil {
 		return nil, err
 	}
 
-	if backupExists {
-		err := s.backupCollection.Save(util.JSONFromInstance(backup))
+	pbSnapshot, err := snapshotToPb(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateLatestBackupReply{
+		Backup:   pbBackup,
+		Snapshot: pbSnapshot,
+	}, nil
+}
+
+// ListBackups lists all known backups
+func (s *Service) ListBackups(ctx context.Context, req *pb.ListBackupsRequest) (*pb.ListBackupsReply, error) {
+	// Get all backups
+	backups, err := s.backups()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*pb.Backup
+	for _, backup := range backups {
+		pbBackup, err := backupToPb(backup)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		_, err := s.backupCollection.Create(util.JSONFromInstance(backup))
+
+		pins, err := s.RemotePins(backup.LatestBackupCid)
 		if err != nil {
 			return nil, err
 		}
+
+		for _, pin := range pins {
+			pbPin, err := remotePinToPb(pin)
+			if err != nil {
+				return nil, err
+			}
+
+			pbBackup.RemotePins = append(pbBackup.RemotePins, pbPin)
+		}
+
+		results = append(results, pbBackup)
 	}
 
-	t, err := ptypes.TimestampProto(backup.UpdatedAt)
+	return &pb.ListBackupsReply{
+		Backups: results,
+	}, nil
+}
+
+// ListBackupHistory lists all snapshots of a device, newest first
+func (s *Service) ListBackupHistory(ctx context.Context, req *pb.ListBackupHistoryRequest) (*pb.ListBackupHistoryReply, error) {
+	snapshots, err := s.snapshotsForDevice(idevice.DeviceID(req.DeviceID))
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.UpdateLatestBackupReply{
-		Backup: &pb.Backup{
-			DeviceID:  backup.ID.String(),
-			BackupCid: backup.LatestBackupCid,
-			UpdatedAt: t,
-		},
+	var results []*pb.Snapshot
+	for _, snapshot := range snapshots {
+		pbSnapshot, err := snapshotToPb(snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, pbSnapshot)
+	}
+
+	return &pb.ListBackupHistoryReply{
+		Snapshots: results,
 	}, nil
 }
 
-// ListBackups lists all known backups
-func (s *Service) ListBackups(ctx context.Context, req *pb.ListBackupsRequest) (*pb.ListBackupsReply, error) {
-	// Get all backups
-	backups, err := s.backupCollection.Find(&db.Query{})
+// GetBackup gets a single snapshot by ID
+func (s *Service) GetBackup(ctx context.Context, req *pb.GetBackupRequest) (*pb.GetBackupReply, error) {
+	snapshot, err := s.OpenSnapshot(core.InstanceID(req.Id))
+	if err == db.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "No snapshot with ID (%s) exists", req.Id)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var results []*pb.Backup
-	for _, b := range backups {
-		backup := &Backup{}
-		util.InstanceFromJSON(b, backup)
+	pbSnapshot, err := snapshotToPb(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetBackupReply{
+		Snapshot: pbSnapshot,
+	}, nil
+}
+
+// PruneBackups removes the snapshots of a device that are not kept by a retention policy and unpins their backups
+func (s *Service) PruneBackups(ctx context.Context, req *pb.PruneBackupsRequest) (*pb.PruneBackupsReply, error) {
+	snapshots, err := s.snapshotsForDevice(idevice.DeviceID(req.DeviceID))
+	if err != nil {
+		return nil, err
+	}
+
+	_, remove := retentionPolicyFromPb(req.Policy).Apply(snapshots, time.Now())
+
+	if !req.DryRun && len(remove) > 0 {
+		if err := s.pruneSnapshots(ctx, remove); err != nil {
+			return nil, err
+		}
+	}
 
-		t, err := ptypes.TimestampProto(backup.UpdatedAt)
+	var results []*pb.Snapshot
+	for _, snapshot := range remove {
+		pbSnapshot, err := snapshotToPb(snapshot)
 		if err != nil {
 			return nil, err
 		}
 
-		results = append(results, &pb.Backup{
-			DeviceID:  backup.ID.String(),
-			BackupCid: backup.LatestBackupCid,
-			UpdatedAt: t,
-		})
+		results = append(results, pbSnapshot)
 	}
 
-	return &pb.ListBackupsReply{
-		Backups: results,
+	return &pb.PruneBackupsReply{
+		Snapshots: results,
 	}, nil
 }
 
+// OnReloadConfig sets how ReloadConfig reloads the config of the daemon
+func (s *Service) OnReloadConfig(reload func() (*pb.ReloadConfigReply, error)) {
+	s.reloadConfig = reload
+}
+
+// ReloadConfig reloads the config of the daemon and applies changes to schedules, pinning services, bootstrap peers and logging
+func (s *Service) ReloadConfig(ctx context.Context, req *pb.ReloadConfigRequest) (*pb.ReloadConfigReply, error) {
+	if s.reloadConfig == nil {
+		return nil, status.Error(codes.Unimplemented, "Reloading the config is not supported")
+	}
+
+	return s.reloadConfig()
+}
+
 // Export returns the information needed to share backups with another device
 func (s *Service) Export(ctx context.Context, req *pb.ExportRequest) (*pb.ExportReply, error) {
 	addrs, key, err := s.d.GetDBInfo()
@@ -141,7 +313,21 @@ func (s *Service) Export(ctx context.Context, req *pb.ExportRequest) (*pb.Export
 	}, nil
 }
 
-func (s *Service) addBackupToIpfs(ctx context.Context, backupDir string) (cid.Cid, error) {
+// OnInvite sets how Invite invites a new node to the thread
+func (s *Service) OnInvite(invite func(*pb.InviteRequest, pb.API_InviteServer) error) {
+	s.invite = invite
+}
+
+// Invite streams a code a new node can join the thread with, and waits for the node to join
+func (s *Service) Invite(req *pb.InviteRequest, srv pb.API_InviteServer) error {
+	if s.invite == nil {
+		return status.Error(codes.Unimplemented, "Inviting nodes is not supported")
+	}
+
+	return s.invite(req, srv)
+}
+
+func (s *Service) addBackupToIpfs(ctx context.Context, backupDir string, events chan<- interface{}) (cid.Cid, error) {
 	backupDirNode, err := getUnixfsNode(backupDir)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("Failed to find backup: %s", err)
@@ -151,6 +337,10 @@ func (s *Service) addBackupToIpfs(ctx context.Context, backupDir string) (cid.Ci
 		options.Unixfs.Pin(true),
 		options.Unixfs.Nocopy(true),
 	}
+	if events != nil {
+		opts = append(opts, options.Unixfs.Events(events), options.Unixfs.Progress(true))
+	}
+
 	cidDirectory, err := s.ipfs.Unixfs().Add(ctx, backupDirNode, opts...)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("Failed to add backup to IPFS: %s", err)
@@ -159,17 +349,247 @@ func (s *Service) addBackupToIpfs(ctx context.Context, backupDir string) (cid.Ci
 	return cidDirectory.Cid(), nil
 }
 
-func (s *Service) backupExistsForDevice(deviceID idevice.DeviceID) (bool, error) {
-	backups, err := s.backupCollection.FindByID(core.InstanceID(deviceID))
-	if err != nil && err != db.ErrNotFound {
-		return false, err
+func (s *Service) updateLatestBackup(ctx context.Context, deviceID idevice.DeviceID, backupCid string, summary *manifest.Summary) (*Backup, *Snapshot, error) {
+	backup := &Backup{
+		DeviceID:        string(deviceID),
+		LatestBackupCid: backupCid,
+		UpdatedAt:       time.Now(),
+		Summary:         summary,
 	}
 
-	if err == db.ErrNotFound {
-		return false, nil
+	if err := s.saveBackup(backup); err != nil {
+		return nil, nil, err
+	}
+
+	// Record the backup in the device's history
+	snapshot, err := s.createSnapshot(ctx, deviceID, backupCid, backup.UpdatedAt, summary)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return len(backups) > 0, nil
+	return backup, snapshot, nil
+}
+
+func (s *Service) getBackupFromIpfs(ctx context.Context, backupCid cid.Cid, deviceID idevice.DeviceID, stagingDir string) error {
+	node, err := s.ipfs.Unixfs().Get(ctx, s.deviceBackupPath(ctx, backupCid, deviceID))
+	if err != nil {
+		return fmt.Errorf("Failed to get backup from IPFS: %s", err)
+	}
+	defer node.Close()
+
+	// Start from an empty directory so no stale files are restored
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stagingDir, 0775); err != nil {
+		return err
+	}
+
+	// devicebackup2 expects the backup in a directory named after the device
+	deviceDir := filepath.Join(stagingDir, string(deviceID))
+	if err := files.WriteTo(node, deviceDir); err != nil {
+		return fmt.Errorf("Failed to write backup to %s: %s", deviceDir, err)
+	}
+
+	return nil
+}
+
+// deviceBackupPath finds the backup of a device within a backup DAG
+func (s *Service) deviceBackupPath(ctx context.Context, backupCid cid.Cid, deviceID idevice.DeviceID) path.Path {
+	if deviceID == "" {
+		return path.IpfsPath(backupCid)
+	}
+
+	// Older backups contain the backups directory of every device instead of a single device
+	legacyPath := path.Join(path.IpfsPath(backupCid), string(deviceID))
+	if _, err := s.ipfs.ResolvePath(ctx, legacyPath); err == nil {
+		return legacyPath
+	}
+
+	return path.IpfsPath(backupCid)
+}
+
+func (s *Service) createSnapshot(ctx context.Context, deviceID idevice.DeviceID, backupCid string, createdAt time.Time, summary *manifest.Summary) (*Snapshot, error) {
+	id, err := cid.Decode(backupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := s.ipfs.Object().Stat(ctx, path.IpfsPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat backup: %s", err)
+	}
+
+	self, err := s.ipfs.Key().Self(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		ID:        core.NewInstanceID(),
+		DeviceID:  string(deviceID),
+		BackupCid: backupCid,
+		Size:      uint64(stat.CumulativeSize),
+		NodeID:    self.ID().Pretty(),
+		CreatedAt: createdAt,
+		Summary:   summary,
+	}
+
+	if err := s.saveRecord(s.snapshotCollection, snapshot.ID, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// LastBackupTime returns when the latest backup of a device was made by any node, or the zero time if it has none
+func (s *Service) LastBackupTime(deviceID idevice.DeviceID) (time.Time, error) {
+	snapshots, err := s.snapshotsForDevice(deviceID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(snapshots) == 0 {
+		return time.Time{}, nil
+	}
+
+	return snapshots[0].CreatedAt, nil
+}
+
+// OpenSnapshot reads a snapshot from the thread by its instance ID
+func (s *Service) OpenSnapshot(id core.InstanceID) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := s.findRecord(s.snapshotCollection, id, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// allSnapshots returns the snapshots of every device, including pruned ones
+func (s *Service) allSnapshots() ([]*Snapshot, error) {
+	records, err := s.sealedRecords(s.snapshotCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, sealed := range records {
+		snapshot := &Snapshot{}
+		if err := s.metadataKey.open(sealed.ID, sealed.Sealed, snapshot); err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+func (s *Service) snapshotsForDevice(deviceID idevice.DeviceID) ([]*Snapshot, error) {
+	all, err := s.allSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, snapshot := range all {
+		// Pruned snapshots are kept as a record but are no longer part of the history
+		if snapshot.DeviceID != string(deviceID) || !snapshot.PrunedAt.IsZero() {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// gc removes blocks that are no longer pinned from the IPFS repo
+func (s *Service) gc(ctx context.Context) error {
+	if err := corerepo.GarbageCollect(s.node, ctx); err != nil {
+		return fmt.Errorf("Failed to run garbage collection: %s", err)
+	}
+
+	return nil
+}
+
+// checkStagingDir rejects staging directories outside the staging directory of the repo, and device IDs that are not
+// a single path element
+func (s *Service) checkStagingDir(stagingDir string, deviceID string) error {
+	if deviceID == "" || deviceID != filepath.Base(deviceID) || deviceID == ".." {
+		return status.Errorf(codes.InvalidArgument, "Invalid device ID %s", deviceID)
+	}
+
+	root, err := filepath.Abs(s.stagingDir)
+	if err != nil || s.stagingDir == "" || !filepath.IsAbs(stagingDir) {
+		return status.Errorf(codes.InvalidArgument, "Staging directory must be inside %s", s.stagingDir)
+	}
+
+	rel, err := filepath.Rel(root, filepath.Clean(stagingDir))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return status.Errorf(codes.InvalidArgument, "Staging directory must be inside %s", s.stagingDir)
+	}
+
+	return nil
+}
+
+// checkStagedBackup makes sure the files devicebackup2 needs to restore a device exist
+func checkStagedBackup(stagingDir string, deviceID idevice.DeviceID) error {
+	deviceDir := filepath.Join(stagingDir, string(deviceID))
+	for _, name := range []string{"Info.plist", "Manifest.plist", "Manifest.db", "Status.plist"} {
+		if _, err := os.Stat(filepath.Join(deviceDir, name)); err != nil {
+			return fmt.Errorf("Backup for device (%s) is incomplete: %s", deviceID, err)
+		}
+	}
+
+	return nil
+}
+
+func backupToPb(backup *Backup) (*pb.Backup, error) {
+	t, err := ptypes.TimestampProto(backup.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := summaryToPb(backup.Summary)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Backup{
+		DeviceID:  backup.DeviceID,
+		BackupCid: backup.LatestBackupCid,
+		UpdatedAt: t,
+		Summary:   summary,
+	}, nil
+}
+
+func snapshotToPb(snapshot *Snapshot) (*pb.Snapshot, error) {
+	t, err := ptypes.TimestampProto(snapshot.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := summaryToPb(snapshot.Summary)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Snapshot{
+		Id:        snapshot.ID.String(),
+		DeviceID:  snapshot.DeviceID,
+		BackupCid: snapshot.BackupCid,
+		Size:      snapshot.Size,
+		NodeID:    snapshot.NodeID,
+		CreatedAt: t,
+		Summary:   summary,
+	}, nil
 }
 
 func getUnixfsNode(path string) (files.Node, error) {
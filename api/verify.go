@@ -0,0 +1,257 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"howett.net/plist"
+)
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// verifier walks a backup using only blocks that are stored locally
+type verifier struct {
+	ipfs          icore.CoreAPI
+	visited       map[cid.Cid]error
+	blocks        uint64
+	missingBlocks uint64
+	errors        []*pb.BackupFileError
+}
+
+func newVerifier(ipfs icore.CoreAPI) (*verifier, error) {
+	offline, err := ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifier{
+		ipfs:    offline,
+		visited: map[cid.Cid]error{},
+	}, nil
+}
+
+// VerifyBackup checks that every block of a backup is stored locally and that the files needed to restore it can be read.
+// If a password is given, every file of an encrypted backup is decrypted too
+func (s *Service) VerifyBackup(ctx context.Context, req *pb.VerifyBackupRequest) (*pb.VerifyBackupReply, error) {
+	backupCid, err := cid.Decode(req.BackupCid)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := newVerifier(s.ipfs)
+	if err != nil {
+		return nil, err
+	}
+
+	backupPath := s.deviceBackupPath(ctx, backupCid, idevice.DeviceID(req.DeviceID))
+	if err := v.verifyBackup(ctx, backupPath, req.Password); err != nil {
+		return nil, err
+	}
+
+	return &pb.VerifyBackupReply{
+		Blocks:        v.blocks,
+		MissingBlocks: v.missingBlocks,
+		Errors:        v.errors,
+	}, nil
+}
+
+func (v *verifier) verifyBackup(ctx context.Context, backupPath path.Path, password string) error {
+	root, err := v.ipfs.ResolvePath(ctx, backupPath)
+	if err != nil {
+		return fmt.Errorf("Failed to find backup: %s", err)
+	}
+
+	if err := v.walk(ctx, root.Cid(), ""); err != nil {
+		return err
+	}
+
+	isEncrypted := false
+	for _, name := range []string{"Info.plist", "Manifest.plist", "Status.plist"} {
+		data, err := v.readFile(ctx, backupPath, name, -1)
+		if err != nil {
+			v.addError(name, err)
+			continue
+		}
+
+		values := map[string]interface{}{}
+		if _, err := plist.Unmarshal(data, &values); err != nil {
+			v.addError(name, fmt.Errorf("corrupted: %s", err))
+			continue
+		}
+
+		if name == "Manifest.plist" {
+			isEncrypted, _ = values["IsEncrypted"].(bool)
+		}
+	}
+
+	// Manifest.db is encrypted in encrypted backups, so only its presence can be checked
+	header, err := v.readFile(ctx, backupPath, "Manifest.db", int64(len(sqliteHeader)))
+	if err != nil {
+		v.addError("Manifest.db", err)
+	} else if !isEncrypted && !bytes.Equal(header, sqliteHeader) {
+		v.addError("Manifest.db", fmt.Errorf("corrupted: not a SQLite database"))
+	}
+
+	if isEncrypted && password != "" {
+		return v.verifyDecryption(ctx, backupPath, password)
+	}
+
+	return nil
+}
+
+// verifyDecryption checks that Manifest.db and every file of an encrypted backup can be decrypted with password
+func (v *verifier) verifyDecryption(ctx context.Context, backupPath path.Path, password string) error {
+	db, err := manifest.OpenDB(&ipfsBackup{
+		ctx:  ctx,
+		ipfs: v.ipfs,
+		path: backupPath,
+	}, password)
+	if errors.Is(err, manifest.ErrWrongPassword) {
+		return err
+	}
+	if err != nil {
+		v.addError("Manifest.db", err)
+		return nil
+	}
+	defer db.Close()
+
+	backupFiles, err := db.Files()
+	if err != nil {
+		v.addError("Manifest.db", err)
+		return nil
+	}
+
+	for _, f := range backupFiles {
+		if f.Flags != manifest.FlagFile {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := v.decryptFile(ctx, backupPath, db, f); err != nil {
+			v.addError(f.ContentPath(), fmt.Errorf("%s: %s", f.Path(), err))
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) decryptFile(ctx context.Context, backupPath path.Path, db *manifest.DB, f manifest.File) error {
+	node, err := v.ipfs.Unixfs().Get(ctx, path.Join(backupPath, f.ContentPath()))
+	if err != nil {
+		return fmt.Errorf("missing: %s", err)
+	}
+	defer node.Close()
+
+	contents, ok := node.(files.File)
+	if !ok {
+		return fmt.Errorf("not a file")
+	}
+
+	r, err := db.Decrypt(f, contents)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return fmt.Errorf("corrupted: %s", err)
+	}
+
+	return nil
+}
+
+// walk visits every block below c, recording the files of blocks that can not be read.
+// Blocks backed by the filestore are hashed when read, so changed source files are detected
+func (v *verifier) walk(ctx context.Context, c cid.Cid, filePath string) error {
+	if err, ok := v.visited[c]; ok {
+		if err != nil {
+			v.addError(filePath, err)
+		}
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	v.blocks++
+	node, err := v.ipfs.Dag().Get(ctx, c)
+	v.visited[c] = err
+	if err != nil {
+		v.missingBlocks++
+		v.addError(filePath, err)
+		return nil
+	}
+
+	for _, link := range node.Links() {
+		childPath := filePath
+		if link.Name != "" {
+			childPath = joinFilePath(filePath, link.Name)
+		}
+
+		if err := v.walk(ctx, link.Cid, childPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFile reads up to limit bytes of a file in a backup, or the whole file if limit is negative
+func (v *verifier) readFile(ctx context.Context, backupPath path.Path, name string, limit int64) ([]byte, error) {
+	node, err := v.ipfs.Unixfs().Get(ctx, path.Join(backupPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("missing: %s", err)
+	}
+	defer node.Close()
+
+	f, ok := node.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("not a file")
+	}
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted: %s", err)
+	}
+
+	return data, nil
+}
+
+func (v *verifier) addError(filePath string, err error) {
+	if filePath == "" {
+		filePath = "/"
+	}
+
+	v.errors = append(v.errors, &pb.BackupFileError{
+		Path:  filePath,
+		Error: err.Error(),
+	})
+}
+
+func joinFilePath(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+
+	return dir + "/" + name
+}
@@ -23,13 +23,32 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
 
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
 	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/codynhat/ipfs-ios-backup/manifest"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/ipfs/go-cid"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	restoreCid    string
+	pruneDryRun   bool
+	lsRecursive   bool
+	verifyDecrypt bool
+	diffDeviceID  string
+	diffListFiles bool
 )
 
 var backupsCmd = &cobra.Command{
@@ -46,23 +65,32 @@ var backupsEnableCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		deviceID := idevice.DeviceID(args[0])
 
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
 		// Pair device
 		fmt.Println("Pairing device...")
-		if err := idevice.PairDevice(deviceID); err != nil {
+		if err := provider.PairDevice(deviceID); err != nil {
+			switch {
+			case errors.Is(err, idevice.ErrPasscodeLocked):
+				log.Fatalf("%v. Try unlocking your device and trying again", err)
+			case errors.Is(err, idevice.ErrNotPaired), errors.Is(err, idevice.ErrUserDeniedTrust):
+				log.Fatalf("%v. Tap Trust on your device when asked to trust this computer and try again", err)
+			}
 			log.Fatalf("Failed to pair device: %v\n", err)
 		}
 		fmt.Println("Device is paired.")
 
 		// Enable backup encryption
 		fmt.Println("Determining if backup encryption is enabled...")
-		willEncrypt, err := idevice.GetDeviceWillEncrypt(deviceID)
+		willEncrypt, err := provider.GetDeviceWillEncrypt(deviceID)
 		if err != nil {
 			log.Fatalf("Failed to determine if backup encryption is enabled: %v", err)
 		}
 
 		if !willEncrypt {
 			fmt.Println("Backup encryption is not enabled. Enabling...")
-			if err := idevice.EnableBackupEncryption(deviceID); err != nil {
+			if err := provider.EnableBackupEncryption(ctx, deviceID); err != nil {
 				log.Fatalf("Failed to enable backup encryption: %v", err)
 			}
 		}
@@ -76,15 +104,47 @@ var backupsPerformCmd = &cobra.Command{
 	Long:  "Perform a backup",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		deviceID := idevice.DeviceID(args[0])
-		repoPath := viper.GetString("repoPath")
-
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := contextWithInterrupt()
 		defer cancel()
 
-		err := performBackup(ctx, deviceID, repoPath)
+		stream, err := client.PerformBackup(ctx, args[0])
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Failed to perform backup: %s\n", err)
+		}
+
+		bar := newProgressBar()
+		phase := pb.BackupPhase(-1)
+		for {
+			event, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				bar.Done()
+				if ctx.Err() != nil {
+					log.Fatal("Backup cancelled.")
+				}
+				log.Fatalf("Failed to perform backup: %s\n", err)
+			}
+
+			if event.Phase != phase {
+				bar.Done()
+				phase = event.Phase
+				fmt.Println(backupPhaseMessage(phase))
+			}
+
+			switch event.Phase {
+			case pb.BackupPhase_BACKING_UP:
+				if event.Status != "" {
+					bar.Update(event.Percent, backupProgressDetail(event, event.Status))
+				}
+			case pb.BackupPhase_ADDING_TO_IPFS:
+				if event.Bytes > 0 {
+					bar.Update(event.Percent, backupProgressDetail(event, ""))
+				}
+			case pb.BackupPhase_DONE:
+				fmt.Printf("%s -> %s\n\tBackup At: %v\n\tSize: %v bytes\n", event.Snapshot.Id, event.Snapshot.BackupCid, ptypes.TimestampString(event.Snapshot.CreatedAt), event.Snapshot.Size)
+			}
 		}
 	},
 }
@@ -92,16 +152,39 @@ var backupsPerformCmd = &cobra.Command{
 var backupsRestoreCmd = &cobra.Command{
 	Use:   "restore [device-id]",
 	Short: "Restore a backup",
-	Long:  "Restore a backup",
+	Long:  "Restore a backup from IPFS. Defaults to the latest backup of the device",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		deviceID := idevice.DeviceID(args[0])
 		repoPath := viper.GetString("repoPath")
 
-		backupDir := filepath.Join(repoPath, "backups")
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
+		backupCid := restoreCid
+		if backupCid == "" {
+			latestCid, err := getLatestBackupCid(ctx, deviceID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			backupCid = latestCid
+		}
+
+		// Get backup from IPFS
+		// The daemon only stages backups inside the staging directory of the repo
+		stagingDir, err := filepath.Abs(filepath.Join(repoPath, "staging", backupCid))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(stagingDir)
+
+		fmt.Printf("Getting backup %s from IPFS...\n", backupCid)
+		if _, err := client.StageBackup(ctx, string(deviceID), backupCid, stagingDir); err != nil {
+			log.Fatalf("Failed to get backup: %v", err)
+		}
 
 		// Restore backup
-		if err := idevice.RestoreBackup(deviceID, backupDir); err != nil {
+		if err := provider.RestoreBackup(ctx, deviceID, stagingDir); err != nil {
 			log.Fatalf("Failed to restore backup: %v", err)
 		}
 	},
@@ -130,6 +213,257 @@ var backupsListCmd = &cobra.Command{
 		fmt.Printf("[device-id] -> [IPFS cid]\n\n")
 		for _, v := range backups.Backups {
 			fmt.Printf("%s -> %s\n\tLast Backup At: %v\n", v.DeviceID, v.BackupCid, ptypes.TimestampString(v.UpdatedAt))
+			printBackupSummary(v.Summary)
+			for _, pin := range v.RemotePins {
+				fmt.Printf("\tPinning Service %s: %s\n", pin.Service, remotePinDetail(pin))
+			}
+		}
+	},
+}
+
+var backupsHistoryCmd = &cobra.Command{
+	Use:   "history [device-id]",
+	Short: "List all backups of a device",
+	Long:  "List all backups of a device, newest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Get all snapshots
+		history, err := client.ListBackupHistory(ctx, args[0])
+		if err != nil {
+			log.Fatalf("Failed to get backup history: %s\n", err)
+		}
+
+		if len(history.Snapshots) == 0 {
+			fmt.Println("No backups found.")
+			return
+		}
+
+		fmt.Printf("Backups found for %s:\n", args[0])
+		fmt.Printf("[snapshot-id] -> [IPFS cid]\n\n")
+		for _, v := range history.Snapshots {
+			fmt.Printf("%s -> %s\n\tBackup At: %v\n\tSize: %v bytes\n\tNode: %s\n", v.Id, v.BackupCid, ptypes.TimestampString(v.CreatedAt), v.Size, v.NodeID)
+		}
+	},
+}
+
+var backupsPruneCmd = &cobra.Command{
+	Use:   "prune [device-id]",
+	Short: "Prune backups using the retention policies of schedules",
+	Long:  "Prune backups using the retention policies of schedules. Pruned backups are unpinned and removed from the IPFS repo",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		schedules, err := client.ListSchedules(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get schedules: %s\n", err)
+		}
+
+		if len(schedules.Schedules) == 0 {
+			fmt.Println("No schedules found.")
+			return
+		}
+
+		for _, schedule := range schedules.Schedules {
+			deviceID := schedule.DeviceID
+			if len(args) > 0 && args[0] != deviceID {
+				continue
+			}
+
+			retention := schedule.Retention
+			if retention == nil {
+				fmt.Printf("Schedule %s has no retention policy. Skipping.\n", schedule.Name)
+				continue
+			}
+
+			reply, err := client.PruneBackups(ctx, deviceID, retention, pruneDryRun)
+			if err != nil {
+				log.Fatalf("Failed to prune backups: %s\n", err)
+			}
+
+			if len(reply.Snapshots) == 0 {
+				fmt.Printf("No backups to prune for %s.\n", deviceID)
+				continue
+			}
+
+			if pruneDryRun {
+				fmt.Printf("Backups that would be pruned for %s:\n", deviceID)
+			} else {
+				fmt.Printf("Backups pruned for %s:\n", deviceID)
+			}
+			for _, v := range reply.Snapshots {
+				fmt.Printf("%s -> %s\n\tBackup At: %v\n", v.Id, v.BackupCid, ptypes.TimestampString(v.CreatedAt))
+			}
+		}
+	},
+}
+
+var backupsVerifyCmd = &cobra.Command{
+	Use:   "verify [device-id|cid]",
+	Short: "Verify a backup can be restored",
+	Long:  "Verify every block of a backup is stored locally and the files needed to restore it can be read. Defaults to the latest backup of a device",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		deviceID, backupCid, err := resolveBackup(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var password string
+		if verifyDecrypt {
+			password, err = readBackupPassword()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		fmt.Printf("Verifying backup %s...\n", backupCid)
+		reply, err := client.VerifyBackup(ctx, deviceID, backupCid, password)
+		if err != nil {
+			log.Fatalf("Failed to verify backup: %s\n", err)
+		}
+
+		fmt.Printf("Checked %v blocks (%v missing)\n", reply.Blocks, reply.MissingBlocks)
+
+		if len(reply.Errors) == 0 {
+			fmt.Println("Backup is OK.")
+			return
+		}
+
+		for _, v := range reply.Errors {
+			fmt.Printf("%s: %s\n", v.Path, v.Error)
+		}
+		log.Fatalf("Backup %s failed verification with %v errors", backupCid, len(reply.Errors))
+	},
+}
+
+var backupsLsCmd = &cobra.Command{
+	Use:   "ls [device-id|cid] [domain/path]",
+	Short: "List the files in a backup",
+	Long:  "List the files in a backup by their path on the device, e.g. HomeDomain/Library/SMS. Lists the domains if no path is given. Defaults to the latest backup of a device",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		deviceID, backupCid, err := resolveBackup(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var dir string
+		if len(args) > 1 {
+			dir = args[1]
+		}
+
+		var reply *pb.ListBackupFilesReply
+		err = withBackupPassword(func(password string) error {
+			reply, err = client.ListBackupFiles(ctx, deviceID, backupCid, dir, lsRecursive, password)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to list files: %s\n", err)
+		}
+
+		for _, v := range reply.Files {
+			printBackupFile(v)
+		}
+	},
+}
+
+var backupsExtractCmd = &cobra.Command{
+	Use:   "extract [device-id|cid] [domain/relativePath] [dest]",
+	Short: "Extract a file from a backup",
+	Long:  "Extract a single file from a backup without fetching the rest of the backup, e.g. HomeDomain/Library/SMS/sms.db. Files of encrypted backups are decrypted using the backup password. Defaults to the latest backup of a device",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		deviceID, backupCid, err := resolveBackup(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var dest string
+		err = withBackupPassword(func(password string) error {
+			stream, err := client.ExtractBackupFile(ctx, deviceID, backupCid, args[1], password)
+			if err != nil {
+				return err
+			}
+
+			dest, err = extractBackupFile(stream, args[2])
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to extract file: %s\n", err)
+		}
+
+		fmt.Printf("Extracted %s to %s\n", args[1], dest)
+	},
+}
+
+var backupsDiffCmd = &cobra.Command{
+	Use:   "diff [cid-a] [cid-b]",
+	Short: "Compare two backups of a device",
+	Long:  "Compare two backups of a device, listing the files added, removed and changed in cid-b by domain, and how many blocks both backups share in IPFS",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for _, v := range args {
+			if _, err := cid.Decode(v); err != nil {
+				log.Fatalf("Invalid CID %s: %s", v, err)
+			}
+		}
+
+		fmt.Printf("Comparing backup %s with %s...\n", args[0], args[1])
+
+		var reply *pb.DiffBackupsReply
+		err := withBackupPassword(func(password string) error {
+			var err error
+			reply, err = client.DiffBackups(ctx, diffDeviceID, args[0], args[1], diffListFiles, password)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to compare backups: %s\n", err)
+		}
+
+		total := &pb.DomainDiff{}
+		for _, v := range reply.Domains {
+			fmt.Println(v.Domain)
+			fmt.Printf("\t%s\n", domainDiffDetail(v))
+			for _, f := range v.Added {
+				fmt.Printf("\t  + %s (%s)\n", f.RelativePath, formatBytes(f.Size))
+			}
+			for _, f := range v.Removed {
+				fmt.Printf("\t  - %s (%s)\n", f.RelativePath, formatBytes(f.Size))
+			}
+			for _, f := range v.Changed {
+				fmt.Printf("\t  ~ %s (%s)\n", f.RelativePath, formatBytes(f.Size))
+			}
+
+			total.AddedFiles += v.AddedFiles
+			total.AddedBytes += v.AddedBytes
+			total.RemovedFiles += v.RemovedFiles
+			total.RemovedBytes += v.RemovedBytes
+			total.ChangedFiles += v.ChangedFiles
+			total.ChangedBytes += v.ChangedBytes
+			total.PreviousChangedBytes += v.PreviousChangedBytes
+		}
+
+		fmt.Printf("Total: %s\n", domainDiffDetail(total))
+		fmt.Printf("Blocks: %v in %s, %v in %s, %v shared\n", reply.BlocksA, args[0], reply.BlocksB, args[1], reply.SharedBlocks)
+		if reply.BytesB > 0 {
+			fmt.Printf("Shared: %s of %s (%.1f%%) of %s is already stored for %s\n", formatBytes(reply.SharedBytes), formatBytes(reply.BytesB), float64(reply.SharedBytes)/float64(reply.BytesB)*100, args[1], args[0])
 		}
 	},
 }
@@ -140,32 +474,226 @@ func init() {
 	backupsCmd.AddCommand(backupsPerformCmd)
 	backupsCmd.AddCommand(backupsListCmd)
 	backupsCmd.AddCommand(backupsRestoreCmd)
+	backupsCmd.AddCommand(backupsHistoryCmd)
+	backupsCmd.AddCommand(backupsPruneCmd)
+	backupsCmd.AddCommand(backupsVerifyCmd)
+	backupsCmd.AddCommand(backupsLsCmd)
+	backupsCmd.AddCommand(backupsExtractCmd)
+	backupsCmd.AddCommand(backupsDiffCmd)
+
+	backupsRestoreCmd.Flags().StringVar(&restoreCid, "cid", "", "CID of the backup to restore (default is the latest backup)")
+	backupsPruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Only show which backups would be pruned")
+	backupsLsCmd.Flags().BoolVarP(&lsRecursive, "recursive", "r", false, "List all files below the path")
+	backupsDiffCmd.Flags().StringVar(&diffDeviceID, "device", "", "Device ID, needed for older backups that contain several devices")
+	backupsDiffCmd.Flags().BoolVar(&diffListFiles, "files", false, "List every added, removed and changed file")
+	backupsVerifyCmd.Flags().BoolVar(&verifyDecrypt, "decrypt", false, "Check that every file of an encrypted backup can be decrypted, using the backup password")
+}
+
+func backupPhaseMessage(phase pb.BackupPhase) string {
+	switch phase {
+	case pb.BackupPhase_STARTING:
+		return "Starting backup..."
+	case pb.BackupPhase_BACKING_UP:
+		return "Backing up device..."
+	case pb.BackupPhase_ADDING_TO_IPFS:
+		return "Adding backup to IPFS..."
+	case pb.BackupPhase_SAVING:
+		return "Saving latest backup..."
+	case pb.BackupPhase_DONE:
+		return "Backup complete."
+	}
+
+	return phase.String()
+}
+
+func printBackupSummary(summary *pb.BackupSummary) {
+	if summary == nil {
+		return
+	}
+
+	fmt.Printf("\tDevice: %s (%s, iOS %s)\n", summary.DeviceName, summary.ProductType, summary.ProductVersion)
+	fmt.Printf("\tEncrypted: %v\n", summary.IsEncrypted)
+	fmt.Printf("\tApps: %v\n", len(summary.Applications))
+
+	if len(summary.Domains) == 0 {
+		return
+	}
+
+	var files uint64
+	for _, v := range summary.Domains {
+		files += v.Files
+	}
+	fmt.Printf("\tFiles: %v in %v domains\n", files, len(summary.Domains))
+}
+
+// backupProgressDetail describes the bytes and files of a progress event
+func backupProgressDetail(event *pb.PerformBackupEvent, status string) string {
+	detail := fmt.Sprintf("%s, %v files", formatBytes(event.Bytes), event.Files)
+	if event.TotalBytes > 0 {
+		detail = fmt.Sprintf("%s of %s, %v files", formatBytes(event.Bytes), formatBytes(event.TotalBytes), event.Files)
+	}
+
+	if status != "" {
+		detail = status + " (" + detail + ")"
+	}
+
+	return detail
 }
 
-func performBackup(ctx context.Context, deviceID idevice.DeviceID, repoPath string) error {
-	log.Infof("Performing backup for device %s", deviceID)
+func printBackupFile(f *pb.BackupFile) {
+	p := f.Domain
+	if f.RelativePath != "" {
+		p += "/" + f.RelativePath
+	}
 
-	backupDir := filepath.Join(repoPath, "backups")
+	if f.Flags != manifest.FlagFile {
+		fmt.Printf("%10s  %-16s  %s/\n", "-", "", p)
+		return
+	}
 
-	// Perform backup
-	if err := idevice.PerformBackup(deviceID, backupDir); err != nil {
-		return fmt.Errorf("failed to perform backup: %s", err)
+	modified := ""
+	if f.LastModified != nil {
+		if t, err := ptypes.Timestamp(f.LastModified); err == nil {
+			modified = t.Local().Format("2006-01-02 15:04")
+		}
 	}
 
-	// Add backup to IPFS
-	log.Infof("Adding backup to IPFS")
-	reply, err := client.AddBackup(ctx, backupDir)
+	fmt.Printf("%10s  %-16s  %s\n", formatBytes(f.Size), modified, p)
+}
+
+// extractBackupFile writes a streamed backup file to dest, or into dest if it is a directory, and returns the path written
+func extractBackupFile(stream pb.API_ExtractBackupFileClient, dest string) (string, error) {
+	reply, err := stream.Recv()
+	if err != nil {
+		return "", err
+	}
+
+	f := reply.File
+	if f == nil {
+		return "", fmt.Errorf("missing file information")
+	}
+
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(f.RelativePath))
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
+		return "", err
+	}
+
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			_, err = out.Write(reply.Data)
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(dest)
+			return "", err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	// Keep the permissions and modification time the file had on the device
+	if perm := os.FileMode(f.Mode).Perm(); perm != 0 {
+		os.Chmod(dest, perm)
+	}
+	if f.LastModified != nil {
+		if t, err := ptypes.Timestamp(f.LastModified); err == nil {
+			os.Chtimes(dest, t, t)
+		}
+	}
+
+	return dest, nil
+}
+
+// domainDiffDetail describes the files added, removed and changed in a domain
+func domainDiffDetail(d *pb.DomainDiff) string {
+	return fmt.Sprintf("+%v files (%s), -%v files (%s), ~%v files (%s, was %s)",
+		d.AddedFiles, formatBytes(d.AddedBytes),
+		d.RemovedFiles, formatBytes(d.RemovedBytes),
+		d.ChangedFiles, formatBytes(d.ChangedBytes), formatBytes(d.PreviousChangedBytes))
+}
+
+// withBackupPassword calls fn without a password, and again with the password of the backup if it is encrypted
+func withBackupPassword(fn func(password string) error) error {
+	err := fn("")
+	if status.Code(err) != codes.FailedPrecondition {
 		return err
 	}
-	log.Infof("Added backup to IPFS (%s)", reply.BackupCid)
 
-	log.Infof("Updating latest backup CID")
-	updateReply, err := client.UpdateLatestBackup(ctx, string(deviceID), reply.BackupCid)
+	password, err := readBackupPassword()
 	if err != nil {
 		return err
 	}
-	log.Infof("Latest backup cid saved (%s)", updateReply.Backup.BackupCid)
 
-	return nil
+	return fn(password)
+}
+
+// readBackupPassword reads the password of an encrypted backup from IPFS_IOS_BACKUP_PASSWORD, or prompts for it
+func readBackupPassword() (string, error) {
+	if password := os.Getenv("IPFS_IOS_BACKUP_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("backup is encrypted, set IPFS_IOS_BACKUP_PASSWORD to its password")
+	}
+
+	fmt.Print("Backup password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), nil
+}
+
+// resolveBackup resolves a device ID to the CID of its latest backup.
+// The device ID is returned too, so backups that contain several devices can be read
+func resolveBackup(ctx context.Context, arg string) (deviceID string, backupCid string, err error) {
+	if _, err := cid.Decode(arg); err == nil {
+		return "", arg, nil
+	}
+
+	backupCid, err = getLatestBackupCid(ctx, idevice.DeviceID(arg))
+	if err != nil {
+		return "", "", err
+	}
+
+	return arg, backupCid, nil
+}
+
+func getLatestBackupCid(ctx context.Context, deviceID idevice.DeviceID) (string, error) {
+	backups, err := client.ListBackups(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get backups: %s", err)
+	}
+
+	for _, v := range backups.Backups {
+		if v.DeviceID == string(deviceID) {
+			return v.BackupCid, nil
+		}
+	}
+
+	return "", fmt.Errorf("no backup found for device %s", deviceID)
+}
+
+// remotePinDetail describes the status of a backup on a pinning service
+func remotePinDetail(pin *pb.RemotePin) string {
+	detail := strings.ToLower(strings.TrimPrefix(pin.Status.String(), "PIN_"))
+	if pin.Reason != "" {
+		detail += " (" + pin.Reason + ")"
+	}
+
+	return fmt.Sprintf("%s since %v", detail, ptypes.TimestampString(pin.UpdatedAt))
 }
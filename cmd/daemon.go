@@ -26,17 +26,19 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"syscall"
 
 	"github.com/codynhat/ipfs-ios-backup/api"
 	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
 	"github.com/codynhat/ipfs-ios-backup/idevice"
-	"github.com/go-co-op/gocron"
+	"github.com/codynhat/ipfs-ios-backup/invite"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/bootstrap"
 	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/corerepo"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	icore "github.com/ipfs/interface-go-ipfs-core"
@@ -46,9 +48,9 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/textileio/go-threads/common"
+	threadcore "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/core/thread"
 	"github.com/textileio/go-threads/db"
-	"github.com/textileio/go-threads/util"
 	"google.golang.org/grpc"
 )
 
@@ -67,31 +69,24 @@ var daemonCmd = &cobra.Command{
 		ipfsRepoRoot := filepath.Join(repoPath, ".ipfs")
 
 		// Get IPFS bootstrap list
-		ipfsBootstrapList := viper.GetStringSlice("ipfsBootstrapList")
-		ipfsBootstrapAddrs := make([]ma.Multiaddr, len(ipfsBootstrapList))
-		for i, v := range ipfsBootstrapList {
-			a, err := ma.NewMultiaddr(v)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			ipfsBootstrapAddrs[i] = a
+		ipfsBootstrapAddrs, err := bootstrapAddrsFromConfig("ipfsBootstrapList")
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		// Get Threads bootstrap list
-		threadsBootstrapList := viper.GetStringSlice("threadsBootstrapList")
-		threadsBootstrapAddrs := make([]ma.Multiaddr, len(threadsBootstrapList))
-		for i, v := range threadsBootstrapList {
-			a, err := ma.NewMultiaddr(v)
-			if err != nil {
-				log.Fatal(err)
-			}
+		threadsBootstrapAddrs, err := bootstrapAddrsFromConfig("threadsBootstrapList")
+		if err != nil {
+			log.Fatal(err)
+		}
 
-			threadsBootstrapAddrs[i] = a
+		// Switch to secrets rotated by a trusted node, or imported, before the new swarm key is needed
+		if err := applyPendingSecrets(ctx, repoPath, threadsBootstrapAddrs); err != nil {
+			log.Fatalf("Failed to switch to new secrets: %s", err)
 		}
 
 		// Spawn IPFS node
-		ipfs, err := createIpfsNode(ctx, ipfsRepoRoot, ipfsBootstrapAddrs)
+		node, ipfs, err := createIpfsNode(ctx, ipfsRepoRoot, ipfsBootstrapAddrs)
 		if err != nil {
 			log.Fatalf("Failed to spawn IPFS node: %v", err)
 		}
@@ -103,48 +98,127 @@ var daemonCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		d, clean, err := loadBackupDB(repoPath, threadID, viper.GetBool("debug"), threadsBootstrapAddrs)
+		d, threadsNet, clean, err := loadBackupDB(repoPath, threadID, viper.GetBool("debug"), threadsBootstrapAddrs)
 		defer clean()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		collection := d.GetCollection("Backup")
+		// Other nodes add these addresses to trustedNodes
+		for _, addr := range threadsNet.Host().Addrs() {
+			fmt.Printf("Threads node started listening on %v/p2p/%v\n", addr, threadsNet.Host().ID())
+		}
 
-		log.Info("Listening for backups performed by others on the thread...")
-		err = listenForBackups(ctx, d, collection, ipfs)
+		// Load the key that encrypts the metadata of backups in the thread
+		metadataKey, err := loadMetadataKey(repoPath)
+		switch {
+		case err == errNoMetadataSecret:
+			log.Warnf("%s. Until then, this node replicates the thread, but can not read or perform backups", err)
+		case err != nil:
+			log.Fatal(err)
+		case metadataKey == nil:
+			log.Warn("This node is storage only. It replicates the thread, but can not read or perform backups")
+		}
+
+		service, err := api.NewService(node, ipfs, d, metadataKey, provider, filepath.Join(repoPath, "backups"), filepath.Join(repoPath, "staging"))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		// Run schedules
-		schedules := viper.Sub("schedules")
-		if schedules != nil {
-			log.Info("Starting schedules")
-			err = startSchedules(ctx, viper.Sub("schedules"), repoPath)
-			if err != nil {
-				log.Fatal(err)
-			}
+		// Count the files of encrypted backups
+		service.SetBackupPassword(os.Getenv("IPFS_IOS_BACKUP_PASSWORD"))
+
+		// Encrypt backups and records saved by older versions
+		if err := service.MigrateLegacyBackups(); err != nil && err != api.ErrNoMetadataKey {
+			log.Fatalf("Failed to encrypt backups: %s", err)
+		}
+		if err := service.MigrateLegacyRecords(); err != nil && err != api.ErrNoMetadataKey {
+			log.Fatalf("Failed to encrypt backup history: %s", err)
+		}
+		if err := listenForLegacyRecords(d, service); err != nil {
+			log.Fatal(err)
 		}
 
-		ptarget, err := TcpAddrFromMultiAddr(apiAddr)
+		// Push backups to pinning services
+		pinner, err := newPinner(ctx, service, node, ipfs)
 		if err != nil {
 			log.Fatal(err)
 		}
+		pinner.start()
 
-		lis, err := net.Listen("tcp", ptarget)
+		log.Info("Listening for backups performed by others on the thread...")
+		err = listenForBackups(ctx, d, service, node, ipfs, pinner)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Run schedules. The scheduler runs without schedules so they can be added by reloading the config
+		log.Info("Starting schedules")
+		scheduler, err := newScheduler(ctx, service)
+		if err != nil {
+			log.Fatalf("Failed to start schedules: %s", err)
+		}
+		service.SetScheduler(scheduler)
+		scheduler.start()
+
+		if err := listenForSchedules(d, scheduler); err != nil {
+			log.Fatal(err)
+		}
+
+		// Reload the config when it changes, on SIGHUP or through the API
+		reloader := &configReloader{
+			scheduler:        scheduler,
+			pinner:           pinner,
+			node:             node,
+			threadsNet:       threadsNet,
+			ipfsBootstrap:    ipfsBootstrapAddrs,
+			threadsBootstrap: threadsBootstrapAddrs,
+		}
+		service.OnReloadConfig(reloader.reload)
+		reloader.watch(ctx)
+
+		// Invites are accepted on the threads host, which new nodes can reach before they have the swarm key
+		inviter := &inviteServer{
+			repoPath: repoPath,
+			d:        d,
+			host:     threadsNet.Host(),
+			inviter:  invite.NewInviter(ctx, threadsNet.Host()),
+		}
+		service.OnInvite(inviter.invite)
+
+		// Secrets rotated by trusted nodes are applied when the daemon restarts
+		invite.HandleAnnouncements(ctx, threadsNet.Host(), isTrustedNode, func(from peer.ID, payload []byte) error {
+			return receiveRotatedSecrets(repoPath, from, payload)
+		})
+
+		ptarget, err := TcpAddrFromMultiAddr(apiAddr)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		service, err := api.NewService(ipfs, d)
+		lis, err := net.Listen("tcp", ptarget)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		grpcServer := grpc.NewServer()
+		grpcServer := grpc.NewServer(grpc.UnaryInterceptor(api.UnaryErrorInterceptor), grpc.StreamInterceptor(api.StreamErrorInterceptor))
 		pb.RegisterAPIServer(grpcServer, service)
+
+		// Cancel running backups on shutdown so devices are not left in the middle of a backup
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupted
+			log.Info("Shutting down. Cancelling running backups...")
+			cancel()
+			grpcServer.Stop()
+
+			<-interrupted
+			log.Fatal("Shutting down without waiting for backups")
+		}()
+
 		grpcServer.Serve(lis)
+		service.WaitForBackup()
 	},
 }
 
@@ -152,6 +226,22 @@ func init() {
 	rootCmd.AddCommand(daemonCmd)
 }
 
+// bootstrapAddrsFromConfig reads a list of bootstrap peer addresses from the config
+func bootstrapAddrsFromConfig(key string) ([]ma.Multiaddr, error) {
+	list := viper.GetStringSlice(key)
+	addrs := make([]ma.Multiaddr, len(list))
+	for i, v := range list {
+		a, err := ma.NewMultiaddr(v)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs[i] = a
+	}
+
+	return addrs, nil
+}
+
 func TcpAddrFromMultiAddr(maddr ma.Multiaddr) (addr string, err error) {
 	if maddr == nil {
 		err = fmt.Errorf("invalid address")
@@ -169,23 +259,23 @@ func TcpAddrFromMultiAddr(maddr ma.Multiaddr) (addr string, err error) {
 }
 
 // See https://github.com/ipfs/go-ipfs/blob/master/docs/examples/go-ipfs-as-a-library/main.go
-func createIpfsNode(ctx context.Context, repoPath string, bootstrapAddrs []ma.Multiaddr) (icore.CoreAPI, error) {
+func createIpfsNode(ctx context.Context, repoPath string, bootstrapAddrs []ma.Multiaddr) (*core.IpfsNode, icore.CoreAPI, error) {
 	// Check if swarm key exists
 	swarmKeyPath := filepath.Join(repoPath, "swarm.key")
 	_, err := os.Stat(swarmKeyPath)
 	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("Swarm key does not exist. Refusing to start IPFS node. Try running `ipfs-ios-backup init`")
+		return nil, nil, fmt.Errorf("Swarm key does not exist. Refusing to start IPFS node. Try running `ipfs-ios-backup init`")
 	}
 
 	// Setup plugins
 	if err := setupPlugins(repoPath); err != nil {
-		return nil, fmt.Errorf("Failed to setup plugins: %s", err)
+		return nil, nil, fmt.Errorf("Failed to setup plugins: %s", err)
 	}
 
 	// Open the repo
 	repo, err := fsrepo.Open(repoPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Construct the node
@@ -197,7 +287,7 @@ func createIpfsNode(ctx context.Context, repoPath string, bootstrapAddrs []ma.Mu
 
 	node, err := core.NewNode(ctx, nodeOptions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	addrs := node.PeerHost.Addrs()
@@ -208,40 +298,60 @@ func createIpfsNode(ctx context.Context, repoPath string, bootstrapAddrs []ma.Mu
 	// Bootstrap
 	addrInfos, err := peer.AddrInfosFromP2pAddrs(bootstrapAddrs...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	node.Bootstrap(bootstrap.BootstrapConfigWithPeers(addrInfos))
 
 	// Attach the Core API to the constructed node
-	return coreapi.NewCoreAPI(node)
+	ipfs, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return node, ipfs, nil
 }
 
-func loadBackupDB(repoRoot string, threadID thread.ID, debug bool, bootstrapAddrs []ma.Multiaddr) (*db.DB, func(), error) {
+func loadBackupDB(repoRoot string, threadID thread.ID, debug bool, bootstrapAddrs []ma.Multiaddr) (*db.DB, common.NetBoostrapper, func(), error) {
 	addrInfos, err := peer.AddrInfosFromP2pAddrs(bootstrapAddrs...)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	net, err := common.DefaultNetwork(repoRoot, common.WithNetDebug(debug), common.WithNetHostAddr(threadsAddr))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	net.Bootstrap(addrInfos)
 
 	d, err := db.NewDB(context.Background(), net, threadID, db.WithNewDBRepoPath(repoRoot))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	// Create any collections missing from repos initialized by older versions
+	for _, cc := range collectionConfigs() {
+		if d.GetCollection(cc.Name) != nil {
+			continue
+		}
+
+		log.Infof("Creating missing collection %s", cc.Name)
+		if _, err := d.NewCollection(cc); err != nil {
+			return nil, nil, func() { d.Close() }, err
+		}
 	}
 
-	return d, func() { d.Close() }, nil
+	return d, net, func() { d.Close() }, nil
 }
 
-// Listen for new backups made on any device in the thread
-func listenForBackups(ctx context.Context, d *db.DB, collection *db.Collection, ipfs icore.CoreAPI) error {
+// Listen for new backups made on any device in the thread, and push them to pinning services
+func listenForBackups(ctx context.Context, d *db.DB, service *api.Service, node *core.IpfsNode, ipfs icore.CoreAPI, pinner *pinner) error {
 	l, err := d.Listen(db.ListenOption{
 		Type:       db.ListenAll,
-		Collection: "Backup",
+		Collection: "SealedBackup",
+	}, db.ListenOption{
+		Type:       db.ListenSave,
+		Collection: "SealedSnapshot",
 	})
 
 	if err != nil {
@@ -252,19 +362,26 @@ func listenForBackups(ctx context.Context, d *db.DB, collection *db.Collection,
 		defer l.Close()
 
 		for action := range l.Channel() {
-			switch action.Type {
-			case db.ActionDelete:
+			if action.Collection == "SealedSnapshot" {
+				if err := unpinPrunedBackup(ctx, service, node, ipfs, pinner, action.ID); err != nil && err != api.ErrNoMetadataKey {
+					log.Errorf("error when listening to thread: %v", err)
+				}
+				continue
+			}
+
+			switch {
+			case action.Type == db.ActionDelete:
 				break
 			default:
-				v, err := collection.FindByID(action.ID)
+				backup, err := service.OpenBackup(action.ID)
+				if err == api.ErrNoMetadataKey {
+					continue
+				}
 				if err != nil {
 					log.Errorf("error when listening to thread: %v", err)
 					continue
 				}
 
-				backup := &api.Backup{}
-				util.InstanceFromJSON(v, backup)
-
 				id, err := cid.Decode(backup.LatestBackupCid)
 				if err != nil {
 					log.Errorf("error when listening to thread: %v", err)
@@ -278,6 +395,8 @@ func listenForBackups(ctx context.Context, d *db.DB, collection *db.Collection,
 					log.Errorf("error when listening to thread: %v", err)
 					continue
 				}
+
+				go pinner.pin(backup.DeviceID, backup.LatestBackupCid)
 			}
 		}
 	}()
@@ -285,69 +404,151 @@ func listenForBackups(ctx context.Context, d *db.DB, collection *db.Collection,
 	return nil
 }
 
-func startSchedules(ctx context.Context, schedules *viper.Viper, repoPath string) error {
-	s1 := gocron.NewScheduler(time.UTC)
+// Seal the records saved in plain text by nodes that have not been upgraded yet
+func listenForLegacyRecords(d *db.DB, service *api.Service) error {
+	var opts []db.ListenOption
+	for _, name := range []string{"Backup", "Snapshot", "Run", "Schedule", "RemotePin"} {
+		opts = append(opts, db.ListenOption{
+			Type:       db.ListenAll,
+			Collection: name,
+		})
+	}
 
-	for name := range schedules.AllSettings() {
-		schedule := schedules.Sub(name)
+	l, err := d.Listen(opts...)
+	if err != nil {
+		return err
+	}
 
-		rawDeviceID := schedule.GetString("deviceID")
-		deviceID := idevice.DeviceID(rawDeviceID)
-		periodInHours := schedule.GetUint64("periodInHours")
+	go func() {
+		defer l.Close()
 
-		onlyWhenCharging := false
-		var minBatteryLevel int
-		if schedule.IsSet("onlyWhenCharging") {
-			onlyWhenCharging = schedule.GetBool("onlyWhenCharging")
-		} else {
-			minBatteryLevel = schedule.GetInt("minBatteryLevel")
+		for action := range l.Channel() {
+			if action.Type == db.ActionDelete {
+				continue
+			}
+
+			migrate := service.MigrateLegacyRecords
+			if action.Collection == "Backup" {
+				migrate = service.MigrateLegacyBackups
+			}
+
+			if err := migrate(); err != nil && err != api.ErrNoMetadataKey {
+				log.Errorf("error when listening to thread: %v", err)
+			}
 		}
+	}()
 
-		s1.Every(uint64(periodInHours)).Hours().StartImmediately().Do(runScheduledBackup, ctx, deviceID, repoPath, minBatteryLevel, onlyWhenCharging)
+	return nil
+}
 
-		log.Infof("Scheduled backup for device %s (%v)", deviceID, schedule.AllSettings())
+// Apply schedules created, updated or deleted through the API of any node in the thread
+func listenForSchedules(d *db.DB, scheduler *scheduler) error {
+	l, err := d.Listen(db.ListenOption{
+		Type:       db.ListenAll,
+		Collection: "SealedSchedule",
+	})
+	if err != nil {
+		return err
 	}
 
-	s1.StartAsync()
+	go func() {
+		defer l.Close()
+
+		for range l.Channel() {
+			if err := scheduler.ReloadSchedules(); err != nil {
+				log.Errorf("failed to reload schedules: %s", err)
+			}
+		}
+	}()
 
 	return nil
 }
 
-func runScheduledBackup(ctx context.Context, deviceID idevice.DeviceID, repoPath string, minBatteryLevel int, onlyWhenCharging bool) {
-	log.Infof("Backup triggered for device %s", deviceID)
-	log.Infof("onlyWhenCharging is %v", onlyWhenCharging)
+// Unpin a backup once its snapshot has been pruned by any node in the thread
+func unpinPrunedBackup(ctx context.Context, service *api.Service, node *core.IpfsNode, ipfs icore.CoreAPI, pinner *pinner, snapshotID threadcore.InstanceID) error {
+	snapshot, err := service.OpenSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	if snapshot.PrunedAt.IsZero() {
+		return nil
+	}
+
+	referenced, err := service.BackupIsReferenced(snapshot.BackupCid)
+	if err != nil || referenced {
+		return err
+	}
 
-	log.Infof("Checking if device is on charger")
+	if err := pinner.unpin(snapshot.BackupCid); err != nil {
+		log.Errorf("failed to remove pruned backup from pinning services: %s", err)
+	}
 
-	isCharging, err := idevice.GetDeviceBatteryIsCharging(deviceID)
+	id, err := cid.Decode(snapshot.BackupCid)
 	if err != nil {
-		log.Errorf("failed to check if device is charging: %s", err)
-		return
+		return err
 	}
 
-	if !isCharging {
-		if onlyWhenCharging {
-			log.Infof("Device is not on charger. Skipping backup.")
-			return
-		}
+	unpinned, err := api.UnpinBackup(ctx, ipfs, id)
+	if err != nil || !unpinned {
+		return err
+	}
 
-		log.Infof("Checking if battery level >= %v%%", minBatteryLevel)
+	log.Infof("Unpinned pruned backup %v", id)
 
-		currentBatteryLevel, err := idevice.GetDeviceBatteryCurrentCapacity(deviceID)
-		if err != nil {
-			log.Errorf("failed to check device battery level: %s", err)
+	return corerepo.GarbageCollect(node, ctx)
+}
+
+// backupEventLogger logs the progress of a backup as structured log lines.
+// Every event is logged at debug level, and progress is logged at info level every 10%
+func backupEventLogger(deviceID idevice.DeviceID) func(*pb.PerformBackupEvent) {
+	phase := pb.BackupPhase(-1)
+	var step int
+
+	return func(event *pb.PerformBackupEvent) {
+		fields := []interface{}{
+			"deviceID", deviceID,
+			"phase", event.Phase.String(),
+			"percent", fmt.Sprintf("%.1f", event.Percent),
+			"bytes", event.Bytes,
+			"totalBytes", event.TotalBytes,
+			"files", event.Files,
+		}
+		if event.Status != "" {
+			fields = append(fields, "status", event.Status)
+		}
+		if event.File != "" {
+			fields = append(fields, "file", event.File)
+		}
+
+		if event.Phase != phase {
+			phase = event.Phase
+			step = 0
+			log.Infow("Backup phase changed", fields...)
 			return
 		}
 
-		if int(currentBatteryLevel) < minBatteryLevel {
-			log.Warnf("Device is not charged enough (%v%% < %v%%). Skipping backup.", currentBatteryLevel, minBatteryLevel)
+		if int(event.Percent/10) > step {
+			step = int(event.Percent / 10)
+			log.Infow("Backup progress", fields...)
 			return
 		}
+
+		log.Debugw("Backup progress", fields...)
 	}
+}
 
-	err = performBackup(ctx, deviceID, repoPath)
-	if err != nil {
-		log.Error(err)
-		return
+// retentionPolicyFromConfig reads the retention policy of a schedule, if it has one
+func retentionPolicyFromConfig(retention *viper.Viper) *pb.RetentionPolicy {
+	if retention == nil {
+		return nil
+	}
+
+	return &pb.RetentionPolicy{
+		KeepLast:     retention.GetUint32("keepLast"),
+		KeepDaily:    retention.GetUint32("keepDaily"),
+		KeepWeekly:   retention.GetUint32("keepWeekly"),
+		KeepMonthly:  retention.GetUint32("keepMonthly"),
+		MaxAgeInDays: retention.GetUint32("maxAgeInDays"),
 	}
 }
@@ -39,7 +39,7 @@ var devicesListCmd = &cobra.Command{
 	Short: "List connected iOS devices",
 	Long:  "List connected iOS devices",
 	Run: func(cmd *cobra.Command, args []string) {
-		devices, err := idevice.GetDevices()
+		devices, err := provider.GetDevices()
 
 		if err != nil {
 			panic(err)
@@ -62,7 +62,7 @@ var devicesListCmd = &cobra.Command{
 				connTypeStr = "Unknown"
 			}
 
-			deviceName, err := idevice.GetDeviceName(device.Udid)
+			deviceName, err := provider.GetDeviceName(device.Udid)
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	secretsEnvelopeVersion = 1
+	// scrypt parameters recommended for interactive logins in 2017. Files with larger parameters are refused, so a
+	// crafted file can not make the key derivation use unbounded memory or time
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// Size of the scrypt salt in bytes
+	scryptSaltSize = 16
+)
+
+// secretsEnvelope is an export encrypted with a passphrase
+type secretsEnvelope struct {
+	Version    int
+	KDF        string
+	N          int
+	R          int
+	P          int
+	Salt       []byte
+	Cipher     string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// sealSecrets encrypts an export with a key derived from a passphrase
+func sealSecrets(e *export, passphrase string) ([]byte, error) {
+	plaintext, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &secretsEnvelope{
+		Version: secretsEnvelopeVersion,
+		KDF:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, scryptSaltSize),
+		Cipher:  "xchacha20-poly1305",
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+
+	if _, err := rand.Read(envelope.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := envelope.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = aead.Seal(nil, envelope.Nonce, plaintext, envelope.additionalData())
+
+	return json.Marshal(envelope)
+}
+
+// openSecrets decrypts an export encrypted by sealSecrets
+func openSecrets(envelope *secretsEnvelope, passphrase string) (*export, error) {
+	if envelope.Version != secretsEnvelopeVersion || envelope.KDF != "scrypt" || envelope.Cipher != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("Unsupported secrets file version %d (%s, %s). Try upgrading ipfs-ios-backup", envelope.Version, envelope.KDF, envelope.Cipher)
+	}
+
+	if envelope.N < 2 || envelope.N > scryptN || envelope.R < 1 || envelope.R > scryptR || envelope.P < 1 || envelope.P > scryptP {
+		return nil, fmt.Errorf("Invalid secrets file: unsupported scrypt parameters N=%d r=%d p=%d", envelope.N, envelope.R, envelope.P)
+	}
+	if len(envelope.Salt) < scryptSaltSize {
+		return nil, fmt.Errorf("Invalid secrets file: salt is too short")
+	}
+
+	aead, err := envelope.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid secrets file")
+	}
+
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, envelope.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt secrets: wrong passphrase or corrupted file")
+	}
+
+	e := &export{}
+	if err := json.Unmarshal(plaintext, e); err != nil {
+		return nil, fmt.Errorf("Invalid secrets file: %s", err)
+	}
+
+	return e, nil
+}
+
+func (envelope *secretsEnvelope) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), envelope.Salt, envelope.N, envelope.R, envelope.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive key from passphrase: %s", err)
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+// additionalData authenticates the version of the envelope and the parameters the key was derived with
+func (envelope *secretsEnvelope) additionalData() []byte {
+	return []byte(fmt.Sprintf("ipfs-ios-backup secrets v%d %s N=%d r=%d p=%d salt=%x %s", envelope.Version, envelope.KDF, envelope.N, envelope.R, envelope.P, envelope.Salt, envelope.Cipher))
+}
+
+// readSecretsPassphrase reads the passphrase of a secrets file from IPFS_IOS_BACKUP_SECRETS_PASSPHRASE, or prompts
+// for it. A new passphrase is asked for twice
+func readSecretsPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv("IPFS_IOS_BACKUP_SECRETS_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("set IPFS_IOS_BACKUP_SECRETS_PASSPHRASE to the passphrase of the secrets")
+	}
+
+	// Secrets are written to stdout, so prompts go to stderr
+	fmt.Fprint(os.Stderr, "Secrets passphrase: ")
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if len(passphrase) == 0 {
+		return "", errors.New("passphrase can not be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if string(repeated) != string(passphrase) {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+
+	return string(passphrase), nil
+}
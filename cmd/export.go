@@ -23,9 +23,10 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
@@ -36,46 +37,42 @@ type export struct {
 	Addrs     []string
 	ThreadKey string
 	SwarmKey  string
+	// MetadataKey is the secret the key that encrypts the metadata of backups is derived from
+	MetadataKey string `json:",omitempty"`
+	// StorageOnly nodes replicate the thread without the metadata key
+	StorageOnly bool `json:",omitempty"`
+	// Revoked is the peer ID of the node removed when the secrets were rotated
+	Revoked string `json:",omitempty"`
 }
 
+var exportStorageOnly bool
+
 // exportCmd represents the export command
 var exportCmd = &cobra.Command{
 	Use:   "export-secrets",
 	Short: "Export secrets needed to sync backups with another device",
-	Long:  "Export secrets needed to sync backups with another device",
+	Long:  "Export secrets needed to sync backups with another device, encrypted with a passphrase",
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		repoPath := viper.GetString("repoPath")
-		ipfsRepoRoot := filepath.Join(repoPath, ".ipfs")
-
 		// Get export
 		reply, err := client.Export(ctx)
 		if err != nil {
 			log.Fatalf("Failed to export: %s\n", err)
 		}
 
-		// Get swarm key
-		swarmKeyPath := filepath.Join(ipfsRepoRoot, "swarm.key")
-		f, err := os.Open(swarmKeyPath)
+		e, err := newExport(viper.GetString("repoPath"), reply.Addrs, reply.ThreadKey, exportStorageOnly)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		b2 := make([]byte, 128)
-		n2, err := f.Read(b2)
+		passphrase, err := readSecretsPassphrase(true)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		e := export{
-			Addrs:     reply.Addrs,
-			ThreadKey: reply.ThreadKey,
-			SwarmKey:  string(b2[:n2]),
-		}
-
-		obj, err := json.Marshal(e)
+		obj, err := sealSecrets(e, passphrase)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -86,4 +83,36 @@ var exportCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().BoolVar(&exportStorageOnly, "storage-only", false, "Export secrets for a node that replicates backups without being able to read their metadata")
+}
+
+// newExport collects the secrets of the node in repoPath for the thread at addrs
+func newExport(repoPath string, addrs []string, threadKey string, storageOnly bool) (*export, error) {
+	swarmKey, err := ioutil.ReadFile(filepath.Join(repoPath, ".ipfs", "swarm.key"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read swarm key: %s", err)
+	}
+
+	e := &export{
+		Addrs:       addrs,
+		ThreadKey:   threadKey,
+		SwarmKey:    string(swarmKey),
+		StorageOnly: storageOnly,
+	}
+
+	// Storage only nodes can not read the metadata of backups
+	if !storageOnly {
+		secret, err := readMetadataSecret(repoPath)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, errors.New("This node is storage only and can only export secrets for storage only nodes")
+		}
+
+		e.MetadataKey = hex.EncodeToString(secret)
+	}
+
+	return e, nil
 }
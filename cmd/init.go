@@ -67,17 +67,6 @@ var initCmd = &cobra.Command{
 			log.Fatalf("repo already exists at %s\n", repoPath)
 		}
 
-		// Create repo
-		if err := checkWritable(repoPath); err != nil {
-			log.Fatal(err)
-		}
-
-		// Create backups dir
-		backupDir := filepath.Join(repoPath, "backups")
-		if err := checkWritable(backupDir); err != nil {
-			log.Fatal(err)
-		}
-
 		var existingExport *export
 		if secretsImportPath != "" {
 			existingExport, err = importSecrets(secretsImportPath)
@@ -88,46 +77,70 @@ var initCmd = &cobra.Command{
 			fmt.Printf("Importing secrets from %v\n", secretsImportPath)
 		}
 
-		// Get IPFS bootstrap list
-		ipfsBootstrapList := viper.GetStringSlice("ipfsBootstrapList")
+		if err := initRepo(ctx, repoPath, existingExport); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
 
-		// Get Threads bootstrap list
-		threadsBootstrapList := viper.GetStringSlice("threadsBootstrapList")
-		threadsBootstrapAddrs := make([]ma.Multiaddr, len(threadsBootstrapList))
-		for i, v := range threadsBootstrapList {
-			a, err := ma.NewMultiaddr(v)
-			if err != nil {
-				log.Fatal(err)
-			}
+func init() {
+	rootCmd.AddCommand(initCmd)
 
-			threadsBootstrapAddrs[i] = a
-		}
+	initCmd.Flags().StringVar(&secretsImportPath, "secrets", "", "Secrets file exported from another node")
+}
 
-		if err := initIpfsRepo(repoPath, existingExport, ipfsBootstrapList); err != nil {
-			log.Fatal(err)
-		}
+// initRepo creates a repo at repoPath, with a new thread or joining the thread of an export
+func initRepo(ctx context.Context, repoPath string, existingExport *export) error {
+	// Create repo
+	if err := checkWritable(repoPath); err != nil {
+		return err
+	}
+
+	// Create backups dir
+	backupDir := filepath.Join(repoPath, "backups")
+	if err := checkWritable(backupDir); err != nil {
+		return err
+	}
+
+	// Get IPFS bootstrap list
+	ipfsBootstrapList := viper.GetStringSlice("ipfsBootstrapList")
 
-		threadID, clean, err := initThreadsRepo(ctx, repoPath, existingExport, threadsBootstrapAddrs)
-		defer clean()
+	// Get Threads bootstrap list
+	threadsBootstrapList := viper.GetStringSlice("threadsBootstrapList")
+	threadsBootstrapAddrs := make([]ma.Multiaddr, len(threadsBootstrapList))
+	for i, v := range threadsBootstrapList {
+		a, err := ma.NewMultiaddr(v)
 		if err != nil {
-			log.Fatalf("Could not initialize threads repo: %s", err)
+			return err
 		}
 
-		fmt.Printf("Repo created at %s\n", repoPath)
+		threadsBootstrapAddrs[i] = a
+	}
 
-		viper.Set("threadID", threadID)
-		if err = viper.WriteConfig(); err != nil {
-			log.Fatal(err)
-		}
+	if err := initIpfsRepo(repoPath, existingExport, ipfsBootstrapList); err != nil {
+		return err
+	}
 
-		fmt.Printf("Saved config to %s\n", viper.ConfigFileUsed())
-	},
-}
+	threadID, clean, err := initThreadsRepo(ctx, repoPath, existingExport, threadsBootstrapAddrs)
+	defer clean()
+	if err != nil {
+		return fmt.Errorf("Could not initialize threads repo: %s", err)
+	}
 
-func init() {
-	rootCmd.AddCommand(initCmd)
+	if err := createMetadataKey(repoPath, existingExport); err != nil {
+		return err
+	}
 
-	initCmd.Flags().StringVar(&secretsImportPath, "secrets", "", "Secrets file exported from another node")
+	fmt.Printf("Repo created at %s\n", repoPath)
+
+	viper.Set("threadID", threadID)
+	if err = viper.WriteConfig(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved config to %s\n", viper.ConfigFileUsed())
+
+	return nil
 }
 
 func initIpfsRepo(repoRoot string, existingExport *export, ipfsBootstrapList []string) error {
@@ -225,18 +238,14 @@ func checkWritable(dir string) error {
 	return err
 }
 
-// See https://github.com/Kubuxu/go-ipfs-swarm-key-gen
+// createSwarmKey writes a new swarm key, or the swarm key of an export
 func createSwarmKey(ipfsRepoRoot string, existingExport *export) error {
 	var swarmKey string
 	if existingExport == nil {
-		key := make([]byte, 32)
-		_, err := rand.Read(key)
-		if err != nil {
-			return fmt.Errorf("While trying to create swarm key: %s", err)
+		var err error
+		if swarmKey, err = newSwarmKey(); err != nil {
+			return err
 		}
-
-		encodedKey := hex.EncodeToString(key)
-		swarmKey = fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", encodedKey)
 	} else {
 		swarmKey = existingExport.SwarmKey
 	}
@@ -250,6 +259,20 @@ func createSwarmKey(ipfsRepoRoot string, existingExport *export) error {
 	return nil
 }
 
+// newSwarmKey generates a swarm key for a new private network.
+// See https://github.com/Kubuxu/go-ipfs-swarm-key-gen
+func newSwarmKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("While trying to create swarm key: %s", err)
+	}
+
+	encodedKey := hex.EncodeToString(key)
+
+	return fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", encodedKey), nil
+}
+
 func initThreadsRepo(ctx context.Context, repoRoot string, existingExport *export, bootstrapAddrs []ma.Multiaddr) (thread.ID, func(), error) {
 	addrInfos, err := peer.AddrInfosFromP2pAddrs(bootstrapAddrs...)
 	if err != nil {
@@ -272,13 +295,10 @@ func initThreadsRepo(ctx context.Context, repoRoot string, existingExport *expor
 			return thread.Undef, func() { net.Close() }, err
 		}
 
-		_, err = d.NewCollection(db.CollectionConfig{
-			Name:   "Backup",
-			Schema: util.SchemaFromInstance(&api.Backup{}, false),
-		})
-
-		if err != nil {
-			return thread.Undef, func() { d.Close(); net.Close() }, err
+		for _, cc := range collectionConfigs() {
+			if _, err = d.NewCollection(cc); err != nil {
+				return thread.Undef, func() { d.Close(); net.Close() }, err
+			}
 		}
 
 		fmt.Printf("Created thread %s\n", id)
@@ -321,12 +341,7 @@ func initThreadsRepo(ctx context.Context, repoRoot string, existingExport *expor
 			}
 
 			// If successful add DB
-			cc1 := db.CollectionConfig{
-				Name:   "Backup",
-				Schema: util.SchemaFromInstance(&api.Backup{}, false),
-			}
-
-			d, err = db.NewDBFromAddr(mctx, net, addr, key, db.WithNewDBRepoPath(repoRoot), db.WithNewDBCollections(cc1))
+			d, err = db.NewDBFromAddr(mctx, net, addr, key, db.WithNewDBRepoPath(repoRoot), db.WithNewDBCollections(collectionConfigs()...))
 			if err != nil {
 				log.Warnf("Could not create db %v: %v", addr, err)
 				continue
@@ -345,28 +360,80 @@ func initThreadsRepo(ctx context.Context, repoRoot string, existingExport *expor
 	return id, func() { d.Close(); net.Close() }, nil
 }
 
-func importSecrets(filePath string) (*export, error) {
-	s, err := os.Stat(filePath)
-	if err != nil {
-		return nil, err
+// collectionConfigs are the collections every node keeps in the backup DB
+func collectionConfigs() []db.CollectionConfig {
+	return []db.CollectionConfig{
+		{
+			Name:   "SealedBackup",
+			Schema: util.SchemaFromInstance(&api.SealedBackup{}, false),
+		},
+		{
+			Name:   "Backup",
+			Schema: util.SchemaFromInstance(&api.LegacyBackup{}, false),
+		},
+		{
+			Name:   "SealedSnapshot",
+			Schema: util.SchemaFromInstance(&api.SealedRecord{}, false),
+		},
+		{
+			Name:   "SealedRun",
+			Schema: util.SchemaFromInstance(&api.SealedRecord{}, false),
+		},
+		{
+			Name:   "SealedSchedule",
+			Schema: util.SchemaFromInstance(&api.SealedRecord{}, false),
+		},
+		{
+			Name:   "SealedRemotePin",
+			Schema: util.SchemaFromInstance(&api.SealedRecord{}, false),
+		},
+		// Collections of records older versions wrote in plain text
+		{
+			Name:   "Snapshot",
+			Schema: util.SchemaFromInstance(&api.Snapshot{}, false),
+		},
+		{
+			Name:   "Run",
+			Schema: util.SchemaFromInstance(&api.Run{}, false),
+		},
+		{
+			Name:   "Schedule",
+			Schema: util.SchemaFromInstance(&api.LegacySchedule{}, false),
+		},
+		{
+			Name:   "RemotePin",
+			Schema: util.SchemaFromInstance(&api.RemotePin{}, false),
+		},
 	}
+}
 
-	f, err := os.Open(filePath)
+// importSecrets reads a secrets file, prompting for its passphrase. Plain text files exported by older versions are accepted too
+func importSecrets(filePath string) (*export, error) {
+	b, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 
-	b2 := make([]byte, s.Size())
-	n2, err := f.Read(b2)
-	if err != nil {
-		return nil, err
+	envelope := &secretsEnvelope{}
+	if err := json.Unmarshal(b, envelope); err != nil {
+		return nil, fmt.Errorf("Invalid secrets file: %s", err)
 	}
 
-	exportJ := string(b2[:n2])
+	if envelope.Version == 0 {
+		log.Warnf("Secrets file %s is not encrypted. Delete it once this node is initialized, and use export-secrets to export encrypted secrets", filePath)
 
-	e := export{}
+		e := &export{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return nil, fmt.Errorf("Invalid secrets file: %s", err)
+		}
 
-	json.Unmarshal([]byte(exportJ), &e)
+		return e, nil
+	}
+
+	passphrase, err := readSecretsPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
 
-	return &e, nil
+	return openSecrets(envelope, passphrase)
 }
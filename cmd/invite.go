@@ -0,0 +1,292 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/invite"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/textileio/go-threads/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultInviteTTL = 10 * time.Minute
+	// How long join looks for the inviting node on the local network
+	discoverTimeout = 2 * time.Minute
+)
+
+var (
+	inviteTTL         time.Duration
+	inviteStorageOnly bool
+	joinPeer          string
+)
+
+// inviteCmd represents the invite command
+var inviteCmd = &cobra.Command{
+	Use:   "invite",
+	Short: "Invite a new node to sync backups with this node",
+	Long:  "Invite a new node to sync backups with this node. The new node joins with the code printed, without copying a secrets file",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
+		if inviteTTL < time.Minute {
+			log.Fatal("--ttl must be at least 1m")
+		}
+
+		stream, err := client.Invite(ctx, uint64(inviteTTL/time.Minute), inviteStorageOnly)
+		if err != nil {
+			log.Fatalf("Failed to invite: %s\n", err)
+		}
+
+		for {
+			event, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Fatal("Invite cancelled.")
+				}
+				log.Fatalf("Failed to invite: %s\n", err)
+			}
+
+			if event.JoinedPeerID != "" {
+				fmt.Printf("Node %s joined.\n", event.JoinedPeerID)
+				continue
+			}
+
+			fmt.Printf("Invite code: %s\n\n", event.Code)
+			fmt.Println("On the new node, run:")
+			fmt.Printf("  ipfs-ios-backup join %s\n\n", event.Code)
+			fmt.Println("If the new node can not find this node on the local network, add --peer with one of:")
+			for _, addr := range event.Addrs {
+				fmt.Printf("  %s\n", addr)
+			}
+			fmt.Printf("\nWaiting for the node to join...\n")
+		}
+	},
+}
+
+// joinCmd represents the join command
+var joinCmd = &cobra.Command{
+	Use:   "join [code]",
+	Short: "Initialize ipfs-ios-backup repo with the invite of another node",
+	Long:  "Initialize ipfs-ios-backup repo with the secrets of another node, received with the code printed by invite on that node",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
+		code := args[0]
+		if err := invite.CheckCode(code); err != nil {
+			log.Fatal(err)
+		}
+
+		// Find repo path
+		repoPath := viper.GetString("repoPath")
+
+		if _, err := os.Stat(repoPath); err == nil {
+			log.Fatalf("repo already exists at %s\n", repoPath)
+		}
+
+		var info *peer.AddrInfo
+		if joinPeer != "" {
+			addr, err := ma.NewMultiaddr(joinPeer)
+			if err != nil {
+				log.Fatalf("Invalid --peer: %s", err)
+			}
+
+			info, err = peer.AddrInfoFromP2pAddr(addr)
+			if err != nil {
+				log.Fatalf("Invalid --peer: %s", err)
+			}
+		}
+
+		if err := joinRepo(ctx, repoPath, info, code); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inviteCmd)
+	rootCmd.AddCommand(joinCmd)
+
+	inviteCmd.Flags().DurationVar(&inviteTTL, "ttl", defaultInviteTTL, "How long the invite is open for")
+	inviteCmd.Flags().BoolVar(&inviteStorageOnly, "storage-only", false, "Invite a node that replicates backups without being able to read their metadata")
+
+	joinCmd.Flags().StringVar(&joinPeer, "peer", "", "Address of the inviting node, if it can not be found on the local network")
+}
+
+// joinRepo creates a repo at repoPath with the secrets of the invite with code. The inviting node is at info, or is
+// looked for on the local network if info is nil
+func joinRepo(ctx context.Context, repoPath string, info *peer.AddrInfo, code string) error {
+	// The secrets are received with a temporary host, before the repo and its keys exist
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"))
+	if err != nil {
+		return fmt.Errorf("Failed to start libp2p host: %s", err)
+	}
+
+	var payload []byte
+	if info != nil {
+		payload, err = invite.Join(ctx, h, *info, code)
+	} else {
+		fmt.Println("Looking for the inviting node on the local network...")
+
+		payload, err = joinDiscovered(ctx, h, code)
+	}
+	h.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to join: %s", err)
+	}
+
+	e := &export{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		return fmt.Errorf("Invalid secrets: %s", err)
+	}
+
+	fmt.Println("Received secrets")
+
+	return initRepo(ctx, repoPath, e)
+}
+
+// joinDiscovered joins the invite of the first node on the local network that has an invite with code
+func joinDiscovered(ctx context.Context, h host.Host, code string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+	defer cancel()
+
+	found, err := invite.Discover(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	tried := map[peer.ID]bool{}
+	for {
+		select {
+		case info := <-found:
+			if info.ID == h.ID() || tried[info.ID] {
+				continue
+			}
+			tried[info.ID] = true
+
+			payload, err := invite.Join(ctx, h, info, code)
+			if err == invite.ErrWrongCode {
+				return nil, err
+			}
+			if err != nil {
+				// Other nodes with open invites may be on the network
+				log.Debugf("Could not join %s: %s", info.ID, err)
+				continue
+			}
+
+			return payload, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Could not find the inviting node on the local network, try again with --peer")
+		}
+	}
+}
+
+// inviteServer invites new nodes to the thread of the daemon
+type inviteServer struct {
+	repoPath string
+	d        *db.DB
+	host     host.Host
+	inviter  *invite.Inviter
+}
+
+func (s *inviteServer) invite(req *pb.InviteRequest, srv pb.API_InviteServer) error {
+	addrs, key, err := s.d.GetDBInfo()
+	if err != nil {
+		return err
+	}
+
+	var rawAddrs []string
+	for _, addr := range addrs {
+		rawAddrs = append(rawAddrs, addr.String())
+	}
+
+	e, err := newExport(s.repoPath, rawAddrs, key.String(), req.StorageOnly)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	inv, err := s.inviter.Invite(payload)
+	if err != nil {
+		return err
+	}
+	defer s.inviter.Cancel(inv)
+
+	hostAddrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: s.host.ID(), Addrs: s.host.Addrs()})
+	if err != nil {
+		return err
+	}
+
+	var rawHostAddrs []string
+	for _, addr := range hostAddrs {
+		rawHostAddrs = append(rawHostAddrs, addr.String())
+	}
+
+	if err := srv.Send(&pb.InviteEvent{Code: inv.Code, Addrs: rawHostAddrs}); err != nil {
+		return err
+	}
+
+	ttl := time.Duration(req.TtlMinutes) * time.Minute
+	if ttl == 0 {
+		ttl = defaultInviteTTL
+	}
+
+	ctx, cancel := context.WithTimeout(srv.Context(), ttl)
+	defer cancel()
+
+	p, err := inv.Wait(ctx)
+	if err == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, "Invite expired")
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Node %s joined with an invite", p)
+
+	return srv.Send(&pb.InviteEvent{JoinedPeerID: p.String()})
+}
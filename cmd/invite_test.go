@@ -0,0 +1,189 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/invite"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+)
+
+// inviteStream is the stream of an invite request, which passes the events sent to it to a channel
+type inviteStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pb.InviteEvent
+}
+
+func (s *inviteStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *inviteStream) Send(event *pb.InviteEvent) error {
+	s.events <- event
+	return nil
+}
+
+// nextEvent returns the next event of an invite, which sends its error to errs and closes events when it returns
+func nextEvent(t *testing.T, events chan *pb.InviteEvent, errs chan error) *pb.InviteEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("invite returned %v before sending an event", <-errs)
+		}
+		return event
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for an invite event")
+	}
+
+	return nil
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// TestInviteAndJoinRepo invites a node from the thread of a repo, and joins it with a new repo
+func TestInviteAndJoinRepo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Both nodes run in this process, so they listen on ports of their own
+	threadsAddr = ma.StringCast("/ip4/127.0.0.1/tcp/0")
+	ipfsAddr = ma.StringCast("/ip4/127.0.0.1/tcp/0")
+	viper.SetConfigFile(filepath.Join(dir, "config.json"))
+	viper.Set("storageOnly", false)
+
+	// The inviting node has a thread, a swarm key and a metadata key like a repo created by init
+	inviting := filepath.Join(dir, "inviting")
+	if err := os.MkdirAll(filepath.Join(inviting, ".ipfs"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	threadID, clean, err := initThreadsRepo(ctx, inviting, nil, nil)
+	clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createSwarmKey(filepath.Join(inviting, ".ipfs"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := createMetadataKey(inviting, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d, net, closeDB, err := loadBackupDB(inviting, threadID, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Close()
+	defer closeDB()
+
+	s := &inviteServer{
+		repoPath: inviting,
+		d:        d,
+		host:     net.Host(),
+		inviter:  invite.NewInviter(ctx, net.Host()),
+	}
+
+	events := make(chan *pb.InviteEvent, 2)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.invite(&pb.InviteRequest{TtlMinutes: 1}, &inviteStream{ctx: ctx, events: events})
+		close(events)
+	}()
+
+	event := nextEvent(t, events, errs)
+	if len(event.Addrs) == 0 {
+		t.Fatal("invite has no addresses")
+	}
+
+	code := event.Code
+	info, err := peer.AddrInfoFromP2pAddr(ma.StringCast(event.Addrs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joining := filepath.Join(dir, "joining")
+	if err := joinRepo(ctx, joining, info, code); err != nil {
+		t.Fatal(err)
+	}
+
+	event = nextEvent(t, events, errs)
+	if event.JoinedPeerID == "" {
+		t.Errorf("second event is %v, want the peer that joined", event)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("invite returned %v", err)
+	}
+
+	// The joining node imported the secrets of the inviting node
+	if got := viper.GetString("threadID"); got != threadID.String() {
+		t.Errorf("joined thread %s, want %s", got, threadID)
+	}
+	if !bytes.Equal(readFile(t, filepath.Join(joining, ".ipfs", "swarm.key")), readFile(t, filepath.Join(inviting, ".ipfs", "swarm.key"))) {
+		t.Error("swarm keys differ")
+	}
+
+	want, err := readMetadataSecret(inviting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMetadataSecret(joining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("metadata secret is %x, want %x", got, want)
+	}
+
+	// The invite is closed once a node joined
+	if err := joinRepo(ctx, filepath.Join(dir, "again"), info, code); err == nil {
+		t.Error("second join with the same code succeeded")
+	}
+}
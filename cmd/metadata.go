@@ -0,0 +1,156 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codynhat/ipfs-ios-backup/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/viper"
+)
+
+// errNoMetadataSecret is returned for repos created by older versions, until one of the nodes of the thread creates
+// the metadata key
+var errNoMetadataSecret = errors.New("This repo was created by an older version and has no metadata key. Run secrets migrate on one node to create it and send it to the nodes in trustedNodes")
+
+// createMetadataKey writes the secret the metadata key is derived from to the repo. A new secret is created
+// unless one is imported. Storage only nodes get no secret, and repos joining a thread created by an older
+// version get it once a node of the thread creates it
+func createMetadataKey(repoRoot string, existingExport *export) error {
+	var secret []byte
+	switch {
+	case existingExport == nil:
+		secret = make([]byte, api.MetadataKeySize)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("While trying to create metadata key: %s", err)
+		}
+	case existingExport.StorageOnly:
+		viper.Set("storageOnly", true)
+		return nil
+	case existingExport.MetadataKey != "":
+		var err error
+		if secret, err = hex.DecodeString(existingExport.MetadataKey); err != nil {
+			return fmt.Errorf("Invalid metadata key: %s", err)
+		}
+	default:
+		return nil
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(repoRoot, "metadata.key"), []byte(hex.EncodeToString(secret)), 0600); err != nil {
+		return fmt.Errorf("Failed to write metadata key: %s", err)
+	}
+
+	return nil
+}
+
+// readMetadataSecret reads the secret the metadata key is derived from. Storage only nodes have no secret, and
+// errNoMetadataSecret is returned for repos created by older versions that have not received one yet
+func readMetadataSecret(repoRoot string) ([]byte, error) {
+	if viper.GetBool("storageOnly") {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(repoRoot, "metadata.key"))
+	if os.IsNotExist(err) {
+		return nil, errNoMetadataSecret
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata key: %s", err)
+	}
+
+	secret, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metadata key: %s", err)
+	}
+
+	return secret, nil
+}
+
+// loadMetadataKey loads the key that encrypts the metadata of backups, or nil if this node is storage only
+func loadMetadataKey(repoRoot string) (*api.MetadataKey, error) {
+	secret, err := readMetadataSecret(repoRoot)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	return api.NewMetadataKey(secret)
+}
+
+// migrateMetadataKey creates the metadata key of a repo created by an older version, unless it already has one,
+// and returns its secret
+func migrateMetadataKey(repoRoot string) ([]byte, error) {
+	secret, err := readMetadataSecret(repoRoot)
+	if err != errNoMetadataSecret {
+		return secret, err
+	}
+
+	if err := createMetadataKey(repoRoot, nil); err != nil {
+		return nil, err
+	}
+
+	return readMetadataSecret(repoRoot)
+}
+
+// receiveMetadataKey saves the metadata key created by a trusted node for a thread created by an older version.
+// A node that already has a metadata key keeps it
+func receiveMetadataKey(repoRoot string, from peer.ID, metadataKey string) error {
+	if viper.GetBool("storageOnly") {
+		return nil
+	}
+
+	received, err := hex.DecodeString(metadataKey)
+	if err != nil {
+		return fmt.Errorf("Invalid metadata key: %s", err)
+	}
+	if _, err := api.NewMetadataKey(received); err != nil {
+		return err
+	}
+
+	secret, err := readMetadataSecret(repoRoot)
+	if err != errNoMetadataSecret {
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(secret, received) {
+			return errors.New("This node already has a different metadata key")
+		}
+
+		return nil
+	}
+
+	if err := createMetadataKey(repoRoot, &export{MetadataKey: metadataKey}); err != nil {
+		return err
+	}
+
+	log.Warnf("Node %s created the metadata key of the thread. Restart the daemon to read and perform backups", from)
+
+	return nil
+}
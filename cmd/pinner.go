@@ -0,0 +1,325 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/api"
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/pinning"
+	"github.com/ipfs/go-ipfs/core"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/viper"
+)
+
+const (
+	// How often the status of pin requests that are not pinned yet is checked
+	remotePinCheckInterval = time.Minute
+	// How long a request to a pinning service can take
+	pinningRequestTimeout = time.Minute
+)
+
+// pinner asks the pinning services in the config to pin new backups, and tracks the status of the pin requests
+type pinner struct {
+	ctx     context.Context
+	service *api.Service
+	node    *core.IpfsNode
+	ipfs    icore.CoreAPI
+	// Pin requests are made one at a time, so a backup is only requested once per service
+	lock     sync.Mutex
+	services map[string]*pinning.Client
+}
+
+func newPinner(ctx context.Context, service *api.Service, node *core.IpfsNode, ipfs icore.CoreAPI) (*pinner, error) {
+	services, err := pinningServicesFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pinner{
+		ctx:      ctx,
+		service:  service,
+		node:     node,
+		ipfs:     ipfs,
+		services: services,
+	}, nil
+}
+
+// pinningServicesFromConfig reads the pinning services in the config by name
+func pinningServicesFromConfig() (map[string]*pinning.Client, error) {
+	services := map[string]*pinning.Client{}
+
+	config := viper.Sub("pinningServices")
+	if config == nil {
+		return services, nil
+	}
+
+	for name := range config.AllSettings() {
+		service := config.Sub(name)
+		if service == nil {
+			return nil, fmt.Errorf("Invalid pinning service %s", name)
+		}
+
+		endpoint, err := url.Parse(service.GetString("endpoint"))
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return nil, fmt.Errorf("Pinning service %s needs an http or https endpoint", name)
+		}
+
+		services[name] = pinning.NewClient(endpoint.String(), service.GetString("accessToken"))
+	}
+
+	return services, nil
+}
+
+// setServices replaces the pinning services, e.g. when the config is reloaded
+func (p *pinner) setServices(services map[string]*pinning.Client) {
+	p.lock.Lock()
+	p.services = services
+	p.lock.Unlock()
+
+	go p.catchUp()
+}
+
+// start catches up with backups made while the daemon was not running, then keeps checking the status of pin requests
+func (p *pinner) start() {
+	go func() {
+		ticker := time.NewTicker(remotePinCheckInterval)
+		defer ticker.Stop()
+
+		p.catchUp()
+		for {
+			select {
+			case <-ticker.C:
+				p.update()
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// catchUp removes backups that were pruned from the pinning services, and asks them to pin the latest backup
+// of every device if they have not yet. Pin requests that failed are made again
+func (p *pinner) catchUp() {
+	// Nodes without the metadata key can not read remote pins, and leave them to the nodes that can
+	pins, err := p.service.RemotePins("")
+	if err == api.ErrNoMetadataKey {
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to read remote pins: %s", err)
+		return
+	}
+
+	for _, pin := range pins {
+		referenced, err := p.service.BackupIsReferenced(pin.BackupCid)
+		if err != nil {
+			log.Errorf("failed to read remote pins: %s", err)
+			return
+		}
+
+		if !referenced {
+			if err := p.unpin(pin.BackupCid); err != nil {
+				log.Errorf("failed to remove %s from pinning services: %s", pin.BackupCid, err)
+			}
+		}
+	}
+
+	backups, err := p.service.ListBackups(p.ctx, &pb.ListBackupsRequest{})
+	if err != nil {
+		log.Errorf("failed to read backups: %s", err)
+		return
+	}
+
+	for _, backup := range backups.Backups {
+		p.pin(backup.DeviceID, backup.BackupCid)
+	}
+}
+
+// pin asks every pinning service to pin a backup, unless it already has
+func (p *pinner) pin(deviceID string, backupCid string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for name, client := range p.services {
+		if err := p.pinOn(name, client, deviceID, backupCid); err != nil {
+			log.Errorf("failed to pin %s on %s: %s", backupCid, name, err)
+		}
+	}
+}
+
+func (p *pinner) pinOn(name string, client *pinning.Client, deviceID string, backupCid string) error {
+	existing, err := p.service.GetRemotePin(name, backupCid)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Status != pinning.Failed {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, pinningRequestTimeout)
+	defer cancel()
+
+	// Another node with the same service may have requested the pin before it was recorded in the thread.
+	// Pinning services are not trusted with the metadata of backups, so the pin does not name the device
+	status, added, err := client.Ensure(ctx, pinning.Pin{
+		Cid:     backupCid,
+		Name:    "backup",
+		Origins: p.origins(),
+	})
+	if err != nil {
+		return err
+	}
+	if added {
+		log.Infof("Asked pinning service %s to pin %s", name, backupCid)
+	}
+
+	p.connect(status.Delegates)
+
+	return p.service.SaveRemotePin(&api.RemotePin{
+		Service:   name,
+		BackupCid: backupCid,
+		DeviceID:  deviceID,
+		RequestID: status.RequestID,
+		Status:    status.Status,
+		Reason:    status.Reason(),
+		NodeID:    p.node.Identity.Pretty(),
+	})
+}
+
+// update checks the status of pin requests that are not pinned yet. Requests made to services that are not
+// in the config of this node are left to the nodes that have them
+func (p *pinner) update() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Nodes without the metadata key can not read remote pins, and leave them to the nodes that can
+	pins, err := p.service.RemotePins("")
+	if err == api.ErrNoMetadataKey {
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to read remote pins: %s", err)
+		return
+	}
+
+	for _, pin := range pins {
+		client, ok := p.services[pin.Service]
+		if !ok || (pin.Status != pinning.Queued && pin.Status != pinning.Pinning) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(p.ctx, pinningRequestTimeout)
+		status, err := client.Check(ctx, pin.RequestID)
+		cancel()
+		if err != nil {
+			log.Warnf("Failed to check the status of %s on %s: %s", pin.BackupCid, pin.Service, err)
+			continue
+		}
+
+		if status.Status == pin.Status {
+			continue
+		}
+
+		pin.Status = status.Status
+		pin.Reason = status.Reason()
+		if err := p.service.SaveRemotePin(pin); err != nil {
+			log.Errorf("failed to save remote pin: %s", err)
+			continue
+		}
+
+		log.Infof("Pin of %s on %s is %s", pin.BackupCid, pin.Service, pin.Status)
+	}
+}
+
+// unpin removes a backup from the pinning services of this node it was pinned on
+func (p *pinner) unpin(backupCid string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pins, err := p.service.RemotePins(backupCid)
+	if err != nil {
+		return err
+	}
+
+	for _, pin := range pins {
+		client, ok := p.services[pin.Service]
+		if !ok {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(p.ctx, pinningRequestTimeout)
+		err := client.Remove(ctx, pin.RequestID)
+		cancel()
+		if err != nil && !pinning.IsNotFound(err) {
+			return err
+		}
+
+		if err := p.service.DeleteRemotePin(pin); err != nil {
+			return err
+		}
+
+		log.Infof("Removed %s from pinning service %s", backupCid, pin.Service)
+	}
+
+	return nil
+}
+
+// origins are the addresses pinning services can fetch backups from
+func (p *pinner) origins() []string {
+	var origins []string
+	for _, addr := range p.node.PeerHost.Addrs() {
+		origins = append(origins, fmt.Sprintf("%s/p2p/%s", addr, p.node.Identity.Pretty()))
+	}
+
+	return origins
+}
+
+// connect connects to the nodes of a pinning service that will pin a backup, so they can fetch it sooner
+func (p *pinner) connect(delegates []string) {
+	for _, v := range delegates {
+		addr, err := ma.NewMultiaddr(v)
+		if err != nil {
+			log.Debugf("Invalid delegate %s: %s", v, err)
+			continue
+		}
+
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			log.Debugf("Invalid delegate %s: %s", v, err)
+			continue
+		}
+
+		go func() {
+			if err := p.ipfs.Swarm().Connect(p.ctx, *info); err != nil {
+				log.Debugf("Failed to connect to delegate %s: %s", info.ID, err)
+			}
+		}()
+	}
+}
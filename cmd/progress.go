@@ -0,0 +1,88 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const progressBarWidth = 30
+
+// progressBar renders progress on a single line when writing to a terminal, or as one line per update otherwise
+type progressBar struct {
+	isTerminal bool
+	active     bool
+}
+
+func newProgressBar() *progressBar {
+	isTerminal := false
+	if st, err := os.Stdout.Stat(); err == nil {
+		isTerminal = st.Mode()&os.ModeCharDevice != 0
+	}
+
+	return &progressBar{
+		isTerminal: isTerminal,
+	}
+}
+
+// Update redraws the bar
+func (b *progressBar) Update(percent float64, detail string) {
+	if !b.isTerminal {
+		fmt.Printf("\t%5.1f%% %s\n", percent, detail)
+		return
+	}
+
+	filled := int(percent / 100 * progressBarWidth)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	// Clear the rest of the line in case the detail got shorter
+	fmt.Printf("\r[%s%s] %5.1f%% %s\033[K", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), percent, detail)
+	b.active = true
+}
+
+// Done ends the line of the bar so other output can be printed
+func (b *progressBar) Done() {
+	if b.active {
+		fmt.Println()
+		b.active = false
+	}
+}
+
+// formatBytes formats a number of bytes using binary units
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/fsnotify/fsnotify"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/bootstrap"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/textileio/go-threads/common"
+)
+
+var daemonReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the config of the running daemon",
+	Long:  "Reload the config of the running daemon, applying changes to schedules, pinning services, bootstrap peers and logging without interrupting running backups",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		reply, err := client.ReloadConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to reload config: %s\n", err)
+		}
+
+		fmt.Println("Config reloaded.")
+		printScheduleChanges("Added", reply.AddedSchedules)
+		printScheduleChanges("Updated", reply.UpdatedSchedules)
+		printScheduleChanges("Removed", reply.RemovedSchedules)
+	},
+}
+
+func init() {
+	daemonCmd.AddCommand(daemonReloadCmd)
+}
+
+// configReloader applies changes to the config to the running daemon
+type configReloader struct {
+	lock             sync.Mutex
+	scheduler        *scheduler
+	pinner           *pinner
+	node             *core.IpfsNode
+	threadsNet       common.NetBoostrapper
+	ipfsBootstrap    []ma.Multiaddr
+	threadsBootstrap []ma.Multiaddr
+}
+
+// watch reloads the config when the config file changes or the daemon receives SIGHUP, until ctx is done
+func (r *configReloader) watch(ctx context.Context) {
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			log.Infof("Config file %s changed. Reloading...", e.Name)
+			if _, err := r.apply(); err != nil {
+				log.Errorf("failed to reload config: %s", err)
+			}
+		})
+		viper.WatchConfig()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP. Reloading config...")
+				if _, err := r.reload(); err != nil {
+					log.Errorf("failed to reload config: %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reload reads the config file again and applies it
+func (r *configReloader) reload() (*pb.ReloadConfigReply, error) {
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("Failed to read config: %s", err)
+		}
+	}
+
+	return r.apply()
+}
+
+// apply reconciles schedules, pinning services, bootstrap peers and the log level with the config.
+// Settings that are only used when the daemon starts, e.g. addresses and the thread, are not applied
+func (r *configReloader) apply() (*pb.ReloadConfigReply, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ipfsBootstrap, err := bootstrapAddrsFromConfig("ipfsBootstrapList")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ipfsBootstrapList: %s", err)
+	}
+
+	threadsBootstrap, err := bootstrapAddrsFromConfig("threadsBootstrapList")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid threadsBootstrapList: %s", err)
+	}
+
+	pinningServices, err := pinningServicesFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := r.scheduler.reconcile()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setLogLevel(viper.GetBool("debug")); err != nil {
+		return nil, err
+	}
+
+	r.pinner.setServices(pinningServices)
+
+	if !reflect.DeepEqual(ipfsBootstrap, r.ipfsBootstrap) {
+		addrInfos, err := peer.AddrInfosFromP2pAddrs(ipfsBootstrap...)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ipfsBootstrapList: %s", err)
+		}
+
+		log.Infof("Bootstrapping IPFS node with %d peers", len(addrInfos))
+		if err := r.node.Bootstrap(bootstrap.BootstrapConfigWithPeers(addrInfos)); err != nil {
+			return nil, fmt.Errorf("Failed to bootstrap IPFS node: %s", err)
+		}
+		r.ipfsBootstrap = ipfsBootstrap
+	}
+
+	if !reflect.DeepEqual(threadsBootstrap, r.threadsBootstrap) {
+		addrInfos, err := peer.AddrInfosFromP2pAddrs(threadsBootstrap...)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid threadsBootstrapList: %s", err)
+		}
+
+		// Peers removed from the list stay connected until they disconnect
+		log.Infof("Bootstrapping threads with %d peers", len(addrInfos))
+		go r.threadsNet.Bootstrap(addrInfos)
+		r.threadsBootstrap = threadsBootstrap
+	}
+
+	// Check added and updated schedules right away
+	r.scheduler.checkAll()
+
+	return &pb.ReloadConfigReply{
+		AddedSchedules:   changes.added,
+		UpdatedSchedules: changes.updated,
+		RemovedSchedules: changes.removed,
+	}, nil
+}
+
+func printScheduleChanges(verb string, names []string) {
+	for _, name := range names {
+		fmt.Printf("%s schedule %s\n", verb, name)
+	}
+}
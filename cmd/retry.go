@@ -0,0 +1,155 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/spf13/viper"
+)
+
+// Classes of transient failures a schedule can retry
+const (
+	// The device went out of range, was unplugged or stopped responding
+	retryDisconnected = "disconnected"
+	// Another backup or restore was using the device
+	retryBusy = "busy"
+	// The device was locked with a passcode
+	retryLocked = "locked"
+	// The backup did not finish within maxDurationMinutes
+	retryTimeout = "timeout"
+)
+
+// retryPolicy is how a schedule retries a failed backup
+type retryPolicy struct {
+	// maxAttempts is the number of attempts, including the first, before giving up until the next backup is due.
+	// 0 means no limit
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	// classes are the failures that are retried. Other failures give up until the next backup is due.
+	// nil retries the failures of devices that idevice.IsRetryable returns true for
+	classes map[string]bool
+}
+
+// defaultRetryPolicy is used by schedules without a retry policy. Transient failures of the device are retried
+// when it is next connected, at most every minAttemptInterval, until a backup failed 3 times
+var defaultRetryPolicy = &retryPolicy{
+	maxAttempts:  3,
+	initialDelay: minAttemptInterval,
+	maxDelay:     minAttemptInterval,
+	multiplier:   1,
+}
+
+// retryPolicyFromConfig reads a retry policy from the config of a schedule
+func retryPolicyFromConfig(retry *viper.Viper) (*retryPolicy, error) {
+	if retry == nil {
+		return defaultRetryPolicy, nil
+	}
+
+	policy := &retryPolicy{
+		maxAttempts:  3,
+		initialDelay: time.Minute,
+		maxDelay:     time.Hour,
+		multiplier:   2,
+		classes: map[string]bool{
+			retryDisconnected: true,
+			retryBusy:         true,
+			retryLocked:       true,
+		},
+	}
+
+	if retry.IsSet("maxAttempts") {
+		policy.maxAttempts = retry.GetInt("maxAttempts")
+	}
+	if retry.IsSet("initialDelayMinutes") {
+		policy.initialDelay = time.Duration(retry.GetFloat64("initialDelayMinutes") * float64(time.Minute))
+	}
+	if retry.IsSet("maxDelayMinutes") {
+		policy.maxDelay = time.Duration(retry.GetFloat64("maxDelayMinutes") * float64(time.Minute))
+	}
+	if retry.IsSet("multiplier") {
+		policy.multiplier = retry.GetFloat64("multiplier")
+	}
+
+	if policy.maxAttempts < 0 || policy.initialDelay <= 0 || policy.maxDelay < policy.initialDelay || policy.multiplier < 1 {
+		return nil, fmt.Errorf("Invalid retry policy %v", retry.AllSettings())
+	}
+
+	if retry.IsSet("on") {
+		policy.classes = map[string]bool{}
+		for _, class := range retry.GetStringSlice("on") {
+			switch class = strings.ToLower(class); class {
+			case retryDisconnected, retryBusy, retryLocked, retryTimeout:
+				policy.classes[class] = true
+			default:
+				return nil, fmt.Errorf("Invalid retry class %q, expected %s, %s, %s or %s", class, retryDisconnected, retryBusy, retryLocked, retryTimeout)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// retries returns true if a run that failed with err should be tried again
+func (p *retryPolicy) retries(err error) bool {
+	if p.classes == nil {
+		return idevice.IsRetryable(err)
+	}
+
+	return p.classes[retryClass(err)]
+}
+
+// delay returns how long to wait before the next attempt after a number of failed attempts
+func (p *retryPolicy) delay(attempts int) time.Duration {
+	d := float64(p.initialDelay)
+	for i := 1; i < attempts; i++ {
+		d *= p.multiplier
+		if d >= float64(p.maxDelay) {
+			return p.maxDelay
+		}
+	}
+
+	return time.Duration(d)
+}
+
+// retryClass returns the class of a transient failure, or "" if err is not transient
+func retryClass(err error) string {
+	switch {
+	case errors.Is(err, idevice.ErrDeviceNotFound), errors.Is(err, idevice.ErrTransportLost):
+		return retryDisconnected
+	case errors.Is(err, idevice.ErrBackupInProgress):
+		return retryBusy
+	case errors.Is(err, idevice.ErrPasscodeLocked):
+		return retryLocked
+	case errors.Is(err, context.DeadlineExceeded):
+		return retryTimeout
+	}
+
+	return ""
+}
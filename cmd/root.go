@@ -22,6 +22,11 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	logging "github.com/ipfs/go-log"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/spf13/cobra"
@@ -30,6 +35,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/codynhat/ipfs-ios-backup/api"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
 	"google.golang.org/grpc"
 )
 
@@ -40,6 +46,7 @@ var (
 	threadsAddr ma.Multiaddr
 	ipfsAddr    ma.Multiaddr
 	log         = logging.Logger("ipfs-ios-backup")
+	provider    = idevice.NewProvider()
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -80,14 +87,8 @@ var rootCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		if viper.GetBool("debug") {
-			if err := logging.SetLogLevel("ipfs-ios-backup", "debug"); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if err := logging.SetLogLevel("ipfs-ios-backup", "info"); err != nil {
-				log.Fatal(err)
-			}
+		if err := setLogLevel(viper.GetBool("debug")); err != nil {
+			log.Fatal(err)
 		}
 	},
 	PersistentPostRun: func(c *cobra.Command, args []string) {
@@ -107,6 +108,34 @@ func Execute() {
 	}
 }
 
+// setLogLevel logs debug messages if debug is true
+func setLogLevel(debug bool) error {
+	if debug {
+		return logging.SetLogLevel("ipfs-ios-backup", "debug")
+	}
+
+	return logging.SetLogLevel("ipfs-ios-backup", "info")
+}
+
+// contextWithInterrupt returns a context that is cancelled when the process is interrupted
+func contextWithInterrupt() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(c)
+
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -0,0 +1,702 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/api"
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/codynhat/ipfs-ios-backup/cron"
+	"github.com/codynhat/ipfs-ios-backup/idevice"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How often schedules are checked for overdue backups, in addition to when devices are connected
+	scheduleCheckInterval = 10 * time.Minute
+	// Minimum time between attempts of a schedule, so a device that keeps reconnecting is not tried over and over
+	minAttemptInterval = 5 * time.Minute
+)
+
+// schedule is a backup schedule of a device from the config
+type schedule struct {
+	name             string
+	deviceID         idevice.DeviceID
+	period           time.Duration
+	cron             *cron.Schedule
+	windows          []window
+	location         *time.Location
+	minBatteryLevel  int
+	onlyWhenCharging bool
+	retention        *pb.RetentionPolicy
+	maxDuration      time.Duration
+	retry            *retryPolicy
+	// settings are the settings of the schedule in the config, to find schedules that changed when it is reloaded
+	settings map[string]interface{}
+
+	lock sync.Mutex
+	// attempts is the number of failed attempts since the last successful or skipped run
+	attempts int
+	// nextAttempt is the earliest time the schedule is attempted again
+	nextAttempt time.Time
+}
+
+// runResult is how a run of a schedule ended
+type runResult struct {
+	outcome   api.RunOutcome
+	reason    string
+	backupCid string
+	// err is the error a failed or cancelled run ended with
+	err error
+}
+
+// scheduler runs the backup of a schedule once its period has passed since the last successful backup of its device
+// and the device is connected. Devices are backed up as soon as they are connected over USB or found on WiFi
+type scheduler struct {
+	ctx     context.Context
+	service *api.Service
+	// reconcileLock makes sure schedules are reconciled one at a time
+	reconcileLock sync.Mutex
+
+	lock      sync.Mutex
+	schedules map[string]*schedule
+	// running are the devices being backed up by a schedule
+	running map[idevice.DeviceID]bool
+}
+
+func newScheduler(ctx context.Context, service *api.Service) (*scheduler, error) {
+	s := &scheduler{
+		ctx:       ctx,
+		service:   service,
+		schedules: map[string]*schedule{},
+		running:   map[idevice.DeviceID]bool{},
+	}
+
+	if _, err := s.reconcile(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// scheduleChanges are the names of the schedules that were added, updated and removed by reconcile
+type scheduleChanges struct {
+	added, updated, removed []string
+}
+
+// reconcile updates the schedules to match the config file and the schedules created through the API.
+// Schedules that did not change keep their state, and backups that are running are not interrupted when their
+// schedule is updated or removed. Nothing changes if any schedule in the config file is invalid
+func (s *scheduler) reconcile() (*scheduleChanges, error) {
+	s.reconcileLock.Lock()
+	defer s.reconcileLock.Unlock()
+
+	schedules := map[string]*schedule{}
+	if config := viper.Sub("schedules"); config != nil {
+		for name := range config.AllSettings() {
+			sch, err := scheduleFromConfig(name, config.Sub(name))
+			if err != nil {
+				return nil, err
+			}
+			schedules[name] = sch
+		}
+	}
+
+	// Nodes without the metadata key can not read the schedules created through the API
+	stored, err := s.service.StoredSchedules()
+	if err != nil && err != api.ErrNoMetadataKey {
+		return nil, fmt.Errorf("Failed to read schedules: %s", err)
+	}
+
+	for _, v := range stored {
+		name := v.Name
+		if _, ok := schedules[name]; ok {
+			log.Warnf("Schedule %s is both in the config file and created through the API. Using the config file", name)
+			continue
+		}
+
+		// Schedules are validated when they are created, but may have been created by a newer version on another node
+		sch, err := scheduleFromConfig(name, settingsToConfig(v.Settings))
+		if err != nil {
+			log.Errorf("Skipping invalid schedule: %s", err)
+			continue
+		}
+		schedules[name] = sch
+	}
+
+	s.lock.Lock()
+	current := s.schedules
+	s.lock.Unlock()
+
+	changes := &scheduleChanges{}
+	for name, sch := range schedules {
+		old, ok := current[name]
+		switch {
+		case !ok:
+			s.restoreRuns(sch)
+			changes.added = append(changes.added, name)
+			log.Infof("Scheduled backup for device %s (%v)", sch.deviceID, sch.settings)
+		case reflect.DeepEqual(old.settings, sch.settings):
+			schedules[name] = old
+		default:
+			old.lock.Lock()
+			sch.attempts, sch.nextAttempt = old.attempts, old.nextAttempt
+			old.lock.Unlock()
+
+			changes.updated = append(changes.updated, name)
+			log.Infof("Updated schedule %s for device %s (%v)", name, sch.deviceID, sch.settings)
+		}
+	}
+
+	for name, old := range current {
+		if _, ok := schedules[name]; !ok {
+			changes.removed = append(changes.removed, name)
+			log.Infof("Removed schedule %s for device %s", name, old.deviceID)
+		}
+	}
+
+	s.lock.Lock()
+	s.schedules = schedules
+	s.lock.Unlock()
+
+	sort.Strings(changes.added)
+	sort.Strings(changes.updated)
+	sort.Strings(changes.removed)
+
+	return changes, nil
+}
+
+// active returns the current schedules
+func (s *scheduler) active() []*schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var schedules []*schedule
+	for _, sch := range s.schedules {
+		schedules = append(schedules, sch)
+	}
+
+	return schedules
+}
+
+// ValidateSchedule returns an error if the settings of a schedule are invalid
+func (s *scheduler) ValidateSchedule(name string, settings map[string]interface{}) error {
+	_, err := scheduleFromConfig(name, settingsToConfig(settings))
+	return err
+}
+
+// ConfigSchedules returns the settings of the schedules in the config file by name
+func (s *scheduler) ConfigSchedules() map[string]map[string]interface{} {
+	schedules := map[string]map[string]interface{}{}
+
+	config := viper.Sub("schedules")
+	if config == nil {
+		return schedules
+	}
+
+	for name := range config.AllSettings() {
+		schedules[name] = config.Sub(name).AllSettings()
+	}
+
+	return schedules
+}
+
+// ReloadSchedules applies changes to the schedules created through the API
+func (s *scheduler) ReloadSchedules() error {
+	if _, err := s.reconcile(); err != nil {
+		return err
+	}
+
+	s.checkAll()
+	return nil
+}
+
+// TriggerSchedule starts a backup of a schedule now, even if it is not due yet or outside its windows.
+// The battery conditions of the schedule still apply
+func (s *scheduler) TriggerSchedule(ctx context.Context, name string) (*api.Run, error) {
+	sch := s.current(name)
+	if sch == nil {
+		return nil, status.Errorf(codes.NotFound, "Schedule %s not found", name)
+	}
+
+	if !isConnected(sch.deviceID) {
+		return nil, &idevice.Error{Op: "perform backup", DeviceID: sch.deviceID, Err: idevice.ErrDeviceNotFound}
+	}
+
+	if !s.startRunning(sch.deviceID) {
+		return nil, &idevice.Error{Op: "perform backup", DeviceID: sch.deviceID, Err: idevice.ErrBackupInProgress}
+	}
+
+	run, err := s.service.StartRun(ctx, sch.name, sch.deviceID)
+	if err != nil {
+		s.stopRunning(sch.deviceID)
+		return nil, fmt.Errorf("Failed to record run of schedule %s: %s", sch.name, err)
+	}
+
+	log.Infof("Backup of device %s triggered through the API", sch.deviceID)
+	go func() {
+		defer s.stopRunning(sch.deviceID)
+		s.run(sch, run)
+	}()
+
+	return run, nil
+}
+
+// settingsToConfig reads the settings of a schedule created through the API like a schedule in the config file
+func settingsToConfig(settings map[string]interface{}) *viper.Viper {
+	config := viper.New()
+	for k, v := range settings {
+		config.Set(k, v)
+	}
+
+	return config
+}
+
+// startRunning marks a device as being backed up by a schedule. It returns false if it already is
+func (s *scheduler) startRunning(deviceID idevice.DeviceID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.running[deviceID] {
+		return false
+	}
+	s.running[deviceID] = true
+
+	return true
+}
+
+func (s *scheduler) stopRunning(deviceID idevice.DeviceID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.running, deviceID)
+}
+
+// current returns the schedule with a name, or nil if there is none
+func (s *scheduler) current(name string) *schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.schedules[name]
+}
+
+// restoreRuns continues a schedule from its runs before the daemon was restarted, so it is not attempted
+// again before its next attempt is due. A run that was still running when the daemon stopped is recorded as cancelled
+func (s *scheduler) restoreRuns(sch *schedule) {
+	runs, err := s.service.NodeRuns(s.ctx, sch.name)
+	if err != nil {
+		log.Errorf("failed to find runs of schedule %s: %s", sch.name, err)
+		return
+	}
+
+	if len(runs) == 0 {
+		return
+	}
+
+	if runs[0].Outcome == api.RunRunning {
+		if err := s.service.FinishRun(runs[0], api.RunCancelled, "Daemon stopped", ""); err != nil {
+			log.Errorf("failed to record run of schedule %s: %s", sch.name, err)
+		}
+	}
+
+	// Replay the failed runs since the last successful or skipped run. Why they failed is not recorded,
+	// so they are assumed to be retryable
+	last := len(runs) - 1
+	for i, run := range runs {
+		if run.Outcome != api.RunFailed && run.Outcome != api.RunCancelled {
+			last = i
+			break
+		}
+	}
+
+	for i := last; i >= 0; i-- {
+		sch.afterRun(runs[i].Outcome, runs[i].EndedAt, true)
+	}
+}
+
+// scheduleFromConfig reads a schedule from the config
+func scheduleFromConfig(name string, config *viper.Viper) (*schedule, error) {
+	sch := &schedule{
+		name:        name,
+		deviceID:    idevice.DeviceID(config.GetString("deviceID")),
+		period:      time.Duration(config.GetUint64("periodInHours")) * time.Hour,
+		location:    time.Local,
+		retention:   retentionPolicyFromConfig(config.Sub("retention")),
+		maxDuration: time.Duration(config.GetInt64("maxDurationMinutes")) * time.Minute,
+		settings:    config.AllSettings(),
+	}
+
+	if sch.deviceID == "" {
+		return nil, fmt.Errorf("Schedule %s needs a deviceID", name)
+	}
+
+	if config.IsSet("onlyWhenCharging") {
+		sch.onlyWhenCharging = config.GetBool("onlyWhenCharging")
+	} else {
+		sch.minBatteryLevel = config.GetInt("minBatteryLevel")
+	}
+
+	retry, err := retryPolicyFromConfig(config.Sub("retry"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry of schedule %s: %s", name, err)
+	}
+	sch.retry = retry
+
+	if config.IsSet("timeZone") {
+		location, err := time.LoadLocation(config.GetString("timeZone"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timeZone of schedule %s: %s", name, err)
+		}
+		sch.location = location
+	}
+
+	if config.IsSet("cron") {
+		c, err := cron.Parse(config.GetString("cron"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron of schedule %s: %s", name, err)
+		}
+		if c.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("Invalid cron of schedule %s: %q never matches", name, config.GetString("cron"))
+		}
+		sch.cron = c
+	} else if sch.period <= 0 {
+		return nil, fmt.Errorf("Schedule %s needs either periodInHours or cron", name)
+	}
+
+	var windows []windowConfig
+	if err := config.UnmarshalKey("windows", &windows); err != nil {
+		return nil, fmt.Errorf("Invalid windows of schedule %s: %s", name, err)
+	}
+
+	for _, v := range windows {
+		w, err := windowFromConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid windows of schedule %s: %s", name, err)
+		}
+		sch.windows = append(sch.windows, w)
+	}
+
+	return sch, nil
+}
+
+// nextBackup returns when the next backup is due after the last successful backup, ignoring windows.
+// A cron expression is due at its first time after the last backup. A device that was never backed up is due immediately
+func (sch *schedule) nextBackup(lastBackup time.Time) time.Time {
+	if lastBackup.IsZero() {
+		return lastBackup
+	}
+
+	if sch.cron != nil {
+		return sch.cron.Next(lastBackup.In(sch.location))
+	}
+
+	return lastBackup.Add(sch.period)
+}
+
+// dueAt returns the earliest time at or after now that a backup can run, given the last successful backup
+func (sch *schedule) dueAt(lastBackup time.Time, now time.Time) time.Time {
+	due := sch.nextBackup(lastBackup)
+	if due.Before(now) {
+		due = now
+	}
+
+	return nextInWindows(sch.windows, due.In(sch.location))
+}
+
+// afterRun updates when a schedule is attempted next after a run that ended at ended. A failed run is retried
+// using the retry policy of the schedule. It returns how long until the run is retried, or 0 if it is not retried
+// before the next backup is due or the device is next connected
+func (sch *schedule) afterRun(outcome api.RunOutcome, ended time.Time, retryable bool) time.Duration {
+	switch outcome {
+	case api.RunSucceeded:
+		sch.attempts = 0
+		sch.nextAttempt = time.Time{}
+		return 0
+	case api.RunSkipped:
+		// Skipped runs, e.g. because the battery was too low, are tried again when the device is next connected
+		sch.attempts = 0
+		sch.nextAttempt = ended.Add(minAttemptInterval)
+		return 0
+	}
+
+	sch.attempts++
+	if !retryable || (sch.retry.maxAttempts > 0 && sch.attempts >= sch.retry.maxAttempts) {
+		// Give up until the next backup would be due
+		sch.attempts = 0
+		sch.nextAttempt = sch.nextBackup(ended)
+		return 0
+	}
+
+	delay := sch.retry.delay(sch.attempts)
+	sch.nextAttempt = ended.Add(delay)
+	return delay
+}
+
+// start checks the schedules when devices are connected and every scheduleCheckInterval until the context is done
+func (s *scheduler) start() {
+	events, err := provider.SubscribeDeviceEvents(s.ctx)
+	if err != nil {
+		log.Warnf("Failed to watch for devices, schedules will be checked every %v: %s", scheduleCheckInterval, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(scheduleCheckInterval)
+		defer ticker.Stop()
+
+		s.checkAll()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkAll()
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+
+				if event.Type != idevice.DeviceAdded {
+					continue
+				}
+
+				log.Debugf("Device %s connected", event.Device.Udid)
+				for _, sch := range s.active() {
+					if sch.deviceID == event.Device.Udid {
+						go s.runIfOverdue(sch)
+					}
+				}
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *scheduler) checkAll() {
+	for _, sch := range s.active() {
+		go s.runIfOverdue(sch)
+	}
+}
+
+// runIfOverdue runs the backup of a schedule if its period has passed since the last successful backup of its device
+// and the device is connected
+func (s *scheduler) runIfOverdue(sch *schedule) {
+	// Schedules that were updated or removed are not run again
+	if s.ctx.Err() != nil || s.current(sch.name) != sch {
+		return
+	}
+
+	// Only one schedule backs up a device at a time, including a schedule that was updated while it was running
+	if !s.startRunning(sch.deviceID) {
+		return
+	}
+	defer s.stopRunning(sch.deviceID)
+
+	sch.lock.Lock()
+	if time.Now().Before(sch.nextAttempt) {
+		sch.lock.Unlock()
+		return
+	}
+
+	lastBackup, err := s.service.LastBackupTime(sch.deviceID)
+	if err != nil {
+		sch.lock.Unlock()
+		log.Errorf("failed to find last backup of device %s: %s", sch.deviceID, err)
+		return
+	}
+
+	now := time.Now()
+	if now.Before(sch.nextBackup(lastBackup)) {
+		sch.lock.Unlock()
+		return
+	}
+
+	if !inWindows(sch.windows, now.In(sch.location)) {
+		sch.lock.Unlock()
+		log.Debugf("Backup of device %s is overdue. Waiting until %v", sch.deviceID, sch.dueAt(lastBackup, now))
+		return
+	}
+
+	if !isConnected(sch.deviceID) {
+		sch.lock.Unlock()
+		log.Debugf("Backup of device %s is overdue. Waiting for it to connect", sch.deviceID)
+		return
+	}
+
+	sch.lock.Unlock()
+
+	if lastBackup.IsZero() {
+		log.Infof("Device %s has never been backed up", sch.deviceID)
+	} else {
+		log.Infof("Last backup of device %s was at %v", sch.deviceID, lastBackup.Local())
+	}
+
+	run, err := s.service.StartRun(s.ctx, sch.name, sch.deviceID)
+	if err != nil {
+		log.Errorf("failed to record run of schedule %s: %s", sch.name, err)
+		return
+	}
+
+	s.run(sch, run)
+}
+
+// run backs up the device of a schedule and records how the run ended. A failed run is retried
+// using the retry policy of the schedule
+func (s *scheduler) run(sch *schedule, run *api.Run) {
+	result := runScheduledBackup(s.ctx, s.service, sch)
+	if err := s.service.FinishRun(run, result.outcome, result.reason, result.backupCid); err != nil {
+		log.Errorf("failed to record run of schedule %s: %s", sch.name, err)
+	}
+
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	sch.lock.Lock()
+	delay := sch.afterRun(result.outcome, run.EndedAt, sch.retry.retries(result.err))
+	attempts, nextAttempt := sch.attempts, sch.nextAttempt
+	sch.lock.Unlock()
+
+	// Continue with the schedule that replaced this one if it was updated while it was running
+	if current := s.current(sch.name); current != sch {
+		if current == nil {
+			return
+		}
+
+		current.lock.Lock()
+		current.attempts, current.nextAttempt = attempts, nextAttempt
+		current.lock.Unlock()
+		sch = current
+	}
+
+	switch {
+	case delay > 0:
+		log.Infof("Retrying backup of device %s in %v (attempt %d)", sch.deviceID, delay, attempts+1)
+		time.AfterFunc(delay, func() {
+			s.runIfOverdue(sch)
+		})
+	case result.outcome == api.RunFailed || result.outcome == api.RunCancelled:
+		log.Warnf("Giving up on backup of device %s until %v", sch.deviceID, nextAttempt.In(sch.location))
+	}
+}
+
+// isConnected returns true if a device is connected over USB or WiFi
+func isConnected(deviceID idevice.DeviceID) bool {
+	devices, err := provider.GetDevices()
+	if err != nil {
+		log.Errorf("failed to list devices: %s", err)
+		return false
+	}
+
+	for _, v := range devices {
+		if v.Udid == deviceID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runScheduledBackup backs up the device of a schedule and enforces its retention policy
+func runScheduledBackup(ctx context.Context, service *api.Service, sch *schedule) runResult {
+	deviceID := sch.deviceID
+	log.Infof("Backup triggered for device %s", deviceID)
+	log.Infof("onlyWhenCharging is %v", sch.onlyWhenCharging)
+
+	log.Infof("Checking if device is on charger")
+
+	isCharging, err := provider.GetDeviceBatteryIsCharging(deviceID)
+	if err != nil {
+		log.Errorf("failed to check if device is charging: %s", err)
+		return runResult{outcome: api.RunFailed, reason: fmt.Sprintf("Failed to check if device is charging: %s", err), err: err}
+	}
+
+	if !isCharging {
+		if sch.onlyWhenCharging {
+			log.Infof("Device is not on charger. Skipping backup.")
+			return runResult{outcome: api.RunSkipped, reason: "Device is not on charger"}
+		}
+
+		log.Infof("Checking if battery level >= %v%%", sch.minBatteryLevel)
+
+		currentBatteryLevel, err := provider.GetDeviceBatteryCurrentCapacity(deviceID)
+		if err != nil {
+			log.Errorf("failed to check device battery level: %s", err)
+			return runResult{outcome: api.RunFailed, reason: fmt.Sprintf("Failed to check device battery level: %s", err), err: err}
+		}
+
+		if int(currentBatteryLevel) < sch.minBatteryLevel {
+			log.Warnf("Device is not charged enough (%v%% < %v%%). Skipping backup.", currentBatteryLevel, sch.minBatteryLevel)
+			return runResult{outcome: api.RunSkipped, reason: fmt.Sprintf("battery %v%% < %v%%", currentBatteryLevel, sch.minBatteryLevel)}
+		}
+	}
+
+	backupCtx := ctx
+	if sch.maxDuration > 0 {
+		var cancel context.CancelFunc
+		backupCtx, cancel = context.WithTimeout(ctx, sch.maxDuration)
+		defer cancel()
+	}
+
+	log.Infof("Performing backup for device %s", deviceID)
+	snapshot, err := service.RunBackup(backupCtx, deviceID, backupEventLogger(deviceID))
+	if err != nil && backupCtx.Err() == context.DeadlineExceeded {
+		log.Errorf("Backup did not finish within %v. Cancelled backup.", sch.maxDuration)
+		return runResult{outcome: api.RunCancelled, reason: fmt.Sprintf("Backup did not finish within %v", sch.maxDuration), err: context.DeadlineExceeded}
+	}
+	if err != nil && ctx.Err() != nil {
+		return runResult{outcome: api.RunCancelled, reason: "Daemon stopped", err: err}
+	}
+	if err != nil {
+		log.Error(err)
+		return runResult{outcome: api.RunFailed, reason: err.Error(), err: err}
+	}
+	log.Infof("Latest backup cid saved (%s)", snapshot.BackupCid)
+
+	if sch.retention == nil {
+		return runResult{outcome: api.RunSucceeded, backupCid: snapshot.BackupCid}
+	}
+
+	// Enforce retention policy. The backup itself succeeded even if pruning fails
+	log.Infof("Pruning backups for device %s", deviceID)
+	reply, err := service.PruneBackups(ctx, &pb.PruneBackupsRequest{
+		DeviceID: string(deviceID),
+		Policy:   sch.retention,
+	})
+	if err != nil {
+		log.Errorf("failed to prune backups: %s", err)
+		return runResult{outcome: api.RunSucceeded, reason: fmt.Sprintf("Failed to prune backups: %s", err), backupCid: snapshot.BackupCid}
+	}
+
+	for _, v := range reply.Snapshots {
+		log.Infof("Pruned backup %s (%s)", v.Id, v.BackupCid)
+	}
+
+	return runResult{outcome: api.RunSucceeded, backupCid: snapshot.BackupCid}
+}
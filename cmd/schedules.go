@@ -0,0 +1,330 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/api"
+	pb "github.com/codynhat/ipfs-ios-backup/api/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statusRuns uint32
+	// Settings of a schedule created with schedules add
+	addSchedule      = &pb.Schedule{Retention: &pb.RetentionPolicy{}, Retry: &pb.RetryPolicy{}}
+	addWindows       []string
+	addDays          []string
+	addReplace       bool
+	addRetryAttempts uint32
+)
+
+var schedulesCmd = &cobra.Command{
+	Use:   "schedules [command]",
+	Short: "Interact with backup schedules",
+	Long:  "Interact with backup schedules",
+}
+
+var schedulesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List schedules",
+	Long:  "List the schedules in the config file and the schedules created with schedules add",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		reply, err := client.ListSchedules(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get schedules: %s\n", err)
+		}
+
+		if len(reply.Schedules) == 0 {
+			fmt.Println("No schedules found.")
+			return
+		}
+
+		for _, v := range reply.Schedules {
+			printSchedule(v)
+		}
+	},
+}
+
+var schedulesAddCmd = &cobra.Command{
+	Use:   "add [name] [device-id]",
+	Short: "Add a schedule",
+	Long:  "Add a schedule that every node in the thread runs. Use --replace to change an existing schedule",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sch := addSchedule
+		sch.Name = args[0]
+		sch.DeviceID = args[1]
+
+		for _, v := range addWindows {
+			bounds := strings.SplitN(v, "-", 2)
+			if len(bounds) != 2 {
+				log.Fatalf("Invalid window %q, expected HH:MM-HH:MM", v)
+			}
+			sch.Windows = append(sch.Windows, &pb.ScheduleWindow{Start: bounds[0], End: bounds[1], Days: addDays})
+		}
+		if len(addDays) > 0 && len(sch.Windows) == 0 {
+			sch.Windows = append(sch.Windows, &pb.ScheduleWindow{Start: "00:00", End: "23:59", Days: addDays})
+		}
+
+		if proto.Equal(sch.Retention, &pb.RetentionPolicy{}) {
+			sch.Retention = nil
+		}
+
+		if !cmd.Flags().Changed("retry-attempts") && len(sch.Retry.On) == 0 {
+			sch.Retry = nil
+		} else {
+			sch.Retry.MaxAttempts = addRetryAttempts
+		}
+
+		var schedule *pb.Schedule
+		if addReplace {
+			reply, err := client.UpdateSchedule(ctx, sch)
+			if err != nil {
+				log.Fatalf("Failed to update schedule: %s\n", err)
+			}
+			schedule = reply.Schedule
+			fmt.Println("Schedule updated.")
+		} else {
+			reply, err := client.CreateSchedule(ctx, sch)
+			if err != nil {
+				log.Fatalf("Failed to add schedule: %s\n", err)
+			}
+			schedule = reply.Schedule
+			fmt.Println("Schedule added.")
+		}
+
+		printSchedule(schedule)
+	},
+}
+
+var schedulesRmCmd = &cobra.Command{
+	Use:   "rm [name]",
+	Short: "Remove a schedule",
+	Long:  "Remove a schedule created with schedules add. A backup it is running is not interrupted",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if _, err := client.DeleteSchedule(ctx, args[0]); err != nil {
+			log.Fatalf("Failed to remove schedule: %s\n", err)
+		}
+
+		fmt.Printf("Schedule %s removed.\n", args[0])
+	},
+}
+
+var schedulesRunNowCmd = &cobra.Command{
+	Use:   "run-now [name]",
+	Short: "Run a schedule now",
+	Long:  "Back up the device of a schedule now, even if it is not due yet or outside its windows. The battery conditions of the schedule still apply. Use schedules status to see how the run ended",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		reply, err := client.TriggerSchedule(ctx, args[0])
+		if err != nil {
+			log.Fatalf("Failed to run schedule: %s\n", err)
+		}
+
+		fmt.Printf("Backup of %s started (run %s).\n", reply.Run.DeviceID, reply.Run.Id)
+	},
+}
+
+var schedulesStatusCmd = &cobra.Command{
+	Use:   "status [schedule]",
+	Short: "Show the status and recent runs of schedules",
+	Long:  "Show when schedules last backed up their device, when the next backup is due and their recent runs, including skipped and failed runs",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		schedules, err := client.ListSchedules(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get schedules: %s\n", err)
+		}
+
+		var found bool
+		for _, v := range schedules.Schedules {
+			if len(args) > 0 && args[0] != v.Name {
+				continue
+			}
+			found = true
+
+			settings, err := api.ScheduleSettings(v)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			sch, err := scheduleFromConfig(v.Name, settingsToConfig(settings))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			printSchedule(v)
+
+			history, err := client.ListBackupHistory(ctx, string(sch.deviceID))
+			if err != nil {
+				log.Fatalf("Failed to get backup history: %s\n", err)
+			}
+
+			var lastBackup time.Time
+			if len(history.Snapshots) == 0 {
+				fmt.Println("\tLast Backup At: never")
+			} else {
+				if lastBackup, err = ptypes.Timestamp(history.Snapshots[0].CreatedAt); err != nil {
+					log.Fatal(err)
+				}
+				fmt.Printf("\tLast Backup At: %v (%s)\n", lastBackup.In(sch.location), history.Snapshots[0].BackupCid)
+			}
+
+			now := time.Now()
+			if due := sch.dueAt(lastBackup, now); due.After(now) {
+				fmt.Printf("\tNext Backup Due: %v\n", due)
+			} else {
+				fmt.Println("\tNext Backup Due: now")
+			}
+
+			reply, err := client.ListRuns(ctx, "", v.Name, statusRuns)
+			if err != nil {
+				log.Fatalf("Failed to get runs: %s\n", err)
+			}
+
+			if len(reply.Runs) == 0 {
+				fmt.Println("\tNo runs yet.")
+				continue
+			}
+
+			fmt.Println("\tRecent Runs:")
+			for _, v := range reply.Runs {
+				fmt.Printf("\t  %s\n", runDetail(v))
+			}
+		}
+
+		if !found {
+			if len(args) > 0 {
+				log.Fatalf("Schedule %s not found", args[0])
+			}
+			fmt.Println("No schedules found.")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schedulesCmd)
+	schedulesCmd.AddCommand(schedulesListCmd)
+	schedulesCmd.AddCommand(schedulesAddCmd)
+	schedulesCmd.AddCommand(schedulesRmCmd)
+	schedulesCmd.AddCommand(schedulesRunNowCmd)
+	schedulesCmd.AddCommand(schedulesStatusCmd)
+
+	schedulesStatusCmd.Flags().Uint32VarP(&statusRuns, "runs", "n", 5, "Number of recent runs to show for each schedule (0 shows all runs)")
+
+	flags := schedulesAddCmd.Flags()
+	flags.Uint64Var(&addSchedule.PeriodInHours, "period", 0, "Hours after a successful backup before the next one")
+	flags.StringVar(&addSchedule.Cron, "cron", "", "Cron expression for when backups are due, instead of --period")
+	flags.StringVar(&addSchedule.TimeZone, "time-zone", "", "Time zone of --cron and --window, e.g. Europe/Berlin (default is local time)")
+	flags.StringSliceVar(&addWindows, "window", nil, "Time of day backups are allowed in, e.g. 01:00-06:00. Can be repeated")
+	flags.StringSliceVar(&addDays, "days", nil, "Days backups are allowed on, e.g. weekdays or mon,wed,fri")
+	flags.Uint32Var(&addSchedule.MinBatteryLevel, "min-battery", 0, "Minimum battery level to back up a device that is not charging")
+	flags.BoolVar(&addSchedule.OnlyWhenCharging, "only-when-charging", false, "Only back up a device while it is charging")
+	flags.Uint64Var(&addSchedule.MaxDurationMinutes, "max-duration", 0, "Cancel a backup that has not finished after this many minutes")
+	flags.Uint32Var(&addSchedule.Retention.KeepLast, "keep-last", 0, "Keep the most recent N backups")
+	flags.Uint32Var(&addSchedule.Retention.KeepDaily, "keep-daily", 0, "Keep the most recent backup of each of the last N days")
+	flags.Uint32Var(&addSchedule.Retention.KeepWeekly, "keep-weekly", 0, "Keep the most recent backup of each of the last N weeks")
+	flags.Uint32Var(&addSchedule.Retention.KeepMonthly, "keep-monthly", 0, "Keep the most recent backup of each of the last N months")
+	flags.Uint32Var(&addSchedule.Retention.MaxAgeInDays, "max-age", 0, "Prune backups older than N days")
+	flags.Uint32Var(&addRetryAttempts, "retry-attempts", 3, "Attempts before giving up until the next backup is due")
+	flags.StringSliceVar(&addSchedule.Retry.On, "retry-on", nil, "Failures to retry: disconnected, busy, locked or timeout")
+	flags.BoolVar(&addReplace, "replace", false, "Replace the settings of an existing schedule")
+}
+
+// printSchedule describes when a schedule backs up its device
+func printSchedule(sch *pb.Schedule) {
+	when := fmt.Sprintf("every %v hours", sch.PeriodInHours)
+	if sch.Cron != "" {
+		when = fmt.Sprintf("cron %q", sch.Cron)
+	}
+
+	var windows []string
+	for _, w := range sch.Windows {
+		window := w.Start + "-" + w.End
+		if len(w.Days) > 0 {
+			window += " " + strings.Join(w.Days, ",")
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) > 0 {
+		when += " within " + strings.Join(windows, ", ")
+	}
+	if sch.TimeZone != "" {
+		when += " (" + sch.TimeZone + ")"
+	}
+
+	source := "API"
+	if sch.ReadOnly {
+		source = "config file"
+	}
+
+	fmt.Printf("%s (device: %s, %s, from %s)\n", sch.Name, sch.DeviceID, when, source)
+}
+
+// runDetail describes when a run started, how long it took and how it ended
+func runDetail(run *pb.Run) string {
+	startedAt, err := ptypes.Timestamp(run.StartedAt)
+	if err != nil {
+		return err.Error()
+	}
+
+	detail := []string{startedAt.Local().Format(time.RFC3339), strings.ToLower(run.Outcome.String())}
+	if run.EndedAt != nil {
+		endedAt, err := ptypes.Timestamp(run.EndedAt)
+		if err == nil {
+			detail = append(detail, fmt.Sprintf("after %v", endedAt.Sub(startedAt).Round(time.Second)))
+		}
+	}
+
+	s := strings.Join(detail, " ")
+	if run.Reason != "" {
+		s += ": " + run.Reason
+	}
+	if run.BackupCid != "" {
+		s += " -> " + run.BackupCid
+	}
+
+	return s
+}
@@ -0,0 +1,638 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/codynhat/ipfs-ios-backup/api"
+	"github.com/codynhat/ipfs-ios-backup/invite"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/textileio/go-threads/common"
+	"github.com/textileio/go-threads/core/thread"
+	"github.com/textileio/go-threads/db"
+)
+
+const (
+	// Secrets received from another node or imported, applied when the daemon starts
+	pendingSecretsFile = "secrets.pending"
+	// Where go-threads keeps the DB of a repo
+	threadsDatastorePath = "eventstore"
+)
+
+var (
+	rotateExportPath string
+	rotateRevoke     string
+)
+
+// trustedNode is another node of the thread, that rotated secrets are sent to and accepted from
+type trustedNode struct {
+	name        string
+	info        peer.AddrInfo
+	storageOnly bool
+}
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage the secrets shared by the nodes of the thread",
+	Long:  "Manage the secrets shared by the nodes of the thread",
+}
+
+var secretsRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotate the secrets of the thread to remove a node",
+	Long:  "Move backups to a new thread and private network with new secrets, and send the secrets to the nodes in trustedNodes. Other nodes can not join the new thread. The daemon must be stopped",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
+		repoPath := viper.GetString("repoPath")
+
+		locked, err := fsrepo.LockedByOtherProcess(filepath.Join(repoPath, ".ipfs"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if locked {
+			log.Fatal("Stop the daemon before rotating secrets")
+		}
+
+		nodes, err := trustedNodesFromConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		revoked, err := revokedNode(nodes, rotateRevoke)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// The revoked node could otherwise still announce secrets this node accepts
+		if err := removeTrustedNode(revoked); err != nil {
+			log.Fatalf("Failed to remove %s from trustedNodes: %s", rotateRevoke, err)
+		}
+
+		metadataKey, err := loadMetadataKey(repoPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if metadataKey == nil {
+			log.Fatal("This node is storage only and can not rotate secrets")
+		}
+
+		threadID, err := thread.Decode(viper.GetString("threadID"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		threadsBootstrapAddrs, err := bootstrapAddrsFromConfig("threadsBootstrapList")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d, threadsNet, clean, err := loadBackupDB(repoPath, threadID, viper.GetBool("debug"), threadsBootstrapAddrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer threadsNet.Close()
+		defer clean()
+
+		e, err := rotateSecrets(ctx, repoPath, threadID, d, threadsNet, metadataKey)
+		if err != nil {
+			log.Fatalf("Failed to rotate secrets: %s", err)
+		}
+
+		fmt.Printf("Moved backups to thread %s with new secrets\n", viper.GetString("threadID"))
+
+		// Trusted nodes that receive the secrets stop trusting the revoked node too
+		e.Revoked = revoked.String()
+
+		// The new thread is served by this node, so trusted nodes can join it as soon as they have the secrets
+		failed := 0
+		for _, node := range nodes {
+			if node.info.ID == revoked {
+				continue
+			}
+
+			nodeExport := *e
+			if node.storageOnly {
+				nodeExport.MetadataKey = ""
+				nodeExport.StorageOnly = true
+			}
+
+			payload, err := json.Marshal(&nodeExport)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := invite.Announce(ctx, threadsNet.Host(), node.info, payload); err != nil {
+				fmt.Printf("Could not send new secrets to %s: %s\n", node.name, err)
+				failed++
+				continue
+			}
+
+			fmt.Printf("Sent new secrets to %s\n", node.name)
+		}
+
+		if rotateExportPath != "" {
+			passphrase, err := readSecretsPassphrase(true)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			obj, err := sealSecrets(e, passphrase)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(rotateExportPath, obj, 0600); err != nil {
+				log.Fatalf("Failed to save new secrets: %s", err)
+			}
+
+			fmt.Printf("Saved new secrets to %s\n", rotateExportPath)
+		}
+
+		if failed > 0 {
+			fmt.Println("Nodes that did not receive the new secrets can import them with secrets import, from a file saved with --export or export-secrets")
+		}
+		fmt.Println("Start the daemon so trusted nodes can join the new thread")
+	},
+}
+
+var secretsMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Create the metadata key of a thread created by an older version",
+	Long:  "Create the metadata key of a thread created by an older version, and send it to the nodes in trustedNodes that are not storage only. Run it on one node only, or again to send the key to nodes that did not receive it. The daemon must be stopped",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := contextWithInterrupt()
+		defer cancel()
+
+		repoPath := viper.GetString("repoPath")
+
+		locked, err := fsrepo.LockedByOtherProcess(filepath.Join(repoPath, ".ipfs"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if locked {
+			log.Fatal("Stop the daemon before creating the metadata key")
+		}
+
+		if viper.GetBool("storageOnly") {
+			log.Fatal("This node is storage only and can not create the metadata key")
+		}
+
+		nodes, err := trustedNodesFromConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		secret, err := migrateMetadataKey(repoPath)
+		if err != nil {
+			log.Fatalf("Failed to create metadata key: %s", err)
+		}
+
+		fmt.Println("This node has the metadata key. Backups are encrypted when the daemon starts")
+
+		payload, err := json.Marshal(&export{MetadataKey: hex.EncodeToString(secret)})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		net, err := common.DefaultNetwork(repoPath, common.WithNetHostAddr(threadsAddr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer net.Close()
+
+		failed := 0
+		for _, node := range nodes {
+			if node.storageOnly {
+				continue
+			}
+
+			if err := invite.Announce(ctx, net.Host(), node.info, payload); err != nil {
+				fmt.Printf("Could not send the metadata key to %s: %s\n", node.name, err)
+				failed++
+				continue
+			}
+
+			fmt.Printf("Sent the metadata key to %s\n", node.name)
+		}
+
+		if failed > 0 {
+			fmt.Println("Run secrets migrate again while the nodes that did not receive the metadata key are running")
+		}
+	},
+}
+
+var secretsImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Switch to the thread of rotated secrets",
+	Long:  "Switch to the thread of secrets rotated by another node and exported to a file. The secrets are applied when the daemon starts",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		repoPath := viper.GetString("repoPath")
+
+		if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+			log.Fatalf("No repo at %s. Use init --secrets to create one with these secrets", repoPath)
+		}
+
+		e, err := importSecrets(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Only secrets saved by secrets rotate name the node they revoke
+		var revoked peer.ID
+		if e.Revoked != "" {
+			revoked, err = peer.Decode(e.Revoked)
+			if err != nil {
+				log.Fatalf("Invalid revoked node: %s", err)
+			}
+		}
+
+		if err := savePendingSecrets(repoPath, e); err != nil {
+			log.Fatal(err)
+		}
+
+		if revoked != "" {
+			if err := removeTrustedNode(revoked); err != nil {
+				log.Fatalf("Failed to remove %s from trustedNodes: %s", revoked, err)
+			}
+		}
+
+		fmt.Println("Saved new secrets. Start or restart the daemon to switch to the new thread")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsRotateCmd)
+	secretsCmd.AddCommand(secretsImportCmd)
+	secretsCmd.AddCommand(secretsMigrateCmd)
+
+	secretsRotateCmd.Flags().StringVar(&rotateExportPath, "export", "", "Also save the new secrets to a file, encrypted with a passphrase")
+	secretsRotateCmd.Flags().StringVar(&rotateRevoke, "revoke", "", "Peer ID, or name in trustedNodes, of the node to remove")
+	secretsRotateCmd.MarkFlagRequired("revoke")
+}
+
+// trustedNodesFromConfig reads the nodes in trustedNodes
+func trustedNodesFromConfig() ([]*trustedNode, error) {
+	var nodes []*trustedNode
+
+	config := viper.Sub("trustedNodes")
+	if config == nil {
+		return nodes, nil
+	}
+
+	for name := range config.AllSettings() {
+		node := config.Sub(name)
+		if node == nil {
+			return nil, fmt.Errorf("Invalid trusted node %s", name)
+		}
+
+		addr, err := ma.NewMultiaddr(node.GetString("addr"))
+		if err != nil {
+			return nil, fmt.Errorf("Trusted node %s needs an addr ending with its peer ID: %s", name, err)
+		}
+
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Trusted node %s needs an addr ending with its peer ID: %s", name, err)
+		}
+
+		nodes = append(nodes, &trustedNode{
+			name:        name,
+			info:        *info,
+			storageOnly: node.GetBool("storageOnly"),
+		})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].name < nodes[j].name
+	})
+
+	return nodes, nil
+}
+
+// revokedNode returns the peer ID of the node named by revoke, a peer ID or a name in trustedNodes
+func revokedNode(nodes []*trustedNode, revoke string) (peer.ID, error) {
+	for _, node := range nodes {
+		if node.name == revoke {
+			return node.info.ID, nil
+		}
+	}
+
+	id, err := peer.Decode(revoke)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a peer ID or the name of a node in trustedNodes", revoke)
+	}
+
+	return id, nil
+}
+
+// removeTrustedNode removes a node from trustedNodes and saves the config, so its announcements are refused
+func removeTrustedNode(id peer.ID) error {
+	nodes, err := trustedNodesFromConfig()
+	if err != nil {
+		return err
+	}
+
+	config := viper.GetStringMap("trustedNodes")
+	removed := false
+	for _, node := range nodes {
+		if node.info.ID == id {
+			delete(config, node.name)
+			removed = true
+		}
+	}
+
+	if !removed {
+		return nil
+	}
+
+	viper.Set("trustedNodes", config)
+
+	return viper.WriteConfig()
+}
+
+// isTrustedNode returns true if a node is in trustedNodes
+func isTrustedNode(id peer.ID) bool {
+	nodes, err := trustedNodesFromConfig()
+	if err != nil {
+		log.Warnf("Invalid trustedNodes: %s", err)
+		return false
+	}
+
+	for _, node := range nodes {
+		if node.info.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rotateSecrets copies the records of a thread to a new thread with new secrets, and switches this node to it.
+// The old thread is deleted, so it is no longer synced with nodes that still have its secrets
+func rotateSecrets(ctx context.Context, repoPath string, oldThreadID thread.ID, d *db.DB, net common.NetBoostrapper, metadataKey *api.MetadataKey) (*export, error) {
+	swarmKey, err := newSwarmKey()
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, api.MetadataKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("While trying to create metadata key: %s", err)
+	}
+
+	newMetadataKey, err := api.NewMetadataKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new thread is created next to the current one until the records are copied
+	stagingPath := filepath.Join(repoPath, "rotating")
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingPath)
+
+	threadID := thread.NewIDV1(thread.Raw, 32)
+	newD, err := db.NewDB(ctx, net, threadID, db.WithNewDBRepoPath(stagingPath), db.WithNewDBCollections(collectionConfigs()...))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create thread: %s", err)
+	}
+	defer newD.Close()
+
+	backupDir := filepath.Join(repoPath, "backups")
+	src, err := api.NewService(nil, nil, d, metadataKey, provider, backupDir, filepath.Join(repoPath, "staging"))
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := api.NewService(nil, nil, newD, newMetadataKey, provider, backupDir, filepath.Join(repoPath, "staging"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.CopyRecords(dst); err != nil {
+		return nil, fmt.Errorf("Failed to copy backups to the new thread: %s", err)
+	}
+
+	addrs, key, err := newD.GetDBInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var rawAddrs []string
+	for _, addr := range addrs {
+		rawAddrs = append(rawAddrs, addr.String())
+	}
+
+	e := &export{
+		Addrs:       rawAddrs,
+		ThreadKey:   key.String(),
+		SwarmKey:    swarmKey,
+		MetadataKey: hex.EncodeToString(secret),
+	}
+
+	// Both DBs are closed before the new one takes the place of the old one
+	if err := newD.Close(); err != nil {
+		return nil, err
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := retireThread(ctx, repoPath, net, oldThreadID); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(filepath.Join(stagingPath, threadsDatastorePath), filepath.Join(repoPath, threadsDatastorePath)); err != nil {
+		return nil, fmt.Errorf("Failed to move DB of thread %s: %s", threadID, err)
+	}
+
+	if err := switchSecrets(repoPath, threadID, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// savePendingSecrets saves secrets to switch to when the daemon starts
+func savePendingSecrets(repoPath string, e *export) error {
+	if len(e.Addrs) == 0 || e.ThreadKey == "" || e.SwarmKey == "" {
+		return errors.New("Invalid secrets")
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(repoPath, pendingSecretsFile), b, 0600); err != nil {
+		return fmt.Errorf("Failed to save new secrets: %s", err)
+	}
+
+	return nil
+}
+
+// receiveRotatedSecrets saves secrets announced by a trusted node after it rotated them, or the metadata key it
+// created for a thread created by an older version
+func receiveRotatedSecrets(repoPath string, from peer.ID, payload []byte) error {
+	e := &export{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		return errors.New("Invalid secrets")
+	}
+
+	if len(e.Addrs) == 0 && e.MetadataKey != "" {
+		return receiveMetadataKey(repoPath, from, e.MetadataKey)
+	}
+
+	revoked, err := peer.Decode(e.Revoked)
+	if err != nil {
+		return errors.New("Rotated secrets must name the node they revoke")
+	}
+
+	// The revoked node may still be trusted if it rotates the secrets first, and must not take the thread with it
+	if revoked == from {
+		return fmt.Errorf("Node %s announced secrets that revoke itself", from)
+	}
+
+	if err := savePendingSecrets(repoPath, e); err != nil {
+		return err
+	}
+
+	if err := removeTrustedNode(revoked); err != nil {
+		return fmt.Errorf("Failed to remove %s from trustedNodes: %s", revoked, err)
+	}
+
+	log.Warnf("Node %s rotated the secrets of the thread to remove node %s. Restart the daemon to switch to the new thread", from, revoked)
+
+	return nil
+}
+
+// applyPendingSecrets switches to the thread of secrets received from a trusted node or imported, if there are any
+func applyPendingSecrets(ctx context.Context, repoPath string, bootstrapAddrs []ma.Multiaddr) error {
+	b, err := ioutil.ReadFile(filepath.Join(repoPath, pendingSecretsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read new secrets: %s", err)
+	}
+
+	e := &export{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return fmt.Errorf("Invalid new secrets: %s", err)
+	}
+
+	// Storage only nodes stay storage only
+	if viper.GetBool("storageOnly") {
+		e.MetadataKey = ""
+		e.StorageOnly = true
+	}
+
+	oldThreadID, err := thread.Decode(viper.GetString("threadID"))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Switching from thread %s to the thread of the new secrets", oldThreadID)
+
+	net, err := common.DefaultNetwork(repoPath, common.WithNetHostAddr(threadsAddr))
+	if err != nil {
+		return err
+	}
+
+	err = retireThread(ctx, repoPath, net, oldThreadID)
+	net.Close()
+	if err != nil {
+		return err
+	}
+
+	threadID, clean, err := initThreadsRepo(ctx, repoPath, e, bootstrapAddrs)
+	if clean != nil {
+		clean()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not join the new thread, the node that rotated the secrets must be running: %s", err)
+	}
+
+	if err := switchSecrets(repoPath, threadID, e); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(repoPath, pendingSecretsFile))
+}
+
+// retireThread stops syncing a thread with other nodes, and moves its DB aside for a new thread
+func retireThread(ctx context.Context, repoPath string, net common.NetBoostrapper, id thread.ID) error {
+	if err := net.DeleteThread(ctx, id); err != nil {
+		log.Warnf("Failed to delete thread %s: %s", id, err)
+	}
+
+	current := filepath.Join(repoPath, threadsDatastorePath)
+	retired := filepath.Join(repoPath, threadsDatastorePath+"-"+id.String())
+
+	// A previous attempt to switch threads already moved the DB
+	if _, err := os.Stat(retired); err == nil {
+		return os.RemoveAll(current)
+	}
+
+	if err := os.Rename(current, retired); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to move DB of thread %s: %s", id, err)
+	}
+
+	return nil
+}
+
+// switchSecrets writes the keys of an export and saves the thread in the config
+func switchSecrets(repoPath string, threadID thread.ID, e *export) error {
+	if err := createSwarmKey(filepath.Join(repoPath, ".ipfs"), e); err != nil {
+		return err
+	}
+
+	if err := createMetadataKey(repoPath, e); err != nil {
+		return err
+	}
+
+	viper.Set("threadID", threadID)
+
+	return viper.WriteConfig()
+}
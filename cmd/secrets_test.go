@@ -0,0 +1,103 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/spf13/viper"
+)
+
+func TestReceiveRotatedSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	viper.SetConfigFile(filepath.Join(dir, "config.json"))
+
+	desktop := test.RandPeerIDFatal(t)
+	laptop := test.RandPeerIDFatal(t)
+	server := test.RandPeerIDFatal(t)
+
+	tests := []struct {
+		name    string
+		from    peer.ID
+		revoked string
+		wantErr bool
+		trusted []peer.ID
+	}{
+		{"revokes another node", desktop, laptop.String(), false, []peer.ID{desktop, server}},
+		{"revokes the sender", laptop, laptop.String(), true, []peer.ID{desktop, laptop, server}},
+		{"no revoked node", desktop, "", true, []peer.ID{desktop, laptop, server}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trustedNodes := map[string]interface{}{}
+			for name, id := range map[string]peer.ID{"desktop": desktop, "laptop": laptop, "server": server} {
+				trustedNodes[name] = map[string]interface{}{"addr": "/ip4/127.0.0.1/tcp/3010/p2p/" + id.String()}
+			}
+			viper.Set("trustedNodes", trustedNodes)
+
+			pendingPath := filepath.Join(dir, pendingSecretsFile)
+			os.Remove(pendingPath)
+
+			payload, err := json.Marshal(&export{
+				Addrs:     []string{"/ip4/127.0.0.1/tcp/3010/p2p/" + test.from.String()},
+				ThreadKey: "thread key",
+				SwarmKey:  "swarm key",
+				Revoked:   test.revoked,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = receiveRotatedSecrets(dir, test.from, payload)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("receiveRotatedSecrets returned %v, want an error: %v", err, test.wantErr)
+			}
+
+			if _, err := os.Stat(pendingPath); os.IsNotExist(err) != test.wantErr {
+				t.Errorf("secrets saved: %v, want %v", !os.IsNotExist(err), !test.wantErr)
+			}
+
+			var trusted []peer.ID
+			for _, id := range []peer.ID{desktop, laptop, server} {
+				if isTrustedNode(id) {
+					trusted = append(trusted, id)
+				}
+			}
+			if !reflect.DeepEqual(trusted, test.trusted) {
+				t.Errorf("trusted nodes are %v, want %v", trusted, test.trusted)
+			}
+		})
+	}
+}
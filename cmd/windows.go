@@ -0,0 +1,160 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// window is a time of day backups are allowed in, on some days of the week.
+// A window that ends before it starts, e.g. 22:00-06:00, continues into the next day
+type window struct {
+	// Minutes since midnight
+	start, end int
+	// Days the window starts on. No days means every day
+	days map[time.Weekday]bool
+}
+
+// windowConfig is a window as written in the config
+type windowConfig struct {
+	Start string
+	End   string
+	Days  []string
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func windowFromConfig(config windowConfig) (window, error) {
+	var w window
+	var err error
+
+	if w.start, err = parseTimeOfDay(config.Start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTimeOfDay(config.End); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("Window %s-%s is empty", config.Start, config.End)
+	}
+
+	for _, name := range config.Days {
+		days, ok := weekdayNames[strings.ToLower(name)]
+		if !ok {
+			return w, fmt.Errorf("Invalid day %q, expected sun, mon, tue, wed, thu, fri, sat, weekdays or weekends", name)
+		}
+
+		if w.days == nil {
+			w.days = map[time.Weekday]bool{}
+		}
+		for _, d := range days {
+			w.days[d] = true
+		}
+	}
+
+	return w, nil
+}
+
+// parseTimeOfDay parses a time like 01:30 into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns true if t is within the window, in the location of t
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.startsOn(t.Weekday()) && m >= w.start && m < w.end
+	}
+
+	// The window started on the day before if t is after midnight
+	return (w.startsOn(t.Weekday()) && m >= w.start) || (w.startsOn((t.Weekday()+6)%7) && m < w.end)
+}
+
+// next returns t if it is within the window, or else when the window next opens
+func (w window) next(t time.Time) time.Time {
+	if w.contains(t) {
+		return t
+	}
+
+	for d := 0; d <= 7; d++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+d, 0, 0, 0, 0, t.Location())
+		start := day.Add(time.Duration(w.start) * time.Minute)
+		if w.startsOn(day.Weekday()) && start.After(t) {
+			return start
+		}
+	}
+
+	return time.Time{}
+}
+
+func (w window) startsOn(d time.Weekday) bool {
+	return w.days == nil || w.days[d]
+}
+
+// inWindows returns true if t is within any of the windows, or if there are none
+func inWindows(windows []window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextInWindows returns the earliest time at or after t that is within any of the windows
+func nextInWindows(windows []window, t time.Time) time.Time {
+	if len(windows) == 0 {
+		return t
+	}
+
+	var next time.Time
+	for _, w := range windows {
+		if n := w.next(t); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,234 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@reboot",
+	}
+
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, expected an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := func(loc *time.Location, year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, loc)
+	}
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return date(time.UTC, year, month, day, hour, minute)
+	}
+
+	// June 17th 2020 is a Wednesday
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			name: "daily",
+			expr: "0 2 * * *",
+			from: utc(2020, time.June, 17, 1, 30),
+			want: []time.Time{utc(2020, time.June, 17, 2, 0), utc(2020, time.June, 18, 2, 0)},
+		},
+		{
+			name: "a matching time is not after itself",
+			expr: "0 2 * * *",
+			from: utc(2020, time.June, 17, 2, 0),
+			want: []time.Time{utc(2020, time.June, 18, 2, 0)},
+		},
+		{
+			name: "seconds are ignored",
+			expr: "*/15 * * * *",
+			from: time.Date(2020, time.June, 17, 10, 7, 30, 500, time.UTC),
+			want: []time.Time{utc(2020, time.June, 17, 10, 15), utc(2020, time.June, 17, 10, 30)},
+		},
+		{
+			name: "range with a step",
+			expr: "0 9-17/4 * * *",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{
+				utc(2020, time.June, 17, 9, 0),
+				utc(2020, time.June, 17, 13, 0),
+				utc(2020, time.June, 17, 17, 0),
+				utc(2020, time.June, 18, 9, 0),
+			},
+		},
+		{
+			name: "value with a step runs to the end of the field",
+			expr: "5/20 * * * *",
+			from: utc(2020, time.June, 17, 10, 0),
+			want: []time.Time{utc(2020, time.June, 17, 10, 5), utc(2020, time.June, 17, 10, 25), utc(2020, time.June, 17, 10, 45), utc(2020, time.June, 17, 11, 5)},
+		},
+		{
+			name: "list of names",
+			expr: "30 1 * * mon,wed,fri",
+			from: utc(2020, time.June, 17, 2, 0),
+			want: []time.Time{utc(2020, time.June, 19, 1, 30), utc(2020, time.June, 22, 1, 30), utc(2020, time.June, 24, 1, 30)},
+		},
+		{
+			name: "range of days of the week",
+			expr: "0 0 * * 6-7",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.June, 20, 0, 0), utc(2020, time.June, 21, 0, 0), utc(2020, time.June, 27, 0, 0)},
+		},
+		{
+			name: "sunday is 7",
+			expr: "0 0 * * 7",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.June, 21, 0, 0), utc(2020, time.June, 28, 0, 0)},
+		},
+		{
+			name: "day of month and day of week match either",
+			expr: "0 0 1,15 * mon",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.June, 22, 0, 0), utc(2020, time.June, 29, 0, 0), utc(2020, time.July, 1, 0, 0), utc(2020, time.July, 6, 0, 0)},
+		},
+		{
+			name: "day of week alone when day of month is *",
+			expr: "0 0 * * fri",
+			from: utc(2020, time.June, 30, 0, 0),
+			want: []time.Time{utc(2020, time.July, 3, 0, 0)},
+		},
+		{
+			name: "day of month alone when day of week is *",
+			expr: "0 0 13 * *",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.July, 13, 0, 0), utc(2020, time.August, 13, 0, 0)},
+		},
+		{
+			name: "day of month with a step counts as *",
+			expr: "0 0 */10 * fri",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.July, 31, 0, 0), utc(2020, time.August, 21, 0, 0)},
+		},
+		{
+			name: "months",
+			expr: "0 0 1 jan,jul *",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.July, 1, 0, 0), utc(2021, time.January, 1, 0, 0)},
+		},
+		{
+			name: "31st skips short months",
+			expr: "0 0 31 * *",
+			from: utc(2020, time.March, 31, 0, 0),
+			want: []time.Time{utc(2020, time.May, 31, 0, 0), utc(2020, time.July, 31, 0, 0)},
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: utc(2020, time.March, 1, 0, 0),
+			want: []time.Time{utc(2024, time.February, 29, 0, 0)},
+		},
+		{
+			name: "never matches",
+			expr: "0 0 30 2 *",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{{}},
+		},
+		{
+			name: "hourly",
+			expr: "@hourly",
+			from: utc(2020, time.June, 17, 23, 30),
+			want: []time.Time{utc(2020, time.June, 18, 0, 0), utc(2020, time.June, 18, 1, 0)},
+		},
+		{
+			name: "weekly",
+			expr: "@weekly",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2020, time.June, 21, 0, 0)},
+		},
+		{
+			name: "yearly",
+			expr: "@yearly",
+			from: utc(2020, time.June, 17, 0, 0),
+			want: []time.Time{utc(2021, time.January, 1, 0, 0)},
+		},
+		{
+			name: "location of the time",
+			expr: "0 2 * * *",
+			from: date(newYork, 2020, time.June, 17, 3, 0),
+			want: []time.Time{date(newYork, 2020, time.June, 18, 2, 0)},
+		},
+		{
+			// Clocks go from 02:00 EST to 03:00 EDT on March 8th 2020
+			name: "time skipped when DST starts is moved forward",
+			expr: "30 2 * * *",
+			from: date(newYork, 2020, time.March, 7, 12, 0),
+			want: []time.Time{
+				time.Date(2020, time.March, 8, 7, 30, 0, 0, time.UTC),
+				date(newYork, 2020, time.March, 9, 2, 30),
+			},
+		},
+		{
+			name: "times around the start of DST",
+			expr: "0 * * * *",
+			from: date(newYork, 2020, time.March, 8, 0, 30),
+			want: []time.Time{date(newYork, 2020, time.March, 8, 1, 0), date(newYork, 2020, time.March, 8, 3, 0), date(newYork, 2020, time.March, 8, 4, 0)},
+		},
+		{
+			// Clocks go from 02:00 EDT back to 01:00 EST on November 1st 2020
+			name: "time repeated when DST ends matches once",
+			expr: "30 1 * * *",
+			from: date(newYork, 2020, time.October, 31, 12, 0),
+			want: []time.Time{
+				time.Date(2020, time.November, 1, 5, 30, 0, 0, time.UTC),
+				date(newYork, 2020, time.November, 2, 1, 30),
+			},
+		},
+		{
+			name: "time in the repeated hour after the first",
+			expr: "*/20 * * * *",
+			from: time.Date(2020, time.November, 1, 6, 10, 0, 0, time.UTC).In(newYork),
+			want: []time.Time{time.Date(2020, time.November, 1, 7, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Parse(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from := test.from
+			for _, want := range test.want {
+				got := s.Next(from)
+				if !got.Equal(want) {
+					t.Fatalf("Next(%v) = %v, want %v", from, got, want)
+				}
+				if !got.IsZero() && got.Location() != from.Location() {
+					t.Errorf("Next(%v) is in %v, want %v", from, got.Location(), from.Location())
+				}
+
+				from = got
+			}
+		})
+	}
+}
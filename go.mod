@@ -3,7 +3,7 @@ module github.com/codynhat/ipfs-ios-backup
 go 1.14
 
 require (
-	github.com/go-co-op/gocron v0.1.2-0.20200429025551-8c7e3da6cc03
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.4.0
 	github.com/hsanjuan/ipfs-lite v1.1.13
 	github.com/ipfs/go-cid v0.0.5
@@ -20,13 +20,16 @@ require (
 	github.com/libp2p/go-libp2p-host v0.0.3
 	github.com/libp2p/go-libp2p-kad-dht v0.7.11
 	github.com/libp2p/go-libp2p-peerstore v0.2.3
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/multiformats/go-multiaddr v0.2.1
 	github.com/spf13/cobra v0.0.7
 	github.com/spf13/viper v1.4.0
 	github.com/textileio/go-threads v0.1.18
+	golang.org/x/crypto v0.0.0-20200423211502-4bdfaf469ed5
 	google.golang.org/grpc v1.29.1
 	google.golang.org/protobuf v1.23.0
+	howett.net/plist v1.0.0
 )
 
 exclude github.com/libp2p/go-libp2p-crypto v0.0.2
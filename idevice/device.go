@@ -0,0 +1,103 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+import "context"
+
+// DeviceID is an identifier for a device
+type DeviceID string
+
+// DeviceConnectionType is a type of connection a device is available on
+type DeviceConnectionType int
+
+const (
+	// USB connection type
+	USB DeviceConnectionType = 1
+	// WIFI connection type
+	WIFI DeviceConnectionType = 2
+)
+
+// Device is a representation of an iOS device
+type Device struct {
+	Udid           DeviceID
+	ConnectionType DeviceConnectionType
+}
+
+// DeviceEventType is a kind of change to the connected devices
+type DeviceEventType int
+
+const (
+	// DeviceAdded is sent when a device is connected over USB or found on WiFi
+	DeviceAdded DeviceEventType = 1
+	// DeviceRemoved is sent when a device is disconnected or lost on WiFi
+	DeviceRemoved DeviceEventType = 2
+	// DevicePaired is sent when a device is paired with this computer
+	DevicePaired DeviceEventType = 3
+)
+
+// DeviceEvent is a change to a connected device, as reported by usbmuxd
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device Device
+}
+
+// BackupProgress is the progress of a backup as reported by a device
+type BackupProgress struct {
+	// Phase is what the device is currently doing, e.g. "Receiving files"
+	Phase string
+	// Percent is the overall progress of the backup
+	Percent float64
+	// File is the file currently being received
+	File string
+	// BytesReceived is the number of bytes received so far
+	BytesReceived uint64
+	// TotalBytes is the number of bytes the device will send, or 0 if it is not known yet
+	TotalBytes uint64
+}
+
+// BackupProgressFunc is called as a backup makes progress
+type BackupProgressFunc func(BackupProgress)
+
+// Provider communicates with iOS devices
+type Provider interface {
+	// GetDevices gets the DeviceID of all connected devices
+	GetDevices() ([]Device, error)
+	// SubscribeDeviceEvents reports devices being connected and disconnected until ctx is done, when the channel is closed
+	SubscribeDeviceEvents(ctx context.Context) (<-chan DeviceEvent, error)
+	// GetDeviceName finds the name of the device with the given ID
+	GetDeviceName(deviceID DeviceID) (string, error)
+	// GetDeviceWillEncrypt queries a device to see if encryption is enabled
+	GetDeviceWillEncrypt(deviceID DeviceID) (bool, error)
+	// GetDeviceBatteryIsCharging queries a device to see if the battery is charging
+	GetDeviceBatteryIsCharging(deviceID DeviceID) (bool, error)
+	// GetDeviceBatteryCurrentCapacity queries a device to get the current battery capacity percentage
+	GetDeviceBatteryCurrentCapacity(deviceID DeviceID) (uint64, error)
+	// PairDevice will attempt to pair a device with this computer, or do nothing if already paired
+	PairDevice(deviceID DeviceID) error
+	// PerformBackup performs a backup of a device to backupDirectory/deviceID, reporting progress to progress if it is not nil.
+	// The backup is aborted if ctx is done
+	PerformBackup(ctx context.Context, deviceID DeviceID, backupDirectory string, progress BackupProgressFunc) error
+	// RestoreBackup restores the backup in backupDirectory/deviceID to a device. The restore is aborted if ctx is done
+	RestoreBackup(ctx context.Context, deviceID DeviceID, backupDirectory string) error
+	// EnableBackupEncryption enables backup encryption interactively. It is aborted if ctx is done
+	EnableBackupEncryption(ctx context.Context, deviceID DeviceID) error
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDeviceNotFound is returned when a device is not connected over USB or WiFi
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrNotPaired is returned when a device has not been paired with this computer, or its pairing is no longer valid
+	ErrNotPaired = errors.New("device is not paired")
+	// ErrPasscodeLocked is returned when a device must be unlocked with its passcode first
+	ErrPasscodeLocked = errors.New("device is locked with a passcode")
+	// ErrUserDeniedTrust is returned when the user did not trust this computer on the device
+	ErrUserDeniedTrust = errors.New("user denied trusting this computer")
+	// ErrEncryptionRequired is returned when backup encryption is not enabled on a device that requires it
+	ErrEncryptionRequired = errors.New("backup encryption is not enabled")
+	// ErrDiskFull is returned when there is not enough space to write a backup
+	ErrDiskFull = errors.New("not enough disk space")
+	// ErrBackupInProgress is returned when another backup or restore is using the device
+	ErrBackupInProgress = errors.New("another backup is in progress")
+	// ErrTransportLost is returned when the connection to a device is lost during an operation
+	ErrTransportLost = errors.New("connection to device was lost")
+)
+
+// Error is a failed operation on a device
+type Error struct {
+	// Op is the operation that failed, e.g. "perform backup"
+	Op       string
+	DeviceID DeviceID
+	// Code is the error code returned by libimobiledevice, or 0 if there is none
+	Code int
+	// Err is one of the sentinel errors of this package, or a description of the failure
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("Failed to %s (%s): %s", e.Op, e.DeviceID, e.Err)
+	if e.Code != 0 {
+		msg += fmt.Sprintf(" (error code %d)", e.Code)
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable returns true if an operation that failed with err may succeed if it is tried again later
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrDeviceNotFound) ||
+		errors.Is(err, ErrTransportLost) ||
+		errors.Is(err, ErrBackupInProgress) ||
+		errors.Is(err, ErrPasscodeLocked)
+}
+
+func newError(op string, deviceID DeviceID, code int, err error) error {
+	return &Error{
+		Op:       op,
+		DeviceID: deviceID,
+		Code:     code,
+		Err:      err,
+	}
+}
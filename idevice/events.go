@@ -0,0 +1,110 @@
+//go:build !nolibimobiledevice
+// +build !nolibimobiledevice
+
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+/*
+#include <libimobiledevice/libimobiledevice.h>
+#include "idevice.h"
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+var (
+	// usbmuxd events are delivered to a single callback without user data, so they are sent to every subscriber
+	subscribeLock    sync.Mutex
+	eventsLock       sync.Mutex
+	eventSubscribers = map[chan DeviceEvent]struct{}{}
+)
+
+// SubscribeDeviceEvents reports devices being connected and disconnected until ctx is done, when the channel is closed
+func (p *libimobiledevice) SubscribeDeviceEvents(ctx context.Context) (<-chan DeviceEvent, error) {
+	subscribeLock.Lock()
+	defer subscribeLock.Unlock()
+
+	events := make(chan DeviceEvent, 16)
+
+	eventsLock.Lock()
+	first := len(eventSubscribers) == 0
+	eventSubscribers[events] = struct{}{}
+	eventsLock.Unlock()
+
+	// usbmuxd reports the devices that are already connected when subscribing
+	if first {
+		if err := C.subscribe_device_events(); err != C.IDEVICE_E_SUCCESS {
+			eventsLock.Lock()
+			delete(eventSubscribers, events)
+			eventsLock.Unlock()
+
+			return nil, fmt.Errorf("Failed to subscribe to device events (error code %d)", err)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		subscribeLock.Lock()
+		defer subscribeLock.Unlock()
+
+		eventsLock.Lock()
+		delete(eventSubscribers, events)
+		last := len(eventSubscribers) == 0
+		close(events)
+		eventsLock.Unlock()
+
+		// Unsubscribing waits for the event thread, so events must not be locked
+		if last {
+			C.idevice_event_unsubscribe()
+		}
+	}()
+
+	return events, nil
+}
+
+//export goDeviceEvent
+func goDeviceEvent(event C.int, udid *C.char, connType C.int) {
+	e := DeviceEvent{
+		Type: DeviceEventType(event),
+		Device: Device{
+			Udid:           DeviceID(C.GoString(udid)),
+			ConnectionType: DeviceConnectionType(connType),
+		},
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	// A subscriber that is not keeping up misses events rather than blocking usbmuxd
+	for events := range eventSubscribers {
+		select {
+		case events <- e:
+		default:
+		}
+	}
+}
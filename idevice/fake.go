@@ -0,0 +1,605 @@
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codynhat/ipfs-ios-backup/manifest"
+	"howett.net/plist"
+)
+
+// FakeDevice is a simulated device used by FakeProvider
+type FakeDevice struct {
+	Udid           DeviceID
+	Name           string
+	ConnectionType DeviceConnectionType
+	ProductType    string
+	ProductVersion string
+	BatteryLevel   uint64
+	IsCharging     bool
+	WillEncrypt    bool
+	// BackupPassword is the password backups are encrypted with if WillEncrypt is set
+	BackupPassword string
+	// PairError is returned by PairDevice, e.g. ErrPasscodeLocked to simulate a locked device
+	PairError error
+	// BackupError is returned by PerformBackup instead of writing a backup, e.g. ErrTransportLost
+	BackupError error
+	// FileDelay is how long each file takes to be sent, to simulate slow or stuck backups
+	FileDelay time.Duration
+	// RestoreError is returned by RestoreBackup
+	RestoreError error
+	// Files are written to every backup, keyed by "Domain/relative/path"
+	Files map[string][]byte
+}
+
+// FakeProvider is an in-memory Provider that simulates devices without libimobiledevice
+type FakeProvider struct {
+	lock     sync.Mutex
+	devices  map[DeviceID]*FakeDevice
+	paired   map[DeviceID]bool
+	backups  map[DeviceID]int
+	restores map[DeviceID][]string
+	// subscribers receive the devices that are added, removed and paired
+	subscribers map[chan DeviceEvent]struct{}
+}
+
+// NewFakeProvider creates a FakeProvider with the given devices connected
+func NewFakeProvider(devices ...FakeDevice) *FakeProvider {
+	p := &FakeProvider{
+		devices:  map[DeviceID]*FakeDevice{},
+		paired:   map[DeviceID]bool{},
+		backups:  map[DeviceID]int{},
+		restores: map[DeviceID][]string{},
+
+		subscribers: map[chan DeviceEvent]struct{}{},
+	}
+
+	for _, device := range devices {
+		p.AddDevice(device)
+	}
+
+	return p
+}
+
+// AddDevice connects a simulated device, replacing any device with the same ID
+func (p *FakeProvider) AddDevice(device FakeDevice) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if device.ConnectionType == 0 {
+		device.ConnectionType = USB
+	}
+	if device.ProductType == "" {
+		device.ProductType = "iPhone12,1"
+	}
+	if device.ProductVersion == "" {
+		device.ProductVersion = "13.4.1"
+	}
+
+	p.devices[device.Udid] = &device
+	p.sendEvent(DeviceAdded, &device)
+}
+
+// RemoveDevice disconnects a simulated device
+func (p *FakeProvider) RemoveDevice(deviceID DeviceID) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, ok := p.devices[deviceID]
+	if !ok {
+		return
+	}
+
+	delete(p.devices, deviceID)
+	p.sendEvent(DeviceRemoved, device)
+}
+
+// SetBattery changes the battery state of a simulated device
+func (p *FakeProvider) SetBattery(deviceID DeviceID, level uint64, isCharging bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.device(deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.BatteryLevel = level
+	device.IsCharging = isCharging
+
+	return nil
+}
+
+// IsPaired returns true if PairDevice succeeded for a device
+func (p *FakeProvider) IsPaired(deviceID DeviceID) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.paired[deviceID]
+}
+
+// BackupCount returns how many backups have been performed for a device
+func (p *FakeProvider) BackupCount(deviceID DeviceID) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.backups[deviceID]
+}
+
+// Restores returns the backup directories that have been restored to a device
+func (p *FakeProvider) Restores(deviceID DeviceID) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]string{}, p.restores[deviceID]...)
+}
+
+// SubscribeDeviceEvents reports simulated devices being added, removed and paired until ctx is done.
+// Devices that are already connected are reported as added first
+func (p *FakeProvider) SubscribeDeviceEvents(ctx context.Context) (<-chan DeviceEvent, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	events := make(chan DeviceEvent, 16+len(p.devices))
+	for _, device := range p.devices {
+		events <- DeviceEvent{
+			Type:   DeviceAdded,
+			Device: Device{device.Udid, device.ConnectionType},
+		}
+	}
+	p.subscribers[events] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		delete(p.subscribers, events)
+		close(events)
+	}()
+
+	return events, nil
+}
+
+// GetDevices gets the DeviceID of all connected devices
+func (p *FakeProvider) GetDevices() ([]Device, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var devices []Device
+	for _, device := range p.devices {
+		devices = append(devices, Device{device.Udid, device.ConnectionType})
+	}
+
+	return devices, nil
+}
+
+// GetDeviceName finds the name of the device with the given ID
+func (p *FakeProvider) GetDeviceName(deviceID DeviceID) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.device(deviceID)
+	if err != nil {
+		return "", err
+	}
+
+	return device.Name, nil
+}
+
+// GetDeviceWillEncrypt queries a device to see if encryption is enabled
+func (p *FakeProvider) GetDeviceWillEncrypt(deviceID DeviceID) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.pairedDevice(deviceID)
+	if err != nil {
+		return false, err
+	}
+
+	return device.WillEncrypt, nil
+}
+
+// GetDeviceBatteryIsCharging queries a device to see if the battery is charging
+func (p *FakeProvider) GetDeviceBatteryIsCharging(deviceID DeviceID) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.pairedDevice(deviceID)
+	if err != nil {
+		return false, err
+	}
+
+	return device.IsCharging, nil
+}
+
+// GetDeviceBatteryCurrentCapacity queries a device to get the current battery capacity percentage
+func (p *FakeProvider) GetDeviceBatteryCurrentCapacity(deviceID DeviceID) (uint64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.pairedDevice(deviceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return device.BatteryLevel, nil
+}
+
+// PairDevice will attempt to pair a device with this computer, or do nothing if already paired
+func (p *FakeProvider) PairDevice(deviceID DeviceID) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.device(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if device.PairError != nil {
+		return newError("pair device", deviceID, 0, device.PairError)
+	}
+
+	if !p.paired[deviceID] {
+		p.paired[deviceID] = true
+		p.sendEvent(DevicePaired, device)
+	}
+
+	return nil
+}
+
+// PerformBackup writes a synthetic backup of a device to backupDirectory/deviceID
+func (p *FakeProvider) PerformBackup(ctx context.Context, deviceID DeviceID, backupDirectory string, progress BackupProgressFunc) error {
+	p.lock.Lock()
+	paired, err := p.pairedDevice(deviceID)
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+
+	// The backup is written from a copy without the lock, so a slow backup does not block the other calls
+	device := *paired
+	device.Files = make(map[string][]byte, len(paired.Files))
+	for name, data := range paired.Files {
+		device.Files[name] = data
+	}
+	p.lock.Unlock()
+
+	if device.BackupError != nil {
+		return newError("perform backup", deviceID, 0, device.BackupError)
+	}
+
+	if err := writeFakeBackup(ctx, &device, filepath.Join(backupDirectory, string(deviceID)), progress); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.backups[deviceID]++
+	p.lock.Unlock()
+
+	return nil
+}
+
+// RestoreBackup checks that backupDirectory/deviceID contains a backup and records the restore
+func (p *FakeProvider) RestoreBackup(ctx context.Context, deviceID DeviceID, backupDirectory string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.pairedDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if device.RestoreError != nil {
+		return newError("restore backup", deviceID, 0, device.RestoreError)
+	}
+
+	deviceDir := filepath.Join(backupDirectory, string(deviceID))
+	for _, name := range []string{"Info.plist", "Manifest.plist", "Manifest.db", "Status.plist"} {
+		if _, err := os.Stat(filepath.Join(deviceDir, name)); err != nil {
+			return fmt.Errorf("Backup is missing %s", name)
+		}
+	}
+
+	p.restores[deviceID] = append(p.restores[deviceID], backupDirectory)
+
+	return nil
+}
+
+// EnableBackupEncryption enables backup encryption of a simulated device
+func (p *FakeProvider) EnableBackupEncryption(ctx context.Context, deviceID DeviceID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	device, err := p.pairedDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.WillEncrypt = true
+
+	return nil
+}
+
+// sendEvent sends an event to every subscriber. p.lock must be held
+func (p *FakeProvider) sendEvent(eventType DeviceEventType, device *FakeDevice) {
+	for events := range p.subscribers {
+		select {
+		case events <- DeviceEvent{Type: eventType, Device: Device{device.Udid, device.ConnectionType}}:
+		default:
+		}
+	}
+}
+
+func (p *FakeProvider) device(deviceID DeviceID) (*FakeDevice, error) {
+	device, ok := p.devices[deviceID]
+	if !ok {
+		return nil, newError("connect to device", deviceID, 0, ErrDeviceNotFound)
+	}
+
+	return device, nil
+}
+
+func (p *FakeProvider) pairedDevice(deviceID DeviceID) (*FakeDevice, error) {
+	device, err := p.device(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.paired[deviceID] {
+		return nil, newError("connect to device", deviceID, 0, ErrNotPaired)
+	}
+
+	return device, nil
+}
+
+// writeFakeBackup writes a backup with the same layout devicebackup2 uses
+func writeFakeBackup(ctx context.Context, device *FakeDevice, deviceDir string, progress BackupProgressFunc) error {
+	if progress == nil {
+		progress = func(BackupProgress) {}
+	}
+
+	if err := os.MkdirAll(deviceDir, 0775); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	// Encrypted backups protect every file and Manifest.db with their own key
+	var keybag *manifest.Keybag
+	var manifestKey, wrappedManifestKey []byte
+	if device.WillEncrypt {
+		var err error
+		// A low iteration count keeps simulated backups fast
+		keybag, err = manifest.NewKeybag(device.BackupPassword, 10, fakeProtectionClass)
+		if err != nil {
+			return err
+		}
+
+		manifestKey, wrappedManifestKey, err = newFakeFileKey(keybag)
+		if err != nil {
+			return err
+		}
+	}
+
+	info := map[string]interface{}{
+		"Device Name":       device.Name,
+		"Display Name":      device.Name,
+		"Product Type":      device.ProductType,
+		"Product Version":   device.ProductVersion,
+		"Unique Identifier": string(device.Udid),
+		"Last Backup Date":  now,
+	}
+
+	manifestPlist := map[string]interface{}{
+		"IsEncrypted":  device.WillEncrypt,
+		"Version":      "10.0",
+		"Date":         now,
+		"Applications": map[string]interface{}{},
+		"Lockdown": map[string]interface{}{
+			"DeviceName":     device.Name,
+			"ProductType":    device.ProductType,
+			"ProductVersion": device.ProductVersion,
+			"UniqueDeviceID": string(device.Udid),
+		},
+	}
+	if keybag != nil {
+		manifestPlist["BackupKeyBag"] = keybag.Bytes()
+		manifestPlist["ManifestKey"] = wrappedManifestKey
+	}
+
+	status := map[string]interface{}{
+		"IsFullBackup":  false,
+		"Version":       "3.3",
+		"BackupState":   "new",
+		"SnapshotState": "finished",
+		"Date":          now,
+	}
+
+	for name, v := range map[string]interface{}{"Info.plist": info, "Manifest.plist": manifestPlist, "Status.plist": status} {
+		data, err := plist.Marshal(v, plist.XMLFormat)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(deviceDir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	files := device.Files
+	if files == nil {
+		files = map[string][]byte{
+			"HomeDomain/Library/Preferences/com.apple.Preferences.plist": []byte("preferences"),
+			"CameraRollDomain/Media/DCIM/100APPLE/IMG_0001.HEIC":         []byte("photo"),
+		}
+	}
+
+	var manifestFiles []manifest.File
+	names := make([]string, 0, len(files))
+	var totalBytes, bytesReceived uint64
+	for name, data := range files {
+		names = append(names, name)
+		totalBytes += uint64(len(data))
+	}
+	sort.Strings(names)
+
+	// Files are stored under the SHA-1 of their domain and relative path
+	for _, name := range names {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(device.FileDelay):
+		}
+
+		data := files[name]
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Fake file %s is not of the form Domain/relative/path", name)
+		}
+
+		hash := sha1.Sum([]byte(parts[0] + "-" + parts[1]))
+		fileID := hex.EncodeToString(hash[:])
+		manifestFile := manifest.File{
+			FileID:       fileID,
+			Domain:       parts[0],
+			RelativePath: parts[1],
+			Flags:        manifest.FlagFile,
+			Size:         uint64(len(data)),
+			Mode:         0100644,
+			LastModified: now,
+		}
+
+		if keybag != nil {
+			// Unchanged files are encrypted with the same key, so they are stored once in IPFS like in real backups
+			key := sha256.Sum256([]byte(device.BackupPassword + "-" + fileID + "-" + string(data)))
+			wrappedKey, err := keybag.WrapKey(fakeProtectionClass, key[:])
+			if err != nil {
+				return err
+			}
+
+			manifestFile.ProtectionClass = fakeProtectionClass
+			manifestFile.EncryptionKey = wrappedKey
+			if data, err = manifest.Encrypt(key[:], data); err != nil {
+				return err
+			}
+		}
+		manifestFiles = append(manifestFiles, manifestFile)
+
+		dir := filepath.Join(deviceDir, fileID[:2])
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, fileID), data, 0644); err != nil {
+			return err
+		}
+
+		bytesReceived += manifestFile.Size
+		progress(BackupProgress{
+			Phase:         "Receiving files",
+			Percent:       float64(bytesReceived) / float64(totalBytes) * 100,
+			File:          name,
+			BytesReceived: bytesReceived,
+			TotalBytes:    totalBytes,
+		})
+	}
+
+	// Manifest.db is written last, like devicebackup2 does
+	manifestDb := filepath.Join(deviceDir, "Manifest.db")
+	if err := os.RemoveAll(manifestDb); err != nil {
+		return err
+	}
+	if err := manifest.WriteDB(manifestDb, manifestFiles); err != nil {
+		return fmt.Errorf("Failed to write Manifest.db: %s", err)
+	}
+
+	if keybag != nil {
+		if err := encryptFakeFile(manifestDb, manifestKey); err != nil {
+			return fmt.Errorf("Failed to encrypt Manifest.db: %s", err)
+		}
+	}
+
+	progress(BackupProgress{
+		Phase:         "Backup Successful",
+		Percent:       100,
+		BytesReceived: bytesReceived,
+		TotalBytes:    totalBytes,
+	})
+
+	return nil
+}
+
+// Protection class of the files of simulated encrypted backups
+const fakeProtectionClass = 3
+
+// newFakeFileKey creates a random file key and wraps it with the keybag of a simulated backup
+func newFakeFileKey(keybag *manifest.Keybag) (key []byte, wrappedKey []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	wrappedKey, err = keybag.WrapKey(fakeProtectionClass, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, wrappedKey, nil
+}
+
+// encryptFakeFile encrypts a file of a simulated backup in place
+func encryptFakeFile(path string, key []byte) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	data, err = manifest.Encrypt(key, data)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,45 @@
+//go:build !nolibimobiledevice
+// +build !nolibimobiledevice
+
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+#include <stdlib.h>
+#include <libimobiledevice/libimobiledevice.h>
+#include <libimobiledevice/devicebackup2.h>
+#include "idevice.h"
+#include "_cgo_export.h"
+
+int run_devicebackup2(int cmd, int flags, char *udid, char *backup_directory, int progress) {
+	if (progress) {
+		return run_cmd(cmd, flags, udid, udid, backup_directory, 1, (void *)goBackupStatus, (void *)goBackupProgress);
+	}
+	return run_cmd(cmd, flags, udid, udid, backup_directory, 1, NULL, NULL);
+}
+
+static void device_event_cb(const idevice_event_t *event, void *user_data) {
+	goDeviceEvent(event->event, (char *)event->udid, event->conn_type);
+}
+
+int subscribe_device_events(void) {
+	return idevice_event_subscribe(device_event_cb, NULL);
+}
@@ -1,3 +1,6 @@
+//go:build !nolibimobiledevice
+// +build !nolibimobiledevice
+
 /*
 Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
 
@@ -24,47 +27,43 @@ package idevice
 /*
 #cgo LDFLAGS: -limobiledevice -lplist
 #include <stdlib.h>
+#include <stdint.h>
 #include <libimobiledevice/libimobiledevice.h>
 #include <libimobiledevice/lockdown.h>
+#include <libimobiledevice/mobilebackup2.h>
 #include <libimobiledevice/devicebackup2.h>
 #include <plist/plist.h>
+#include "idevice.h"
 */
 import "C"
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"os/exec"
 	"unsafe"
 )
 
-// DeviceID is an identifier for a device
-type DeviceID string
-
-// DeviceConnectionType is a type of connection a device is available on
-type DeviceConnectionType int
-
-const (
-	// USB connection type
-	USB DeviceConnectionType = 1
-	// WIFI connection type
-	WIFI DeviceConnectionType = 2
-)
+// libimobiledevice is a Provider that talks to real devices using libimobiledevice
+type libimobiledevice struct{}
 
-// Device is a representation of an iOS device
-type Device struct {
-	Udid           DeviceID
-	ConnectionType DeviceConnectionType
+// NewProvider creates a Provider backed by libimobiledevice
+func NewProvider() Provider {
+	return &libimobiledevice{}
 }
 
 // GetDevices gets the DeviceID of all connected devices
-func GetDevices() ([]Device, error) {
+func (p *libimobiledevice) GetDevices() ([]Device, error) {
 	var cDeviceInfos *C.idevice_info_t
 	var length C.int
 
 	err := C.idevice_get_device_list_extended(&cDeviceInfos, &length)
 	defer C.idevice_device_list_extended_free(cDeviceInfos)
 	if err < 0 {
-		return nil, errors.New("Failed to retrieve list of devices")
+		return nil, fmt.Errorf("Failed to retrieve list of devices (error code %d)", err)
 	}
 
 	cDevices := (*[1 << 28]C.idevice_info_t)(unsafe.Pointer(cDeviceInfos))[:length:length]
@@ -81,238 +80,383 @@ func GetDevices() ([]Device, error) {
 }
 
 // GetDeviceName finds the name of the device with the given ID
-func GetDeviceName(deviceID DeviceID) (string, error) {
-	var device C.idevice_t
-	var client C.lockdownd_client_t
+func (p *libimobiledevice) GetDeviceName(deviceID DeviceID) (string, error) {
+	const op = "get device name"
 
-	var cDeviceID *C.char = C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cDeviceID))
-
-	err := C.idevice_new_with_options(&device, cDeviceID, C.IDEVICE_LOOKUP_USBMUX|C.IDEVICE_LOOKUP_NETWORK)
-	defer C.idevice_free(device)
-	if err < 0 {
-		return "", errors.New("Failed to retrieve device name (idevice_new_with_options)")
-	}
-
-	if device == nil {
-		return "", fmt.Errorf("No device with UDID (%s) is connected", deviceID)
-	}
-
-	var cLabel *C.char = C.CString("ipfs-ios-backup")
-	defer C.free(unsafe.Pointer(cLabel))
-	err1 := C.lockdownd_client_new(device, &client, cLabel)
-	defer C.lockdownd_client_free(client)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return "", fmt.Errorf("Failed to connect to device (%s)", deviceID)
+	conn, err := connect(deviceID, op, false)
+	if err != nil {
+		return "", err
 	}
+	defer conn.close()
 
 	var cDeviceName *C.char
-	defer C.free(unsafe.Pointer(cDeviceName))
-	err1 = C.lockdownd_get_device_name(client, &cDeviceName)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return "", fmt.Errorf("Failed to get device name (%s)", deviceID)
+	if lerr := C.lockdownd_get_device_name(conn.client, &cDeviceName); lerr != C.LOCKDOWN_E_SUCCESS {
+		return "", lockdownError(op, deviceID, lerr)
 	}
+	defer C.free(unsafe.Pointer(cDeviceName))
 
 	return C.GoString(cDeviceName), nil
 }
 
 // GetDeviceWillEncrypt queries a device to see if encryption is enabled. See ideviceinfo cmd
-func GetDeviceWillEncrypt(deviceID DeviceID) (bool, error) {
+func (p *libimobiledevice) GetDeviceWillEncrypt(deviceID DeviceID) (bool, error) {
 	return getDeviceInfoBool(deviceID, "com.apple.mobile.backup", "WillEncrypt")
 }
 
 // GetDeviceBatteryIsCharging queries a device to see if the battery is charging. See ideviceinfo cmd
-func GetDeviceBatteryIsCharging(deviceID DeviceID) (bool, error) {
+func (p *libimobiledevice) GetDeviceBatteryIsCharging(deviceID DeviceID) (bool, error) {
 	return getDeviceInfoBool(deviceID, "com.apple.mobile.battery", "BatteryIsCharging")
 }
 
 // GetDeviceBatteryCurrentCapacity queries a device to get the current battery capacity percentage. See ideviceinfo cmd
-func GetDeviceBatteryCurrentCapacity(deviceID DeviceID) (uint64, error) {
+func (p *libimobiledevice) GetDeviceBatteryCurrentCapacity(deviceID DeviceID) (uint64, error) {
 	return getDeviceInfoUInt64(deviceID, "com.apple.mobile.battery", "BatteryCurrentCapacity")
 }
 
 // PairDevice will attempt to pair a device with this computer, or do nothing if already paired
-func PairDevice(deviceID DeviceID) error {
-	var device C.idevice_t
-	var client C.lockdownd_client_t
-
-	var cDeviceID *C.char = C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cDeviceID))
+func (p *libimobiledevice) PairDevice(deviceID DeviceID) error {
+	const op = "pair device"
 
-	err := C.idevice_new_with_options(&device, cDeviceID, C.IDEVICE_LOOKUP_USBMUX|C.IDEVICE_LOOKUP_NETWORK)
-	defer C.idevice_free(device)
-	if err < 0 {
-		return errors.New("Failed to retrieve device name (idevice_new_with_options)")
-	}
-
-	if device == nil {
-		return fmt.Errorf("No device with UDID (%s) is connected", deviceID)
-	}
-
-	var cLabel *C.char = C.CString("ipfs-ios-backup")
-	defer C.free(unsafe.Pointer(cLabel))
-
-	err1 := C.lockdownd_client_new_with_handshake(device, &client, cLabel)
-	defer C.lockdownd_client_free(client)
-	if err1 == C.LOCKDOWN_E_SUCCESS {
-		// Device is already paired
+	// Starting a session only succeeds if the device is already paired
+	if conn, err := connect(deviceID, op, true); err == nil {
+		conn.close()
 		return nil
 	}
 
-	err1 = C.lockdownd_client_new(device, &client, cLabel)
-	defer C.lockdownd_client_free(client)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return fmt.Errorf("Failed to connect to device (%s)", deviceID)
+	conn, err := connect(deviceID, op, false)
+	if err != nil {
+		return err
 	}
+	defer conn.close()
 
-	err1 = C.lockdownd_pair(client, nil)
-	switch err1 {
-	case C.LOCKDOWN_E_SUCCESS:
-		break
-	case C.LOCKDOWN_E_PASSWORD_PROTECTED:
-		return fmt.Errorf("Passcode detected. Try unlocking your device and trying again")
-		break
-	default:
-		return fmt.Errorf("Failed to get lockdownd value (%s)", deviceID)
+	if lerr := C.lockdownd_pair(conn.client, nil); lerr != C.LOCKDOWN_E_SUCCESS {
+		return lockdownError(op, deviceID, lerr)
 	}
 
 	return nil
 }
 
 // PerformBackup performs a backup using devicebackup2
-func PerformBackup(deviceID DeviceID, backupDirectory string) error {
-	cUdid := C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cUdid))
+func (p *libimobiledevice) PerformBackup(ctx context.Context, deviceID DeviceID, backupDirectory string, progress BackupProgressFunc) error {
+	return runCmd(ctx, "perform backup", &cmdRequest{
+		Cmd:             C.CMD_BACKUP,
+		DeviceID:        deviceID,
+		BackupDirectory: backupDirectory,
+		Progress:        progress != nil,
+	}, progress)
+}
 
-	cBackupDir := C.CString(backupDirectory)
-	defer C.free(unsafe.Pointer(cBackupDir))
+// RestoreBackup restores a backup using devicebackup2 with default settings
+func (p *libimobiledevice) RestoreBackup(ctx context.Context, deviceID DeviceID, backupDirectory string) error {
+	return runCmd(ctx, "restore backup", &cmdRequest{
+		Cmd:             C.CMD_RESTORE,
+		DeviceID:        deviceID,
+		BackupDirectory: backupDirectory,
+	}, nil)
+}
 
-	cErr := C.run_cmd(C.CMD_BACKUP, 0, cUdid, cUdid, cBackupDir, 1, nil, nil)
+// EnableBackupEncryption enables backup encryption interactively using devicebackup2
+func (p *libimobiledevice) EnableBackupEncryption(ctx context.Context, deviceID DeviceID) error {
+	return runCmd(ctx, "enable backup encryption", &cmdRequest{
+		Cmd:      C.CMD_CHANGEPW,
+		Flags:    C.CMD_FLAG_ENCRYPTION_ENABLE,
+		DeviceID: deviceID,
+	}, nil)
+}
 
-	if cErr < 0 {
-		return fmt.Errorf("devicebackup2 failed with error code %d", cErr)
-	}
+// devicebackup2 can not cancel a command once it is running, so each command runs in a child process of this
+// executable, which is killed when the command is cancelled. The device ends the session when its connection is closed.
+// The child process is told which command to run with this environment variable
+const cmdEnv = "IPFS_IOS_BACKUP_DEVICEBACKUP2_CMD"
+
+// The child process reports progress and the result of the command on this file descriptor, because devicebackup2
+// prints to stdout
+const cmdMessagesFd = 3
+
+// cmdRequest is a devicebackup2 command for the child process
+type cmdRequest struct {
+	Cmd             int
+	Flags           int
+	DeviceID        DeviceID
+	BackupDirectory string
+	Progress        bool
+}
 
-	return nil
+// cmdMessage is sent by the child process as a backup makes progress, and once the command is done
+type cmdMessage struct {
+	Progress *BackupProgress `json:",omitempty"`
+	Done     bool
+	Code     int
 }
 
-// RestoreBackup restores a backup using devicebackup2 with default settings
-func RestoreBackup(deviceID DeviceID, backupDirectory string) error {
-	cUdid := C.CString(string(deviceID))
+func init() {
+	if req := os.Getenv(cmdEnv); req != "" {
+		os.Exit(runCmdProcess(req))
+	}
+}
+
+// runCmdProcess runs a devicebackup2 command in the child process, and returns its exit code
+func runCmdProcess(encoded string) int {
+	enc := json.NewEncoder(os.NewFile(cmdMessagesFd, "messages"))
+
+	req := &cmdRequest{}
+	if err := json.Unmarshal([]byte(encoded), req); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid devicebackup2 command: %s\n", err)
+		return 2
+	}
+
+	cUdid := C.CString(string(req.DeviceID))
 	defer C.free(unsafe.Pointer(cUdid))
 
-	cBackupDir := C.CString(backupDirectory)
-	defer C.free(unsafe.Pointer(cBackupDir))
+	var cBackupDir *C.char
+	if req.BackupDirectory != "" {
+		cBackupDir = C.CString(req.BackupDirectory)
+		defer C.free(unsafe.Pointer(cBackupDir))
+	}
+
+	var cProgress C.int
+	if req.Progress {
+		cProgress = 1
+		startBackupProgress(func(progress BackupProgress) {
+			enc.Encode(&cmdMessage{Progress: &progress})
+		})
+	}
 
-	cErr := C.run_cmd(C.CMD_RESTORE, 0, cUdid, cUdid, cBackupDir, 1, nil, nil)
+	cErr := C.run_devicebackup2(C.int(req.Cmd), C.int(req.Flags), cUdid, cBackupDir, cProgress)
 
-	if cErr < 0 {
-		return fmt.Errorf("devicebackup2 failed with error code %d", cErr)
+	if err := enc.Encode(&cmdMessage{Done: true, Code: int(cErr)}); err != nil {
+		return 1
 	}
 
-	return nil
+	return 0
 }
 
-// EnableBackupEncryption enables backup encryption interactively using devicebackup2
-func EnableBackupEncryption(deviceID DeviceID) error {
-	cUdid := C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cUdid))
+// runCmd runs a devicebackup2 command in a child process, which is killed if ctx is done
+func runCmd(ctx context.Context, op string, req *cmdRequest, progress BackupProgressFunc) error {
+	deviceID := req.DeviceID
 
-	cErr := C.run_cmd(C.CMD_CHANGEPW, C.CMD_FLAG_ENCRYPTION_ENABLE, cUdid, cUdid, nil, 1, nil, nil)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if cErr < 0 {
-		return fmt.Errorf("devicebackup2 failed with error code %d", cErr)
+	// devicebackup2 only returns an error code, so check the device can be reached first to report a more useful error
+	conn, err := connect(deviceID, op, true)
+	if err != nil {
+		return err
 	}
+	conn.close()
 
-	return nil
-}
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
 
-func getDeviceInfoBool(deviceID DeviceID, domain string, value string) (bool, error) {
-	var device C.idevice_t
-	var client C.lockdownd_client_t
-	var node C.plist_t
+	exe, err := os.Executable()
+	if err != nil {
+		return newError(op, deviceID, 0, fmt.Errorf("Failed to find executable: %s", err))
+	}
 
-	var cDeviceID *C.char = C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cDeviceID))
+	r, w, err := os.Pipe()
+	if err != nil {
+		return newError(op, deviceID, 0, err)
+	}
+	defer r.Close()
+
+	// Restoring and enabling encryption ask for the backup password
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", cmdEnv, encoded))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return newError(op, deviceID, 0, fmt.Errorf("Failed to start devicebackup2: %s", err))
+	}
 
-	err := C.idevice_new_with_options(&device, cDeviceID, C.IDEVICE_LOOKUP_USBMUX|C.IDEVICE_LOOKUP_NETWORK)
-	defer C.idevice_free(device)
-	if err < 0 {
-		return false, errors.New("Failed to retrieve device name (idevice_new_with_options)")
+	// The pipe is closed when the child process exits
+	result := &cmdMessage{}
+	dec := json.NewDecoder(r)
+	for {
+		m := &cmdMessage{}
+		if err := dec.Decode(m); err != nil {
+			break
+		}
+
+		if m.Progress != nil && progress != nil {
+			progress(*m.Progress)
+		}
+		if m.Done {
+			result = m
+		}
 	}
 
-	if device == nil {
-		return false, fmt.Errorf("No device with UDID (%s) is connected", deviceID)
+	waitErr := cmd.Wait()
+
+	// The child process was killed because ctx is done
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	var cLabel *C.char = C.CString("ipfs-ios-backup")
-	defer C.free(unsafe.Pointer(cLabel))
-	err1 := C.lockdownd_client_new_with_handshake(device, &client, cLabel)
-	defer C.lockdownd_client_free(client)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return false, fmt.Errorf("Failed to connect to device (%s)", deviceID)
+	if !result.Done {
+		return newError(op, deviceID, 0, fmt.Errorf("devicebackup2 exited unexpectedly: %v", waitErr))
 	}
 
-	var cDomain *C.char = C.CString(domain)
-	defer C.free(unsafe.Pointer(cDomain))
+	cErr := C.int(result.Code)
+	if cErr >= 0 {
+		return nil
+	}
 
-	var cValue *C.char = C.CString(value)
-	defer C.free(unsafe.Pointer(cValue))
+	// The device went away during the command
+	conn, err = connect(deviceID, op, false)
+	if err != nil {
+		return newError(op, deviceID, int(cErr), ErrTransportLost)
+	}
+	conn.close()
+
+	return devicebackup2Error(op, deviceID, cErr)
+}
 
-	err1 = C.lockdownd_get_value(client, cDomain, cValue, &node)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return false, fmt.Errorf("Failed to get lockdownd value (%s)", deviceID)
+// lockdownConnection is a connection to lockdownd on a device
+type lockdownConnection struct {
+	device C.idevice_t
+	client C.lockdownd_client_t
+}
+
+// connect connects to lockdownd on a device. With handshake a session is started, which requires the device to be paired
+func connect(deviceID DeviceID, op string, handshake bool) (*lockdownConnection, error) {
+	conn := &lockdownConnection{}
+
+	cDeviceID := C.CString(string(deviceID))
+	defer C.free(unsafe.Pointer(cDeviceID))
+
+	err := C.idevice_new_with_options(&conn.device, cDeviceID, C.IDEVICE_LOOKUP_USBMUX|C.IDEVICE_LOOKUP_NETWORK)
+	if err < 0 || conn.device == nil {
+		conn.close()
+		return nil, newError(op, deviceID, int(err), ErrDeviceNotFound)
 	}
 
-	var b C.uint8_t
-	C.plist_get_bool_val(node, &b)
+	cLabel := C.CString("ipfs-ios-backup")
+	defer C.free(unsafe.Pointer(cLabel))
 
-	if uint8(b) > 0 {
-		return true, nil
+	var lerr C.lockdownd_error_t
+	if handshake {
+		lerr = C.lockdownd_client_new_with_handshake(conn.device, &conn.client, cLabel)
 	} else {
-		return false, nil
+		lerr = C.lockdownd_client_new(conn.device, &conn.client, cLabel)
+	}
+	if lerr != C.LOCKDOWN_E_SUCCESS {
+		conn.close()
+		return nil, lockdownError(op, deviceID, lerr)
 	}
+
+	return conn, nil
 }
 
-func getDeviceInfoUInt64(deviceID DeviceID, domain string, value string) (uint64, error) {
-	var device C.idevice_t
-	var client C.lockdownd_client_t
-	var node C.plist_t
+func (c *lockdownConnection) close() {
+	if c.client != nil {
+		C.lockdownd_client_free(c.client)
+	}
+	if c.device != nil {
+		C.idevice_free(c.device)
+	}
+}
 
-	var cDeviceID *C.char = C.CString(string(deviceID))
-	defer C.free(unsafe.Pointer(cDeviceID))
+// getDeviceInfo gets a value from lockdownd. The value must be freed with plist_free
+func getDeviceInfo(deviceID DeviceID, domain string, key string) (C.plist_t, error) {
+	op := fmt.Sprintf("get %s", key)
 
-	err := C.idevice_new_with_options(&device, cDeviceID, C.IDEVICE_LOOKUP_USBMUX|C.IDEVICE_LOOKUP_NETWORK)
-	defer C.idevice_free(device)
-	if err < 0 {
-		return 0, errors.New("Failed to retrieve device name (idevice_new_with_options)")
+	conn, err := connect(deviceID, op, true)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.close()
+
+	cDomain := C.CString(domain)
+	defer C.free(unsafe.Pointer(cDomain))
+
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
 
-	if device == nil {
-		return 0, fmt.Errorf("No device with UDID (%s) is connected", deviceID)
+	var node C.plist_t
+	if lerr := C.lockdownd_get_value(conn.client, cDomain, cKey, &node); lerr != C.LOCKDOWN_E_SUCCESS {
+		return nil, lockdownError(op, deviceID, lerr)
 	}
 
-	var cLabel *C.char = C.CString("ipfs-ios-backup")
-	defer C.free(unsafe.Pointer(cLabel))
-	err1 := C.lockdownd_client_new_with_handshake(device, &client, cLabel)
-	defer C.lockdownd_client_free(client)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return 0, fmt.Errorf("Failed to connect to device (%s)", deviceID)
+	return node, nil
+}
+
+func getDeviceInfoBool(deviceID DeviceID, domain string, key string) (bool, error) {
+	node, err := getDeviceInfo(deviceID, domain, key)
+	if err != nil {
+		return false, err
 	}
+	defer C.plist_free(node)
 
-	var cDomain *C.char = C.CString(domain)
-	defer C.free(unsafe.Pointer(cDomain))
+	var b C.uint8_t
+	C.plist_get_bool_val(node, &b)
 
-	var cValue *C.char = C.CString(value)
-	defer C.free(unsafe.Pointer(cValue))
+	return uint8(b) > 0, nil
+}
 
-	err1 = C.lockdownd_get_value(client, cDomain, cValue, &node)
-	if err1 != C.LOCKDOWN_E_SUCCESS {
-		return 0, fmt.Errorf("Failed to get lockdownd value (%s)", deviceID)
+func getDeviceInfoUInt64(deviceID DeviceID, domain string, key string) (uint64, error) {
+	node, err := getDeviceInfo(deviceID, domain, key)
+	if err != nil {
+		return 0, err
 	}
+	defer C.plist_free(node)
 
 	var u C.uint64_t
 	C.plist_get_uint_val(node, &u)
 
 	return uint64(u), nil
 }
+
+// lockdownError maps a lockdownd error code to an Error
+func lockdownError(op string, deviceID DeviceID, code C.lockdownd_error_t) error {
+	var err error
+	switch code {
+	case C.LOCKDOWN_E_PASSWORD_PROTECTED, C.LOCKDOWN_E_ESCROW_LOCKED:
+		err = ErrPasscodeLocked
+	case C.LOCKDOWN_E_USER_DENIED_PAIRING:
+		err = ErrUserDeniedTrust
+	case C.LOCKDOWN_E_PAIRING_DIALOG_RESPONSE_PENDING, C.LOCKDOWN_E_PAIRING_FAILED, C.LOCKDOWN_E_SSL_ERROR,
+		C.LOCKDOWN_E_INVALID_HOST_ID, C.LOCKDOWN_E_MISSING_PAIR_RECORD, C.LOCKDOWN_E_INVALID_PAIR_RECORD:
+		err = ErrNotPaired
+	case C.LOCKDOWN_E_MUX_ERROR, C.LOCKDOWN_E_RECEIVE_TIMEOUT:
+		err = ErrTransportLost
+	case C.LOCKDOWN_E_SERVICE_LIMIT:
+		// Another session is already using the backup service
+		err = ErrBackupInProgress
+	default:
+		err = errors.New("lockdownd returned an error")
+	}
+
+	return newError(op, deviceID, int(code), err)
+}
+
+// The error code devicebackup2 reports when the backup directory runs out of space
+const deviceErrorNoSpace = -15
+
+// The error code devicebackup2 reports when the device refuses a backup because a configuration profile requires
+// backup encryption and it is not enabled
+const deviceErrorEncryptionRequired = -208
+
+// devicebackup2Error maps the result of run_cmd, which is a mobilebackup2 error code or the error code of a failed file operation, to an Error
+func devicebackup2Error(op string, deviceID DeviceID, code C.int) error {
+	var err error
+	switch code {
+	case C.MOBILEBACKUP2_E_MUX_ERROR, C.MOBILEBACKUP2_E_SSL_ERROR, C.MOBILEBACKUP2_E_RECEIVE_TIMEOUT:
+		err = ErrTransportLost
+	case deviceErrorNoSpace:
+		err = ErrDiskFull
+	case deviceErrorEncryptionRequired:
+		err = ErrEncryptionRequired
+	default:
+		err = errors.New("devicebackup2 returned an error")
+	}
+
+	return newError(op, deviceID, int(code), err)
+}
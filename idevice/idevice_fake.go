@@ -0,0 +1,38 @@
+//go:build nolibimobiledevice
+// +build nolibimobiledevice
+
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+// NewProvider creates a FakeProvider with a single simulated device, for builds without libimobiledevice
+func NewProvider() Provider {
+	return NewFakeProvider(FakeDevice{
+		Udid:         "00000000-0000000000000000",
+		Name:         "Simulated iPhone",
+		BatteryLevel: 100,
+		IsCharging:   true,
+		WillEncrypt:  true,
+		// Backups of the simulated device are encrypted with this password
+		BackupPassword: "simulated",
+	})
+}
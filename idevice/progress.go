@@ -0,0 +1,65 @@
+//go:build !nolibimobiledevice
+// +build !nolibimobiledevice
+
+/*
+Copyright © 2020 Cody Hatfield <cody.hatfield@me.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idevice
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+var (
+	// The callbacks of devicebackup2 have no user data, so progress is reported to the backup that is running
+	backupProgress BackupProgressFunc
+	backupState    BackupProgress
+)
+
+// startBackupProgress reports the progress of the next backup to progress
+func startBackupProgress(progress BackupProgressFunc) {
+	backupProgress = progress
+	backupState = BackupProgress{}
+}
+
+//export goBackupStatus
+func goBackupStatus(status *C.char, percent C.double) {
+	backupState.Phase = C.GoString(status)
+	backupState.Percent = float64(percent)
+	reportBackupProgress()
+}
+
+//export goBackupProgress
+func goBackupProgress(file *C.char, received C.uint64_t, total C.uint64_t) {
+	if file != nil {
+		backupState.File = C.GoString(file)
+	}
+	backupState.BytesReceived = uint64(received)
+	backupState.TotalBytes = uint64(total)
+	reportBackupProgress()
+}
+
+func reportBackupProgress() {
+	if backupProgress != nil {
+		backupProgress(backupState)
+	}
+}
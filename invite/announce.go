@@ -0,0 +1,104 @@
+package invite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// AnnounceProtocolID is the libp2p protocol new secrets are announced on when they are rotated
+const AnnounceProtocolID = protocol.ID("/ipfs-ios-backup/announce/1.0.0")
+
+// Announcements are small, so larger ones are refused
+const maxAnnouncementSize = 64 << 10
+
+// ErrNotTrusted is returned when a node refuses an announcement because it does not trust the sender
+var ErrNotTrusted = errors.New("Node does not trust this node")
+
+type announcement struct {
+	Payload []byte
+}
+
+type ack struct {
+	Error string
+}
+
+// Announce sends a payload to another node. Unlike invites, announcements are not protected by a code. Streams are
+// encrypted and authenticated by libp2p, so the receiving node decides whether to accept the payload by its sender
+func Announce(ctx context.Context, h host.Host, to peer.AddrInfo, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, to); err != nil {
+		return fmt.Errorf("Failed to connect to %s: %s", to.ID, err)
+	}
+
+	s, err := h.NewStream(ctx, to.ID, AnnounceProtocolID)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %s", to.ID, err)
+	}
+	defer s.Reset()
+
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	if err := json.NewEncoder(s).Encode(&announcement{Payload: payload}); err != nil {
+		return err
+	}
+
+	a := &ack{}
+	if err := json.NewDecoder(s).Decode(a); err != nil {
+		return fmt.Errorf("No reply from %s: %s", to.ID, err)
+	}
+
+	if a.Error == ErrNotTrusted.Error() {
+		return ErrNotTrusted
+	}
+	if a.Error != "" {
+		return errors.New(a.Error)
+	}
+
+	helpers.FullClose(s)
+
+	return nil
+}
+
+// HandleAnnouncements passes payloads announced by nodes that trusted returns true for to receive, until ctx is done
+func HandleAnnouncements(ctx context.Context, h host.Host, trusted func(peer.ID) bool, receive func(peer.ID, []byte) error) {
+	h.SetStreamHandler(AnnounceProtocolID, func(s network.Stream) {
+		s.SetDeadline(time.Now().Add(exchangeTimeout))
+
+		from := s.Conn().RemotePeer()
+		enc := json.NewEncoder(s)
+
+		a := &announcement{}
+		if err := json.NewDecoder(io.LimitReader(s, maxAnnouncementSize)).Decode(a); err != nil {
+			s.Reset()
+			return
+		}
+
+		reply := &ack{}
+		if !trusted(from) {
+			reply.Error = ErrNotTrusted.Error()
+		} else if err := receive(from, a.Payload); err != nil {
+			reply.Error = err.Error()
+		}
+
+		enc.Encode(reply)
+		helpers.FullClose(s)
+	})
+
+	go func() {
+		<-ctx.Done()
+		h.RemoveStreamHandler(AnnounceProtocolID)
+	}()
+}
@@ -0,0 +1,442 @@
+// Package invite hands the secrets of a thread to other nodes over libp2p. A new node is invited with a short code,
+// shared out of band. Both nodes prove that they know the code using SPAKE2, and the secrets are encrypted with the
+// key they agree on. Nodes that already trust each other announce rotated secrets directly
+package invite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// ProtocolID is the libp2p protocol invites are accepted on
+	ProtocolID = protocol.ID("/ipfs-ios-backup/invite/1.0.0")
+	// MaxAttempts is how many exchanges with a wrong code an invite allows before it is cancelled. An exchange
+	// counts once the joining node got the confirmation of this node, which lets it check a guess of the code
+	MaxAttempts = 3
+	// Nodes with open invites are advertised on the local network with this mDNS service
+	mdnsServiceTag = "ipfs-ios-backup-invite"
+	// How long an exchange can take
+	exchangeTimeout = 30 * time.Second
+	// The messages of the joining node are small, so larger exchanges are refused
+	maxExchangeSize = 4 << 10
+)
+
+var (
+	ErrInvalidCode     = errors.New("Invalid invite code, expected a code like 42-1234-5678")
+	ErrNoInvite        = errors.New("No open invite with this code")
+	ErrWrongCode       = errors.New("Wrong invite code")
+	ErrTooManyAttempts = errors.New("Invite cancelled after too many attempts with a wrong code")
+	ErrCancelled       = errors.New("Invite cancelled")
+)
+
+var codePattern = regexp.MustCompile(`^(\d{2})-\d{4}-\d{4}$`)
+
+// Messages of an exchange, in order
+type hello struct {
+	Nameplate string
+	Message   []byte
+}
+
+type reply struct {
+	Message      []byte
+	Confirmation []byte
+}
+
+type confirm struct {
+	Confirmation []byte
+}
+
+type sealedPayload struct {
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Invite offers a payload to the node that knows its code
+type Invite struct {
+	// Code is shared with the new node. The first part, the nameplate, tells invites of the same node apart
+	Code      string
+	nameplate string
+	payload   []byte
+	// Exchanges are made one at a time
+	exchange sync.Mutex
+	attempts int
+	done     chan struct{}
+	peer     peer.ID
+	err      error
+}
+
+// Wait waits until a node accepted the invite, the invite failed or ctx is done
+func (inv *Invite) Wait(ctx context.Context) (peer.ID, error) {
+	select {
+	case <-inv.done:
+		return inv.peer, inv.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Inviter accepts invites on a libp2p host
+type Inviter struct {
+	ctx     context.Context
+	host    host.Host
+	lock    sync.Mutex
+	invites map[string]*Invite
+	mdns    discovery.Service
+}
+
+// NewInviter accepts invites on a host until ctx is done
+func NewInviter(ctx context.Context, h host.Host) *Inviter {
+	i := &Inviter{
+		ctx:     ctx,
+		host:    h,
+		invites: map[string]*Invite{},
+	}
+	h.SetStreamHandler(ProtocolID, i.handle)
+
+	go func() {
+		<-ctx.Done()
+		h.RemoveStreamHandler(ProtocolID)
+	}()
+
+	return i
+}
+
+// Invite creates an invite for a payload with a new code
+func (i *Inviter) Invite(payload []byte) (*Invite, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(i.invites) >= 50 {
+		return nil, errors.New("Too many open invites")
+	}
+
+	var nameplate string
+	for {
+		n, err := randomNumber(90)
+		if err != nil {
+			return nil, err
+		}
+
+		nameplate = fmt.Sprintf("%02d", n+10)
+		if _, ok := i.invites[nameplate]; !ok {
+			break
+		}
+	}
+
+	secret1, err := randomNumber(10000)
+	if err != nil {
+		return nil, err
+	}
+	secret2, err := randomNumber(10000)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invite{
+		Code:      fmt.Sprintf("%s-%04d-%04d", nameplate, secret1, secret2),
+		nameplate: nameplate,
+		payload:   payload,
+		done:      make(chan struct{}),
+	}
+	i.invites[nameplate] = inv
+
+	// Nodes can still join with the address of this node if it can not be found on the local network
+	if i.mdns == nil {
+		if service, err := discovery.NewMdnsService(i.ctx, i.host, time.Minute, mdnsServiceTag); err == nil {
+			i.mdns = service
+		}
+	}
+
+	return inv, nil
+}
+
+// Cancel cancels an invite if it is still open
+func (i *Inviter) Cancel(inv *Invite) {
+	i.close(inv, "", ErrCancelled)
+}
+
+func (i *Inviter) close(inv *Invite, p peer.ID, err error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.invites[inv.nameplate] != inv {
+		return
+	}
+
+	delete(i.invites, inv.nameplate)
+	inv.peer = p
+	inv.err = err
+	close(inv.done)
+
+	if len(i.invites) == 0 && i.mdns != nil {
+		i.mdns.Close()
+		i.mdns = nil
+	}
+}
+
+func (i *Inviter) open(nameplate string) *Invite {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.invites[nameplate]
+}
+
+func (i *Inviter) handle(s network.Stream) {
+	s.SetDeadline(time.Now().Add(exchangeTimeout))
+
+	dec := json.NewDecoder(io.LimitReader(s, maxExchangeSize))
+
+	h := &hello{}
+	if err := dec.Decode(h); err != nil {
+		s.Reset()
+		return
+	}
+
+	inv := i.open(h.Nameplate)
+	if inv == nil {
+		s.Reset()
+		return
+	}
+
+	inv.exchange.Lock()
+	defer inv.exchange.Unlock()
+
+	// The invite may have been accepted by an exchange that was made at the same time
+	if i.open(h.Nameplate) != inv {
+		s.Reset()
+		return
+	}
+
+	guessed, err := i.exchange(inv, s, dec, h)
+	if err != nil {
+		s.Reset()
+
+		// Exchanges that failed before the joining node could check its code, e.g. with an invalid message or a
+		// dropped connection, are not attempts
+		if !guessed {
+			return
+		}
+
+		inv.attempts++
+		if inv.attempts >= MaxAttempts {
+			i.close(inv, "", ErrTooManyAttempts)
+		}
+		return
+	}
+
+	helpers.FullClose(s)
+	i.close(inv, s.Conn().RemotePeer(), nil)
+}
+
+// exchange agrees on a key with the joining node, and sends it the payload once it proved it knows the code.
+// guessed is true if it failed after the confirmation of this node was sent, so the joining node could check a
+// wrong code against it
+func (i *Inviter) exchange(inv *Invite, s network.Stream, dec *json.Decoder, h *hello) (guessed bool, err error) {
+	enc := json.NewEncoder(s)
+
+	pake, err := newSPAKE2(roleB, inv.Code, []byte(s.Conn().RemotePeer()), []byte(i.host.ID()))
+	if err != nil {
+		return false, err
+	}
+
+	keys, err := pake.finish(h.Message)
+	if err != nil {
+		return false, err
+	}
+
+	if err := enc.Encode(&reply{Message: pake.message(), Confirmation: keys.confirmation()}); err != nil {
+		return true, err
+	}
+
+	// A joining node with a wrong code does not send its confirmation
+	c := &confirm{}
+	if err := dec.Decode(c); err != nil {
+		return true, ErrWrongCode
+	}
+
+	if !keys.verify(c.Confirmation) {
+		return true, ErrWrongCode
+	}
+
+	sealed, err := seal(keys, inv.payload)
+	if err != nil {
+		return false, err
+	}
+
+	return false, enc.Encode(sealed)
+}
+
+// CheckCode returns ErrInvalidCode if code is not formatted like an invite code
+func CheckCode(code string) error {
+	if !codePattern.MatchString(code) {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// Join accepts the invite of a node with a code, and returns its payload
+func Join(ctx context.Context, h host.Host, inviter peer.AddrInfo, code string) ([]byte, error) {
+	m := codePattern.FindStringSubmatch(code)
+	if m == nil {
+		return nil, ErrInvalidCode
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, inviter); err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %s", inviter.ID, err)
+	}
+
+	s, err := h.NewStream(ctx, inviter.ID, ProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %s", inviter.ID, err)
+	}
+	defer s.Reset()
+
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	enc, dec := json.NewEncoder(s), json.NewDecoder(s)
+
+	pake, err := newSPAKE2(roleA, code, []byte(h.ID()), []byte(inviter.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enc.Encode(&hello{Nameplate: m[1], Message: pake.message()}); err != nil {
+		return nil, err
+	}
+
+	// The inviting node closes the stream if it has no invite with the nameplate
+	r := &reply{}
+	if err := dec.Decode(r); err != nil {
+		return nil, ErrNoInvite
+	}
+
+	keys, err := pake.finish(r.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !keys.verify(r.Confirmation) {
+		return nil, ErrWrongCode
+	}
+
+	if err := enc.Encode(&confirm{Confirmation: keys.confirmation()}); err != nil {
+		return nil, err
+	}
+
+	sealed := &sealedPayload{}
+	if err := dec.Decode(sealed); err != nil {
+		return nil, fmt.Errorf("Failed to receive secrets: %s", err)
+	}
+
+	payload, err := open(keys, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	helpers.FullClose(s)
+
+	return payload, nil
+}
+
+// Discover finds nodes with open invites on the local network until ctx is done
+func Discover(ctx context.Context, h host.Host) (<-chan peer.AddrInfo, error) {
+	service, err := discovery.NewMdnsService(ctx, h, 2*time.Second, mdnsServiceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(notifee, 16)
+	service.RegisterNotifee(found)
+
+	go func() {
+		<-ctx.Done()
+		service.Close()
+	}()
+
+	return found, nil
+}
+
+type notifee chan peer.AddrInfo
+
+func (n notifee) HandlePeerFound(info peer.AddrInfo) {
+	select {
+	case n <- info:
+	default:
+	}
+}
+
+func seal(keys *sessionKeys, payload []byte) (*sealedPayload, error) {
+	key, err := keys.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &sealedPayload{
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, payload, nil),
+	}, nil
+}
+
+func open(keys *sessionKeys, sealed *sealedPayload) ([]byte, error) {
+	key, err := keys.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid secrets")
+	}
+
+	payload, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt secrets: %s", err)
+	}
+
+	return payload, nil
+}
+
+func randomNumber(max int64) (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0, err
+	}
+
+	return n.Int64(), nil
+}
@@ -0,0 +1,307 @@
+package invite
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func newHost(t *testing.T, ctx context.Context) host.Host {
+	t.Helper()
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	return h
+}
+
+// newInvite creates an invite for payload on one host, and returns another host to join it from
+func newInvite(t *testing.T, payload []byte) (*Invite, host.Host, peer.AddrInfo) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	inviting := newHost(t, ctx)
+	joining := newHost(t, ctx)
+
+	inv, err := NewInviter(ctx, inviting).Invite(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return inv, joining, peer.AddrInfo{ID: inviting.ID(), Addrs: inviting.Addrs()}
+}
+
+// wrongCode returns a code with the nameplate of code and a different secret
+func wrongCode(code string) string {
+	if strings.HasSuffix(code, "0000") {
+		return code[:len(code)-4] + "0001"
+	}
+
+	return code[:len(code)-4] + "0000"
+}
+
+func wait(t *testing.T, inv *Invite) (peer.ID, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return inv.Wait(ctx)
+}
+
+func TestInviteAndJoin(t *testing.T) {
+	payload := []byte(`{"ThreadKey": "secret"}`)
+	inv, joining, inviting := newInvite(t, payload)
+
+	if err := CheckCode(inv.Code); err != nil {
+		t.Fatalf("invite has code %s: %s", inv.Code, err)
+	}
+
+	got, err := Join(context.Background(), joining, inviting, inv.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Join returned %q, want %q", got, payload)
+	}
+
+	p, err := wait(t, inv)
+	if err != nil || p != joining.ID() {
+		t.Errorf("Wait returned %s %v, want %s", p, err, joining.ID())
+	}
+
+	// Each code can be used once
+	if _, err := Join(context.Background(), joining, inviting, inv.Code); err != ErrNoInvite {
+		t.Errorf("second Join returned %v, want %v", err, ErrNoInvite)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	inv, joining, inviting := newInvite(t, []byte("payload"))
+
+	otherNameplate := "10"
+	if inv.nameplate == otherNameplate {
+		otherNameplate = "11"
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want error
+	}{
+		{"invalid code", "1234", ErrInvalidCode},
+		{"no invite with the nameplate", otherNameplate + "-0000-0000", ErrNoInvite},
+		{"wrong code", wrongCode(inv.Code), ErrWrongCode},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Join(context.Background(), joining, inviting, test.code); err != test.want {
+				t.Errorf("Join returned %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	// The invite is still open after one wrong code
+	if _, err := Join(context.Background(), joining, inviting, inv.Code); err != nil {
+		t.Errorf("Join with the right code after a wrong one returned %v", err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	inv, joining, inviting := newInvite(t, []byte("payload"))
+
+	for i := 0; i < MaxAttempts; i++ {
+		if _, err := Join(context.Background(), joining, inviting, wrongCode(inv.Code)); err != ErrWrongCode {
+			t.Fatalf("Join %d returned %v, want %v", i, err, ErrWrongCode)
+		}
+	}
+
+	if _, err := wait(t, inv); err != ErrTooManyAttempts {
+		t.Fatalf("Wait returned %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	if _, err := Join(context.Background(), joining, inviting, inv.Code); err != ErrNoInvite {
+		t.Errorf("Join with the right code after the invite was cancelled returned %v, want %v", err, ErrNoInvite)
+	}
+}
+
+func TestFailedExchangesAreNotAttempts(t *testing.T) {
+	inv, joining, inviting := newInvite(t, []byte("payload"))
+
+	ctx := context.Background()
+	if err := joining.Connect(ctx, inviting); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exchanges that end before the joining node gets a confirmation can not check a guess of the code
+	for i := 0; i < MaxAttempts+1; i++ {
+		s, err := joining.NewStream(ctx, inviting.ID, ProtocolID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.NewEncoder(s).Encode(&hello{Nameplate: inv.nameplate, Message: []byte("not a point")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The stream is reset by the inviting node
+		if err := json.NewDecoder(s).Decode(&reply{}); err == nil {
+			t.Fatal("an invalid message got a reply")
+		}
+		s.Close()
+	}
+
+	if _, err := Join(ctx, joining, inviting, inv.Code); err != nil {
+		t.Errorf("Join after failed exchanges returned %v", err)
+	}
+}
+
+func TestLargeHelloIsRefused(t *testing.T) {
+	inv, joining, inviting := newInvite(t, []byte("payload"))
+
+	ctx := context.Background()
+	if err := joining.Connect(ctx, inviting); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := joining.NewStream(ctx, inviting.ID, ProtocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pake, err := newSPAKE2(roleA, inv.Code, []byte(joining.ID()), []byte(inviting.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A hello that is valid apart from its size
+	large := map[string]interface{}{
+		"Nameplate": inv.nameplate,
+		"Message":   pake.message(),
+		"Padding":   strings.Repeat("x", maxExchangeSize),
+	}
+
+	// The inviting node stops reading at the limit, so the rest of the hello may not be written
+	json.NewEncoder(s).Encode(large)
+
+	if err := json.NewDecoder(s).Decode(&reply{}); err == nil {
+		t.Fatal("a hello larger than the limit got a reply")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inviter := NewInviter(ctx, newHost(t, ctx))
+	inv, err := inviter.Invite([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inviter.Cancel(inv)
+
+	if _, err := wait(t, inv); err != ErrCancelled {
+		t.Errorf("Wait returned %v, want %v", err, ErrCancelled)
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// TestSPAKE2KnownAnswer checks the exchange against the test vector of SPAKE2-P256-SHA256-HKDF-HMAC in RFC 9382
+func TestSPAKE2KnownAnswer(t *testing.T) {
+	w, _ := new(big.Int).SetString("2ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a5f", 16)
+	x := decodeHex(t, "43dd0fd7215bdcb482879fca3220c6a968e66d70b1356cac18bb26c84a78d729")
+	y := decodeHex(t, "dcb60106f276b02606d8ef0a328c02e4b629f84f89786af5befb0bc75b6e66be")
+
+	pA := decodeHex(t, "04a56fa807caaa53a4d28dbb9853b9815c61a411118a6fe516a8798434751470f9010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb4116988ede5f912c")
+	pB := decodeHex(t, "0406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d09857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b7")
+	ke := decodeHex(t, "0e0672dc86f8e45565d338b0540abe69")
+	confirmA := decodeHex(t, "58ad4aa88e0b60d5061eb6b5dd93e80d9c4f00d127c65b3b35b1b5281fee38f0")
+	confirmB := decodeHex(t, "d3e2e547f1ae04f2dbdbf0fc4b79f8ecff2dff314b5d32fe9fcef2fb26dc459b")
+
+	a := newSPAKE2WithScalars(roleA, w, x, []byte("server"), []byte("client"))
+	b := newSPAKE2WithScalars(roleB, w, y, []byte("server"), []byte("client"))
+
+	if !bytes.Equal(a.message(), pA) {
+		t.Errorf("pA is %x, want %x", a.message(), pA)
+	}
+	if !bytes.Equal(b.message(), pB) {
+		t.Errorf("pB is %x, want %x", b.message(), pB)
+	}
+
+	keysA, err := a.finish(b.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysB, err := b.finish(a.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range []*sessionKeys{keysA, keysB} {
+		if !bytes.Equal(keys.key, ke) || !bytes.Equal(keys.confirmA, confirmA) || !bytes.Equal(keys.confirmB, confirmB) {
+			t.Errorf("keys are %x %x %x, want %x %x %x", keys.key, keys.confirmA, keys.confirmB, ke, confirmA, confirmB)
+		}
+	}
+
+	if !keysA.verify(keysB.confirmation()) || !keysB.verify(keysA.confirmation()) {
+		t.Error("confirmations do not verify")
+	}
+	if keysA.verify(keysA.confirmation()) {
+		t.Error("a side accepted its own confirmation")
+	}
+}
+
+func TestSPAKE2WrongCode(t *testing.T) {
+	a, err := newSPAKE2(roleA, "42-1234-5678", []byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSPAKE2(roleB, "42-1234-5679", []byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysA, err := a.finish(b.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysB, err := b.finish(a.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keysA.verify(keysB.confirmation()) || keysB.verify(keysA.confirmation()) {
+		t.Error("confirmations verify with different codes")
+	}
+
+	if _, err := a.finish([]byte("not a point")); err != errInvalidMessage {
+		t.Errorf("finish of an invalid message returned %v, want %v", err, errInvalidMessage)
+	}
+}
@@ -0,0 +1,238 @@
+package invite
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SPAKE2 over P-256 with SHA-256, HKDF and HMAC, as in RFC 9382
+
+var curve = elliptic.P256()
+
+// M and N are the points of RFC 9382 for P-256. Nobody knows their discrete logarithms
+var (
+	pointM = mustDecompress("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	pointN = mustDecompress("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+var errInvalidMessage = errors.New("invalid key exchange message")
+
+type point struct {
+	x, y *big.Int
+}
+
+type role int
+
+const (
+	// The joining node is A and the inviting node is B
+	roleA role = iota
+	roleB
+)
+
+// spake2 is one side of a key exchange based on a shared code
+type spake2 struct {
+	role     role
+	idA, idB []byte
+	w        *big.Int
+	secret   []byte
+	msg      []byte
+}
+
+// sessionKeys are the keys both sides agree on if they used the same code
+type sessionKeys struct {
+	key      []byte
+	confirmA []byte
+	confirmB []byte
+	role     role
+}
+
+func newSPAKE2(r role, code string, idA []byte, idB []byte) (*spake2, error) {
+	// The code is only ever used in the exchange, so guessing it requires one exchange per guess
+	h := sha256.Sum256([]byte(code))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(h[:]), curve.Params().N)
+
+	secret, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSPAKE2WithScalars(r, w, secret, idA, idB), nil
+}
+
+// newSPAKE2WithScalars starts a key exchange with the scalar derived from the code and the secret scalar of this side
+func newSPAKE2WithScalars(r role, w *big.Int, secret []byte, idA []byte, idB []byte) *spake2 {
+	blind := pointM
+	if r == roleB {
+		blind = pointN
+	}
+
+	x, y := curve.ScalarBaseMult(secret)
+	bx, by := curve.ScalarMult(blind.x, blind.y, scalarBytes(w))
+	x, y = curve.Add(x, y, bx, by)
+
+	return &spake2{
+		role:   r,
+		idA:    idA,
+		idB:    idB,
+		w:      w,
+		secret: secret,
+		msg:    elliptic.Marshal(curve, x, y),
+	}
+}
+
+// message is the message to send to the other side
+func (s *spake2) message() []byte {
+	return s.msg
+}
+
+// finish derives the session keys from the message of the other side
+func (s *spake2) finish(peerMsg []byte) (*sessionKeys, error) {
+	px, py := elliptic.Unmarshal(curve, peerMsg)
+	if px == nil {
+		return nil, errInvalidMessage
+	}
+
+	// Remove the blinding of the other side
+	blind := pointN
+	if s.role == roleB {
+		blind = pointM
+	}
+	bx, by := curve.ScalarMult(blind.x, blind.y, scalarBytes(s.w))
+	by = new(big.Int).Sub(curve.Params().P, by)
+
+	kx, ky := curve.Add(px, py, bx, by)
+	kx, ky = curve.ScalarMult(kx, ky, s.secret)
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, errInvalidMessage
+	}
+
+	pA, pB := s.msg, peerMsg
+	if s.role == roleB {
+		pA, pB = peerMsg, s.msg
+	}
+
+	var tt []byte
+	for _, v := range [][]byte{s.idA, s.idB, pA, pB, elliptic.Marshal(curve, kx, ky), scalarBytes(s.w)} {
+		tt = appendPrefixed(tt, v)
+	}
+
+	hash := sha256.Sum256(tt)
+	ke, ka := hash[:16], hash[16:]
+
+	kc := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ka, nil, []byte("ConfirmationKeys")), kc); err != nil {
+		return nil, err
+	}
+
+	return &sessionKeys{
+		key:      ke,
+		confirmA: mac(kc[:16], tt),
+		confirmB: mac(kc[16:], tt),
+		role:     s.role,
+	}, nil
+}
+
+// confirmation proves to the other side that this side used the same code
+func (k *sessionKeys) confirmation() []byte {
+	if k.role == roleA {
+		return k.confirmA
+	}
+
+	return k.confirmB
+}
+
+// verify checks the confirmation of the other side
+func (k *sessionKeys) verify(confirmation []byte) bool {
+	if k.role == roleA {
+		return hmac.Equal(confirmation, k.confirmB)
+	}
+
+	return hmac.Equal(confirmation, k.confirmA)
+}
+
+// encryptionKey derives a 256 bit key for encrypting messages with the session key
+func (k *sessionKeys) encryptionKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.key, nil, []byte("ipfs-ios-backup invite")), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+func appendPrefixed(b []byte, v []byte) []byte {
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(v)))
+
+	return append(append(b, l[:]...), v...)
+}
+
+func randomScalar() ([]byte, error) {
+	for {
+		k, err := rand.Int(rand.Reader, curve.Params().N)
+		if err != nil {
+			return nil, err
+		}
+
+		if k.Sign() > 0 {
+			return scalarBytes(k), nil
+		}
+	}
+}
+
+// scalarBytes encodes a scalar as 32 big-endian bytes
+func scalarBytes(k *big.Int) []byte {
+	b := make([]byte, 32)
+	v := k.Bytes()
+	copy(b[32-len(v):], v)
+
+	return b
+}
+
+// mustDecompress decodes a compressed SEC1 point
+func mustDecompress(s string) point {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 33 || (b[0] != 2 && b[0] != 3) {
+		panic("invalid point " + s)
+	}
+
+	params := curve.Params()
+	x := new(big.Int).SetBytes(b[1:])
+
+	// y² = x³ - 3x + b
+	y2 := new(big.Int).Exp(x, big.NewInt(3), params.P)
+	y2.Sub(y2, new(big.Int).Mul(x, big.NewInt(3)))
+	y2.Add(y2, params.B)
+	y2.Mod(y2, params.P)
+
+	// p = 3 mod 4, so the square root is y2^((p+1)/4)
+	exp := new(big.Int).Add(params.P, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(y2, exp, params.P)
+
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(params.P, y)
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		panic("invalid point " + s)
+	}
+
+	return point{x, y}
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+// Files of encrypted backups are encrypted with AES-256 in CBC mode with a zero IV
+var zeroIV = make([]byte, aes.BlockSize)
+
+// Size of the chunks encrypted files are decrypted in
+const decryptChunkSize = 64 * 1024
+
+// UnlockKeybag reads the keybag of an encrypted backup from Manifest.plist and unlocks it with the backup password
+func UnlockKeybag(manifest *Manifest, password string) (*Keybag, error) {
+	if len(manifest.BackupKeyBag) == 0 {
+		return nil, fmt.Errorf("Manifest.plist has no keybag")
+	}
+
+	keybag, err := ParseKeybag(manifest.BackupKeyBag)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := keybag.Unlock(password); err != nil {
+		return nil, err
+	}
+
+	return keybag, nil
+}
+
+// decryptManifestDB decrypts Manifest.db of an encrypted backup in memory
+func decryptManifestDB(manifest *Manifest, keybag *Keybag, data []byte) ([]byte, error) {
+	key, err := keybag.UnwrapKey(manifest.ManifestKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt Manifest.db: %s", err)
+	}
+
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Failed to decrypt Manifest.db: not a multiple of the block size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, zeroIV).CryptBlocks(plaintext, data)
+
+	return plaintext, nil
+}
+
+// NewDecryptReader decrypts the contents of an encrypted file read from r.
+// The padding is removed by stopping after size bytes
+func NewDecryptReader(r io.Reader, key []byte, size uint64) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:         r,
+		mode:      cipher.NewCBCDecrypter(block, zeroIV),
+		remaining: size,
+		chunk:     make([]byte, decryptChunkSize),
+	}, nil
+}
+
+type decryptReader struct {
+	r    io.Reader
+	mode cipher.BlockMode
+	// remaining is the number of plaintext bytes that have not been decrypted yet
+	remaining uint64
+	chunk     []byte
+	// buf holds decrypted bytes that have not been read yet
+	buf []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.r, d.chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, fmt.Errorf("encrypted file is truncated")
+			}
+			return 0, err
+		}
+		if n%aes.BlockSize != 0 {
+			return 0, fmt.Errorf("encrypted file is not a multiple of the block size")
+		}
+
+		d.mode.CryptBlocks(d.chunk[:n], d.chunk[:n])
+		d.buf = d.chunk[:n]
+		if uint64(n) > d.remaining {
+			d.buf = d.buf[:d.remaining]
+		}
+		d.remaining -= uint64(len(d.buf))
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return n, nil
+}
+
+// Encrypt encrypts the contents of a file the way devicebackup2 does, padding them to the block size.
+// It is the inverse of NewDecryptReader, e.g. to simulate an encrypted backup
+func Encrypt(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	ciphertext := make([]byte, len(data)+padding)
+	copy(ciphertext, data)
+	for i := len(data); i < len(ciphertext); i++ {
+		ciphertext[i] = byte(padding)
+	}
+
+	cipher.NewCBCEncrypter(block, zeroIV).CryptBlocks(ciphertext, ciphertext)
+
+	return ciphertext, nil
+}
@@ -0,0 +1,509 @@
+package manifest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	// Manifest.db is a SQLite database
+	_ "github.com/mattn/go-sqlite3"
+	"howett.net/plist"
+)
+
+// Flags of a file in Manifest.db
+const (
+	FlagFile      = 1
+	FlagDirectory = 2
+	FlagSymlink   = 4
+)
+
+var (
+	// ErrNotFound is returned when a file is not in a backup
+	ErrNotFound = errors.New("file not found in backup")
+	// ErrEncrypted is returned when opening Manifest.db of an encrypted backup without a password
+	ErrEncrypted = errors.New("backup is encrypted, a password is required")
+)
+
+// File is an entry of the Files table of Manifest.db
+type File struct {
+	// FileID is the SHA-1 of "Domain-RelativePath"
+	FileID       string
+	Domain       string
+	RelativePath string
+	Flags        int
+	Size         uint64
+	Mode         uint32
+	LastModified time.Time
+	// ProtectionClass and EncryptionKey are only set in encrypted backups
+	ProtectionClass uint32
+	EncryptionKey   []byte
+}
+
+// Path returns the path of a file as "Domain/RelativePath"
+func (f File) Path() string {
+	if f.RelativePath == "" {
+		return f.Domain
+	}
+
+	return f.Domain + "/" + f.RelativePath
+}
+
+// ContentPath returns the path of the contents of a file within the backup.
+// Directories that are only the parent of other files have no contents
+func (f File) ContentPath() string {
+	if len(f.FileID) < 2 {
+		return ""
+	}
+
+	return f.FileID[:2] + "/" + f.FileID
+}
+
+// IsDir returns true if the file is a directory
+func (f File) IsDir() bool {
+	return f.Flags == FlagDirectory
+}
+
+// SplitPath splits a "Domain/relative/path" into its domain and relative path
+func SplitPath(p string) (domain string, relativePath string) {
+	p = strings.Trim(p, "/")
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// Schema of the Files table, which is all that is read from Manifest.db
+const createFilesTable = "CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB)"
+
+// DB is an open Manifest.db
+type DB struct {
+	db *sql.DB
+	// Copy of Manifest.db that is removed when the DB is closed
+	tempPath string
+	// keybag is the unlocked keybag of an encrypted backup
+	keybag *Keybag
+}
+
+// OpenDB opens Manifest.db of a backup read only.
+// Manifest.db of a backup that is not in a local directory is copied to a temporary file first.
+// Encrypted backups are decrypted with password and read into memory, so their contents are never written to disk
+func OpenDB(src Source, password string) (*DB, error) {
+	manifest, err := ReadManifest(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.IsEncrypted {
+		if password == "" {
+			return nil, ErrEncrypted
+		}
+
+		return openEncryptedDB(src, manifest, password)
+	}
+
+	if dir, ok := src.(Dir); ok {
+		return openDB(filepath.Join(string(dir), "Manifest.db"), "")
+	}
+
+	data, err := src.ReadFile("Manifest.db")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+
+	f, err := ioutil.TempFile("", "Manifest.*.db")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return openDB(f.Name(), f.Name())
+}
+
+func openDB(path string, tempPath string) (*DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open Manifest.db: %s", err)
+	}
+
+	return &DB{
+		db:       db,
+		tempPath: tempPath,
+	}, nil
+}
+
+// openEncryptedDB decrypts Manifest.db and copies its files into an in-memory database
+func openEncryptedDB(src Source, manifest *Manifest, password string) (*DB, error) {
+	keybag, err := UnlockKeybag(manifest, password)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := src.ReadFile("Manifest.db")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+
+	data, err = decryptManifestDB(manifest, keybag, data)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := newSQLiteFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open Manifest.db: %s", err)
+	}
+	// Every connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+
+	if err := copyFiles(db, file); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+
+	return &DB{
+		db:     db,
+		keybag: keybag,
+	}, nil
+}
+
+func copyFiles(db *sql.DB, file *sqliteFile) error {
+	if _, err := db.Exec(createFilesTable); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO Files (fileID, domain, relativePath, flags, file) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// The columns are in the order of the schema devicebackup2 uses
+	err = file.readTable("Files", func(row []interface{}) error {
+		if len(row) < 5 {
+			return fmt.Errorf("Files has %v columns, expected 5", len(row))
+		}
+
+		_, err := stmt.Exec(row[:5]...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IsEncrypted returns true if the backup is encrypted
+func (d *DB) IsEncrypted() bool {
+	return d.keybag != nil
+}
+
+// Decrypt returns the contents of a file, given r, the file as it is stored in the backup.
+// Files of unencrypted backups are returned as is
+func (d *DB) Decrypt(f File, r io.Reader) (io.Reader, error) {
+	if d.keybag == nil {
+		return r, nil
+	}
+
+	if len(f.EncryptionKey) == 0 {
+		return nil, fmt.Errorf("%s has no encryption key", f.Path())
+	}
+
+	key, err := d.keybag.UnwrapKey(f.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt %s: %s", f.Path(), err)
+	}
+
+	return NewDecryptReader(r, key, f.Size)
+}
+
+// Close closes the database
+func (d *DB) Close() error {
+	err := d.db.Close()
+	if d.tempPath != "" {
+		os.Remove(d.tempPath)
+	}
+
+	return err
+}
+
+// Files lists every file, directory and symlink in the backup, sorted by domain and path
+func (d *DB) Files() ([]File, error) {
+	return d.query("SELECT fileID, domain, relativePath, flags, file FROM Files ORDER BY domain, relativePath")
+}
+
+// Find finds a file by its "Domain/relative/path"
+func (d *DB) Find(p string) (*File, error) {
+	domain, relativePath := SplitPath(p)
+	files, err := d.query("SELECT fileID, domain, relativePath, flags, file FROM Files WHERE domain = ? AND relativePath = ?", domain, relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &files[0], nil
+}
+
+// List lists the files below dir, a "Domain/relative/path", sorted by path.
+// If dir is empty, the domains are listed as directories.
+// Unless recursive, only the direct children of dir are listed, including directories that only exist as the parent of other files
+func (d *DB) List(dir string, recursive bool) ([]File, error) {
+	domain, _ := SplitPath(dir)
+
+	var all []File
+	var err error
+	if domain == "" {
+		all, err = d.Files()
+	} else {
+		all, err = d.query("SELECT fileID, domain, relativePath, flags, file FROM Files WHERE domain = ? ORDER BY relativePath", domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []File
+	children := map[string]bool{}
+	for _, f := range all {
+		p := f.Path()
+		if !strings.HasPrefix(p, prefix) || p == strings.TrimSuffix(prefix, "/") {
+			continue
+		}
+
+		if recursive {
+			files = append(files, f)
+			continue
+		}
+
+		// Only keep the first component below dir
+		name := strings.SplitN(strings.TrimPrefix(p, prefix), "/", 2)[0]
+		if children[name] {
+			continue
+		}
+		children[name] = true
+
+		if prefix+name != p {
+			childDomain, childPath := SplitPath(prefix + name)
+			f = File{Domain: childDomain, RelativePath: childPath, Flags: FlagDirectory}
+		}
+		files = append(files, f)
+	}
+
+	// dir is a file or does not exist
+	if prefix != "" && len(files) == 0 {
+		f, err := d.Find(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if !f.IsDir() {
+			files = append(files, *f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path() < files[j].Path()
+	})
+
+	return files, nil
+}
+
+// DomainFileCounts counts the files in each domain
+func (d *DB) DomainFileCounts() (map[string]uint64, error) {
+	rows, err := d.db.Query("SELECT domain, COUNT(*) FROM Files WHERE flags = ? GROUP BY domain", FlagFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]uint64{}
+	for rows.Next() {
+		var domain string
+		var count uint64
+		if err := rows.Scan(&domain, &count); err != nil {
+			return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+		}
+
+		counts[domain] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (d *DB) query(query string, args ...interface{}) ([]File, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		var blob []byte
+		if err := rows.Scan(&f.FileID, &f.Domain, &f.RelativePath, &f.Flags, &blob); err != nil {
+			return nil, fmt.Errorf("Failed to read Manifest.db: %s", err)
+		}
+
+		// The metadata of a file is not needed to find it, so a file with unreadable metadata is still listed
+		readFileMetadata(blob, &f)
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// keyedArchive is a plist written by NSKeyedArchiver
+type keyedArchive struct {
+	Archiver string               `plist:"$archiver"`
+	Version  uint64               `plist:"$version"`
+	Top      map[string]plist.UID `plist:"$top"`
+	Objects  []interface{}        `plist:"$objects"`
+}
+
+// readFileMetadata reads the size, mode and modification time of a file from its MBFile archive
+func readFileMetadata(blob []byte, f *File) error {
+	if len(blob) == 0 {
+		return nil
+	}
+
+	archive := &keyedArchive{}
+	if _, err := plist.Unmarshal(blob, archive); err != nil {
+		return err
+	}
+
+	root, ok := archive.Top["root"]
+	if !ok || int(root) >= len(archive.Objects) {
+		return fmt.Errorf("MBFile archive has no root object")
+	}
+
+	object, ok := archive.Objects[root].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("MBFile archive root is not an object")
+	}
+
+	f.Size = plistUint(object["Size"])
+	f.Mode = uint32(plistUint(object["Mode"]))
+	if t := plistUint(object["LastModified"]); t > 0 {
+		f.LastModified = time.Unix(int64(t), 0)
+	}
+	f.ProtectionClass = uint32(plistUint(object["ProtectionClass"]))
+
+	// The encryption key is an NSData object
+	if uid, ok := object["EncryptionKey"].(plist.UID); ok && int(uid) < len(archive.Objects) {
+		if data, ok := archive.Objects[uid].(map[string]interface{}); ok {
+			f.EncryptionKey, _ = data["NS.data"].([]byte)
+		}
+	}
+
+	return nil
+}
+
+func plistUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+
+	return 0
+}
+
+// WriteDB creates a Manifest.db containing files, e.g. to simulate a backup
+func WriteDB(path string, files []File) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(createFilesTable); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		object := map[string]interface{}{
+			"Size":         f.Size,
+			"Mode":         uint64(f.Mode),
+			"LastModified": uint64(f.LastModified.Unix()),
+			"RelativePath": plist.UID(3),
+			"$class":       plist.UID(2),
+		}
+		objects := []interface{}{
+			"$null",
+			object,
+			map[string]interface{}{
+				"$classname": "MBFile",
+				"$classes":   []string{"MBFile", "NSObject"},
+			},
+			f.RelativePath,
+		}
+
+		if len(f.EncryptionKey) > 0 {
+			object["ProtectionClass"] = uint64(f.ProtectionClass)
+			object["EncryptionKey"] = plist.UID(4)
+			objects = append(objects,
+				map[string]interface{}{
+					"NS.data": f.EncryptionKey,
+					"$class":  plist.UID(5),
+				},
+				map[string]interface{}{
+					"$classname": "NSMutableData",
+					"$classes":   []string{"NSMutableData", "NSData", "NSObject"},
+				},
+			)
+		}
+
+		blob, err := plist.Marshal(&keyedArchive{
+			Archiver: "NSKeyedArchiver",
+			Version:  100000,
+			Top:      map[string]plist.UID{"root": 1},
+			Objects:  objects,
+		}, plist.BinaryFormat)
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.Exec("INSERT INTO Files (fileID, domain, relativePath, flags, file) VALUES (?, ?, ?, ?, ?)", f.FileID, f.Domain, f.RelativePath, f.Flags, blob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,340 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrWrongPassword is returned when the keybag of a backup can not be unlocked with a password
+var ErrWrongPassword = errors.New("wrong backup password")
+
+// Class keys wrapped with the key derived from the backup password
+const wrapPasscode = 2
+
+// Initial value of RFC 3394 key wrapping
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// Keybag holds the class keys that protect the files of an encrypted backup.
+// It is stored in Manifest.plist as BackupKeyBag
+type Keybag struct {
+	UUID []byte
+	Type uint32
+	Wrap uint32
+
+	salt       []byte
+	iterations uint32
+	// Salt and iterations of the first round of key derivation, used since iOS 10.2
+	dpsl []byte
+	dpic uint32
+
+	classKeys map[uint32]*classKey
+}
+
+type classKey struct {
+	uuid    []byte
+	class   uint32
+	wrap    uint32
+	keyType uint32
+	wrapped []byte
+	// key is the unwrapped key, set once the keybag is unlocked
+	key []byte
+}
+
+// ParseKeybag parses the TLV encoded keybag of a backup
+func ParseKeybag(data []byte) (*Keybag, error) {
+	k := &Keybag{
+		classKeys: map[uint32]*classKey{},
+	}
+
+	var current *classKey
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("Failed to parse keybag: truncated")
+		}
+
+		tag := string(data[:4])
+		length := binary.BigEndian.Uint32(data[4:8])
+		if uint64(length) > uint64(len(data)-8) {
+			return nil, fmt.Errorf("Failed to parse keybag: %s is truncated", tag)
+		}
+		value := data[8 : 8+length]
+		data = data[8+length:]
+
+		var n uint32
+		if len(value) == 4 {
+			n = binary.BigEndian.Uint32(value)
+		}
+
+		// The first UUID belongs to the keybag, every following UUID starts a class key
+		if tag == "UUID" && k.UUID != nil {
+			if current != nil {
+				k.classKeys[current.class] = current
+			}
+			current = &classKey{uuid: value}
+			continue
+		}
+
+		if current != nil {
+			switch tag {
+			case "CLAS":
+				current.class = n
+			case "WRAP":
+				current.wrap = n
+			case "KTYP":
+				current.keyType = n
+			case "WPKY":
+				current.wrapped = value
+			}
+			continue
+		}
+
+		switch tag {
+		case "UUID":
+			k.UUID = value
+		case "TYPE":
+			k.Type = n & 0x3fffffff
+		case "WRAP":
+			k.Wrap = n
+		case "SALT":
+			k.salt = value
+		case "ITER":
+			k.iterations = n
+		case "DPSL":
+			k.dpsl = value
+		case "DPIC":
+			k.dpic = n
+		}
+	}
+
+	if current != nil {
+		k.classKeys[current.class] = current
+	}
+
+	if len(k.salt) == 0 || k.iterations == 0 {
+		return nil, fmt.Errorf("Failed to parse keybag: missing salt")
+	}
+
+	return k, nil
+}
+
+// Unlock unwraps the class keys of the keybag using the backup password
+func (k *Keybag) Unlock(password string) error {
+	key := []byte(password)
+	if len(k.dpsl) > 0 {
+		key = pbkdf2.Key(key, k.dpsl, int(k.dpic), 32, sha256.New)
+	}
+	key = pbkdf2.Key(key, k.salt, int(k.iterations), 32, sha1.New)
+
+	for _, c := range k.classKeys {
+		// Keys wrapped only with the device key are not needed to read a backup
+		if c.wrap&wrapPasscode == 0 {
+			continue
+		}
+
+		unwrapped, err := unwrapKey(key, c.wrapped)
+		if err != nil {
+			return ErrWrongPassword
+		}
+		c.key = unwrapped
+	}
+
+	return nil
+}
+
+// UnwrapKey unwraps a key of a protection class, e.g. the key of a file or of Manifest.db.
+// The first four bytes of wrapped are the protection class, little endian
+func (k *Keybag) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 4 {
+		return nil, fmt.Errorf("Failed to unwrap key: too short")
+	}
+
+	class := binary.LittleEndian.Uint32(wrapped[:4])
+	c, ok := k.classKeys[class]
+	if !ok || c.key == nil {
+		return nil, fmt.Errorf("Failed to unwrap key: no key for protection class %v", class)
+	}
+
+	return unwrapKey(c.key, wrapped[4:])
+}
+
+// NewKeybag creates an unlocked keybag protected by password, e.g. to simulate an encrypted backup
+func NewKeybag(password string, iterations uint32, classes ...uint32) (*Keybag, error) {
+	random := make([]byte, 16+20+20+len(classes)*(16+32))
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	next := func(n int) []byte {
+		b := random[:n]
+		random = random[n:]
+		return b
+	}
+
+	k := &Keybag{
+		UUID:       next(16),
+		Type:       1,
+		salt:       next(20),
+		iterations: iterations,
+		dpsl:       next(20),
+		dpic:       iterations,
+		classKeys:  map[uint32]*classKey{},
+	}
+
+	key := pbkdf2.Key(pbkdf2.Key([]byte(password), k.dpsl, int(k.dpic), 32, sha256.New), k.salt, int(k.iterations), 32, sha1.New)
+	for _, class := range classes {
+		c := &classKey{
+			uuid:  next(16),
+			class: class,
+			wrap:  wrapPasscode,
+			key:   next(32),
+		}
+
+		wrapped, err := wrapKey(key, c.key)
+		if err != nil {
+			return nil, err
+		}
+		c.wrapped = wrapped
+
+		k.classKeys[class] = c
+	}
+
+	return k, nil
+}
+
+// WrapKey wraps key with the key of a protection class, in the format UnwrapKey reads
+func (k *Keybag) WrapKey(class uint32, key []byte) ([]byte, error) {
+	c, ok := k.classKeys[class]
+	if !ok || c.key == nil {
+		return nil, fmt.Errorf("Failed to wrap key: no key for protection class %v", class)
+	}
+
+	wrapped, err := wrapKey(c.key, key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 4)
+	binary.LittleEndian.PutUint32(prefix, class)
+
+	return append(prefix, wrapped...), nil
+}
+
+// Bytes encodes the keybag as TLV, the format ParseKeybag reads
+func (k *Keybag) Bytes() []byte {
+	var buf bytes.Buffer
+	writeTLV(&buf, "VERS", uint32Bytes(4))
+	writeTLV(&buf, "TYPE", uint32Bytes(k.Type))
+	writeTLV(&buf, "UUID", k.UUID)
+	writeTLV(&buf, "WRAP", uint32Bytes(k.Wrap))
+	writeTLV(&buf, "SALT", k.salt)
+	writeTLV(&buf, "ITER", uint32Bytes(k.iterations))
+	if len(k.dpsl) > 0 {
+		writeTLV(&buf, "DPWT", uint32Bytes(1))
+		writeTLV(&buf, "DPIC", uint32Bytes(k.dpic))
+		writeTLV(&buf, "DPSL", k.dpsl)
+	}
+
+	classes := make([]uint32, 0, len(k.classKeys))
+	for class := range k.classKeys {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i] < classes[j] })
+
+	for _, class := range classes {
+		c := k.classKeys[class]
+		writeTLV(&buf, "UUID", c.uuid)
+		writeTLV(&buf, "CLAS", uint32Bytes(c.class))
+		writeTLV(&buf, "WRAP", uint32Bytes(c.wrap))
+		writeTLV(&buf, "KTYP", uint32Bytes(c.keyType))
+		writeTLV(&buf, "WPKY", c.wrapped)
+	}
+
+	return buf.Bytes()
+}
+
+func writeTLV(buf *bytes.Buffer, tag string, value []byte) {
+	buf.WriteString(tag)
+	buf.Write(uint32Bytes(uint32(len(value))))
+	buf.Write(value)
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// unwrapKey unwraps a key wrapped with AES key wrap (RFC 3394)
+func unwrapKey(kek []byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("Failed to unwrap key: invalid length %v", len(wrapped))
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			copy(buf, a)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+
+	if !bytes.Equal(a, keyWrapIV) {
+		return nil, fmt.Errorf("Failed to unwrap key: integrity check failed")
+	}
+
+	return r, nil
+}
+
+// wrapKey wraps a key with AES key wrap (RFC 3394)
+func wrapKey(kek []byte, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, fmt.Errorf("Failed to wrap key: invalid length %v", len(key))
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	a := make([]byte, 8)
+	copy(a, keyWrapIV)
+	r := make([]byte, n*8)
+	copy(r, key)
+
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+
+	return append(a, r...), nil
+}
@@ -0,0 +1,120 @@
+// Package manifest reads the metadata of iOS backups written by devicebackup2
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Source is a backup to read metadata from
+type Source interface {
+	// ReadFile reads a file at the root of the backup
+	ReadFile(name string) ([]byte, error)
+}
+
+// Dir is a backup in a local directory
+type Dir string
+
+// ReadFile reads a file at the root of the backup
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), name))
+}
+
+// Info is the contents of Info.plist
+type Info struct {
+	DeviceName            string    `plist:"Device Name"`
+	DisplayName           string    `plist:"Display Name"`
+	ProductType           string    `plist:"Product Type"`
+	ProductVersion        string    `plist:"Product Version"`
+	BuildVersion          string    `plist:"Build Version"`
+	SerialNumber          string    `plist:"Serial Number"`
+	UniqueIdentifier      string    `plist:"Unique Identifier"`
+	LastBackupDate        time.Time `plist:"Last Backup Date"`
+	InstalledApplications []string  `plist:"Installed Applications"`
+}
+
+// Status is the contents of Status.plist
+type Status struct {
+	Version       string    `plist:"Version"`
+	Date          time.Time `plist:"Date"`
+	IsFullBackup  bool      `plist:"IsFullBackup"`
+	BackupState   string    `plist:"BackupState"`
+	SnapshotState string    `plist:"SnapshotState"`
+}
+
+// Manifest is the contents of Manifest.plist
+type Manifest struct {
+	Version        string                 `plist:"Version"`
+	Date           time.Time              `plist:"Date"`
+	IsEncrypted    bool                   `plist:"IsEncrypted"`
+	WasPasscodeSet bool                   `plist:"WasPasscodeSet"`
+	Applications   map[string]Application `plist:"Applications"`
+	Lockdown       Lockdown               `plist:"Lockdown"`
+	// BackupKeyBag holds the class keys of an encrypted backup, see ParseKeybag
+	BackupKeyBag []byte `plist:"BackupKeyBag"`
+	// ManifestKey is the wrapped key Manifest.db of an encrypted backup is encrypted with
+	ManifestKey []byte `plist:"ManifestKey"`
+}
+
+// Application is an app installed on the device when it was backed up
+type Application struct {
+	BundleIdentifier string `plist:"CFBundleIdentifier"`
+	BundleVersion    string `plist:"CFBundleVersion"`
+}
+
+// Lockdown is the device information reported by lockdownd during the backup
+type Lockdown struct {
+	DeviceName     string `plist:"DeviceName"`
+	ProductType    string `plist:"ProductType"`
+	ProductVersion string `plist:"ProductVersion"`
+	BuildVersion   string `plist:"BuildVersion"`
+	UniqueDeviceID string `plist:"UniqueDeviceID"`
+	SerialNumber   string `plist:"SerialNumber"`
+}
+
+// ReadInfo reads Info.plist from a backup
+func ReadInfo(src Source) (*Info, error) {
+	info := &Info{}
+	if err := readPlist(src, "Info.plist", info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ReadStatus reads Status.plist from a backup
+func ReadStatus(src Source) (*Status, error) {
+	status := &Status{}
+	if err := readPlist(src, "Status.plist", status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// ReadManifest reads Manifest.plist from a backup
+func ReadManifest(src Source) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := readPlist(src, "Manifest.plist", manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func readPlist(src Source, name string, v interface{}) error {
+	data, err := src.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", name, err)
+	}
+
+	if _, err := plist.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Failed to parse %s: %s", name, err)
+	}
+
+	return nil
+}
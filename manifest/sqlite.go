@@ -0,0 +1,311 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Types of b-tree pages
+const (
+	interiorTablePage = 0x05
+	leafTablePage     = 0x0d
+)
+
+// sqliteFile reads the tables of a SQLite database held in memory.
+// The decrypted Manifest.db of an encrypted backup is read this way, so it is never written to disk
+type sqliteFile struct {
+	data       []byte
+	pageSize   int
+	usableSize int
+}
+
+func newSQLiteFile(data []byte) (*sqliteFile, error) {
+	if len(data) < 100 || !bytes.Equal(data[:len(sqliteHeader)], sqliteHeader) {
+		return nil, fmt.Errorf("not a SQLite database")
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(data[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 {
+		return nil, fmt.Errorf("invalid page size %v", pageSize)
+	}
+
+	return &sqliteFile{
+		data:       data,
+		pageSize:   pageSize,
+		usableSize: pageSize - int(data[20]),
+	}, nil
+}
+
+// readTable calls fn with the columns of every row of a table
+func (f *sqliteFile) readTable(name string, fn func(row []interface{}) error) error {
+	// The schema is stored in the table on page 1
+	var root int64
+	err := f.walk(1, 0, func(row []interface{}) error {
+		if len(row) >= 4 && row[0] == "table" && row[1] == name {
+			root, _ = row[3].(int64)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if root <= 0 {
+		return fmt.Errorf("table %s not found", name)
+	}
+
+	return f.walk(uint32(root), 0, fn)
+}
+
+// walk visits the rows of the table b-tree rooted at a page
+func (f *sqliteFile) walk(pageNumber uint32, depth int, fn func(row []interface{}) error) error {
+	// A b-tree deeper than this contains a loop
+	if depth > 64 {
+		return fmt.Errorf("corrupted b-tree")
+	}
+
+	page, err := f.page(pageNumber)
+	if err != nil {
+		return err
+	}
+
+	// Page 1 starts with the database header
+	header := 0
+	if pageNumber == 1 {
+		header = 100
+	}
+
+	if len(page) < header+12 {
+		return fmt.Errorf("page %v is truncated", pageNumber)
+	}
+
+	cells := int(binary.BigEndian.Uint16(page[header+3:]))
+	switch page[header] {
+	case interiorTablePage:
+		pointers := header + 12
+		for i := 0; i < cells; i++ {
+			cell, err := cellOffset(page, pointers, i)
+			if err != nil {
+				return err
+			}
+
+			if cell+4 > len(page) {
+				return fmt.Errorf("cell of page %v is truncated", pageNumber)
+			}
+			if err := f.walk(binary.BigEndian.Uint32(page[cell:]), depth+1, fn); err != nil {
+				return err
+			}
+		}
+
+		return f.walk(binary.BigEndian.Uint32(page[header+8:]), depth+1, fn)
+	case leafTablePage:
+		pointers := header + 8
+		for i := 0; i < cells; i++ {
+			cell, err := cellOffset(page, pointers, i)
+			if err != nil {
+				return err
+			}
+
+			payloadSize, n := readVarint(page[cell:])
+			if n == 0 {
+				return fmt.Errorf("cell of page %v is truncated", pageNumber)
+			}
+			cell += n
+
+			// Skip the rowid
+			_, n = readVarint(page[cell:])
+			if n == 0 {
+				return fmt.Errorf("cell of page %v is truncated", pageNumber)
+			}
+			cell += n
+
+			payload, err := f.payload(page, cell, payloadSize)
+			if err != nil {
+				return err
+			}
+
+			row, err := parseRecord(payload)
+			if err != nil {
+				return err
+			}
+
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("page %v is not a table page", pageNumber)
+}
+
+func (f *sqliteFile) page(pageNumber uint32) ([]byte, error) {
+	offset := (int(pageNumber) - 1) * f.pageSize
+	if pageNumber == 0 || offset+f.pageSize > len(f.data) {
+		return nil, fmt.Errorf("page %v is out of range", pageNumber)
+	}
+
+	return f.data[offset : offset+f.pageSize], nil
+}
+
+// payload reads the payload of a cell, following overflow pages if it does not fit in the page
+func (f *sqliteFile) payload(page []byte, offset int, size uint64) ([]byte, error) {
+	u := f.usableSize
+	maxLocal := u - 35
+	if size <= uint64(maxLocal) {
+		if offset+int(size) > len(page) {
+			return nil, fmt.Errorf("payload is truncated")
+		}
+		return page[offset : offset+int(size)], nil
+	}
+
+	minLocal := (u-12)*32/255 - 23
+	local := minLocal + int((size-uint64(minLocal))%uint64(u-4))
+	if local > maxLocal {
+		local = minLocal
+	}
+
+	if offset+local+4 > len(page) {
+		return nil, fmt.Errorf("payload is truncated")
+	}
+
+	// size is read from the file, so check the overflow pages could hold it before allocating the payload
+	pages := uint64(len(f.data) / f.pageSize)
+	if size > uint64(len(f.data)) || size-uint64(local) > pages*uint64(u-4) {
+		return nil, fmt.Errorf("payload size %d is larger than the database", size)
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, page[offset:offset+local]...)
+	next := binary.BigEndian.Uint32(page[offset+local:])
+	for uint64(len(payload)) < size {
+		overflow, err := f.page(next)
+		if err != nil {
+			return nil, err
+		}
+
+		n := u - 4
+		if remaining := size - uint64(len(payload)); remaining < uint64(n) {
+			n = int(remaining)
+		}
+
+		payload = append(payload, overflow[4:4+n]...)
+		next = binary.BigEndian.Uint32(overflow)
+	}
+
+	return payload, nil
+}
+
+func cellOffset(page []byte, pointers int, i int) (int, error) {
+	p := pointers + 2*i
+	if p+2 > len(page) {
+		return 0, fmt.Errorf("cell pointer is out of range")
+	}
+
+	offset := int(binary.BigEndian.Uint16(page[p:]))
+	if offset >= len(page) {
+		return 0, fmt.Errorf("cell is out of range")
+	}
+
+	return offset, nil
+}
+
+// parseRecord parses the columns of a record
+func parseRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := readVarint(payload)
+	if n == 0 || headerSize > uint64(len(payload)) {
+		return nil, fmt.Errorf("record header is truncated")
+	}
+
+	var types []uint64
+	for offset := n; offset < int(headerSize); {
+		t, n := readVarint(payload[offset:int(headerSize)])
+		if n == 0 {
+			return nil, fmt.Errorf("record header is truncated")
+		}
+		types = append(types, t)
+		offset += n
+	}
+
+	body := payload[headerSize:]
+	row := make([]interface{}, 0, len(types))
+	for _, t := range types {
+		size := serialTypeSize(t)
+		if uint64(len(body)) < size {
+			return nil, fmt.Errorf("record is truncated")
+		}
+		value := body[:size]
+		body = body[size:]
+
+		switch {
+		case t == 0:
+			row = append(row, nil)
+		case t <= 6:
+			var u uint64
+			for _, b := range value {
+				u = u<<8 | uint64(b)
+			}
+			// Sign extend
+			shift := 64 - 8*size
+			row = append(row, int64(u<<shift)>>shift)
+		case t == 7:
+			row = append(row, math.Float64frombits(binary.BigEndian.Uint64(value)))
+		case t == 8:
+			row = append(row, int64(0))
+		case t == 9:
+			row = append(row, int64(1))
+		case t >= 12 && t%2 == 0:
+			row = append(row, value)
+		case t >= 13:
+			row = append(row, string(value))
+		default:
+			return nil, fmt.Errorf("invalid serial type %v", t)
+		}
+	}
+
+	return row, nil
+}
+
+func serialTypeSize(t uint64) uint64 {
+	switch {
+	case t <= 4:
+		return t
+	case t == 5:
+		return 6
+	case t == 6, t == 7:
+		return 8
+	case t >= 12:
+		return (t - 12) / 2
+	}
+
+	return 0
+}
+
+// readVarint reads a SQLite varint, returning its value and length, or a length of 0 if b is too short
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+
+	if len(b) < 9 {
+		return 0, 0
+	}
+
+	return v<<8 | uint64(b[8]), 9
+}
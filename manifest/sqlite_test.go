@@ -0,0 +1,291 @@
+package manifest
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// createSQLiteFixture creates a database with go-sqlite3 and returns its contents
+func createSQLiteFixture(t *testing.T, pageSize int, statements []string, rows map[string][][]interface{}) []byte {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fixture.db")
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	// The page size must be set before the first table is created
+	statements = append([]string{fmt.Sprintf("PRAGMA page_size = %d", pageSize)}, statements...)
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	for table, values := range rows {
+		for _, row := range values {
+			placeholders := "?"
+			for i := 1; i < len(row); i++ {
+				placeholders += ", ?"
+			}
+
+			if _, err := db.Exec(fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, placeholders), row...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func readSQLiteTable(data []byte, name string) ([][]interface{}, error) {
+	f, err := newSQLiteFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]interface{}
+	err = f.readTable(name, func(row []interface{}) error {
+		rows = append(rows, row)
+		return nil
+	})
+
+	return rows, err
+}
+
+// blob returns n bytes that differ between pages, so a payload read from the wrong overflow page is noticed
+func blob(n int, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i/7 + seed)
+	}
+
+	return b
+}
+
+func TestSQLiteFileReadsFilesTable(t *testing.T) {
+	// Payloads that fit in the leaf page, spill onto one overflow page, and need a chain of them
+	sizes := []int{0, 10, 400, 1000, 1200, 5000, 20000}
+
+	var files [][]interface{}
+	for i := 0; i < 1500; i++ {
+		files = append(files, []interface{}{
+			fmt.Sprintf("%040x", i),
+			fmt.Sprintf("Domain%d", i%7),
+			fmt.Sprintf("Library/File %d", i),
+			int64(i%3 + 1),
+			blob(sizes[i%len(sizes)], i),
+		})
+	}
+
+	tests := []struct {
+		name     string
+		pageSize int
+	}{
+		{"small pages", 512},
+		{"default pages", 4096},
+		{"large pages", 65536},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := createSQLiteFixture(t, test.pageSize, []string{
+				// Manifest.db has an index and another table, which are skipped
+				"CREATE TABLE Properties (key TEXT PRIMARY KEY, value BLOB)",
+				createFilesTable,
+				"CREATE INDEX FilesDomainIdx ON Files(domain)",
+			}, map[string][][]interface{}{
+				"Properties": {{"salt", blob(16, 0)}},
+				"Files":      files,
+			})
+
+			rows, err := readSQLiteTable(data, "Files")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rows) != len(files) {
+				t.Fatalf("read %d rows, want %d", len(rows), len(files))
+			}
+			for i := range files {
+				if !reflect.DeepEqual(rows[i], files[i]) {
+					t.Fatalf("row %d is %.80v, want %.80v", i, rows[i], files[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteFileUsesInteriorAndOverflowPages(t *testing.T) {
+	var files [][]interface{}
+	for i := 0; i < 200; i++ {
+		files = append(files, []interface{}{fmt.Sprintf("%040x", i), "HomeDomain", "", int64(1), blob(3000, i)})
+	}
+
+	data := createSQLiteFixture(t, 1024, []string{createFilesTable}, map[string][][]interface{}{"Files": files})
+
+	f, err := newSQLiteFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the root page of Files the same way readTable does
+	var root int64
+	f.walk(1, 0, func(row []interface{}) error {
+		if row[0] == "table" && row[1] == "Files" {
+			root = row[3].(int64)
+		}
+		return nil
+	})
+
+	page, err := f.page(uint32(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != interiorTablePage {
+		t.Fatalf("root page of Files has type %#x, want an interior page", page[0])
+	}
+
+	rows, err := readSQLiteTable(data, "Files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, files) {
+		t.Fatal("rows read through interior and overflow pages differ from the rows written")
+	}
+}
+
+func TestSQLiteFileSerialTypes(t *testing.T) {
+	values := [][]interface{}{
+		{nil},
+		{int64(0)},
+		{int64(1)},
+		{int64(-1)},
+		{int64(127)},
+		{int64(-128)},
+		{int64(32767)},
+		{int64(-32768)},
+		{int64(8388607)},
+		{int64(-8388608)},
+		{int64(2147483647)},
+		{int64(-2147483648)},
+		{int64(140737488355327)},
+		{int64(-140737488355328)},
+		{int64(math.MaxInt64)},
+		{int64(math.MinInt64)},
+		{3.5},
+		{-1e300},
+		{""},
+		{"text"},
+		{[]byte{}},
+		{[]byte{0, 1, 2}},
+	}
+
+	data := createSQLiteFixture(t, 4096, []string{"CREATE TABLE v (value)"}, map[string][][]interface{}{"v": values})
+
+	rows, err := readSQLiteTable(data, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != len(values) {
+		t.Fatalf("read %d rows, want %d", len(rows), len(values))
+	}
+	for i := range values {
+		if !reflect.DeepEqual(rows[i], values[i]) {
+			t.Errorf("row %d is %#v, want %#v", i, rows[i], values[i])
+		}
+	}
+}
+
+// corruptPayloadSize creates a database with one row in Files, and changes the payload size of its cell to more
+// than the database holds
+func corruptPayloadSize(t *testing.T) []byte {
+	t.Helper()
+
+	files := [][]interface{}{{"0", "HomeDomain", "", int64(1), blob(2000, 0)}}
+	data := createSQLiteFixture(t, 1024, []string{createFilesTable}, map[string][][]interface{}{"Files": files})
+
+	f, err := newSQLiteFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var root int64
+	f.walk(1, 0, func(row []interface{}) error {
+		if row[0] == "table" && row[1] == "Files" {
+			root = row[3].(int64)
+		}
+		return nil
+	})
+
+	page, err := f.page(uint32(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != leafTablePage {
+		t.Fatalf("root page of Files has type %#x, want a leaf page", page[0])
+	}
+
+	// The payload size is the first varint of the cell, which takes two bytes for a payload of this size
+	cell := int(page[8])<<8 | int(page[9])
+	if page[cell]&0x80 == 0 || page[cell+1]&0x80 != 0 {
+		t.Fatalf("payload size %x is not a two byte varint", page[cell:cell+2])
+	}
+	page[cell] = 0xff
+	page[cell+1] = 0x7f
+
+	return data
+}
+
+func TestSQLiteFileErrors(t *testing.T) {
+	var files [][]interface{}
+	for i := 0; i < 50; i++ {
+		files = append(files, []interface{}{fmt.Sprintf("%d", i), "HomeDomain", "", int64(1), blob(2000, i)})
+	}
+	data := createSQLiteFixture(t, 1024, []string{createFilesTable}, map[string][][]interface{}{"Files": files})
+
+	tests := []struct {
+		name  string
+		data  []byte
+		table string
+	}{
+		{"empty", nil, "Files"},
+		{"not a database", bytes.Repeat([]byte("x"), 1024), "Files"},
+		{"missing table", data, "Missing"},
+		{"truncated", data[:len(data)/2], "Files"},
+		{"corrupt payload size", corruptPayloadSize(t), "Files"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readSQLiteTable(test.data, test.table); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
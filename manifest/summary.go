@@ -0,0 +1,94 @@
+package manifest
+
+import (
+	"sort"
+	"time"
+)
+
+// Summary describes the device and contents of a backup
+type Summary struct {
+	DeviceName     string
+	ProductType    string
+	ProductVersion string
+	BuildVersion   string
+	BackupDate     time.Time
+	IsEncrypted    bool
+	IsFullBackup   bool
+	// Applications are the bundle IDs of the installed apps, sorted
+	Applications []string
+	// DomainFileCounts is the number of files in each domain. It is empty for encrypted backups that could not be decrypted,
+	// because Manifest.db is encrypted
+	DomainFileCounts map[string]uint64
+}
+
+// FileCount returns the number of files in the backup
+func (s *Summary) FileCount() uint64 {
+	var count uint64
+	for _, v := range s.DomainFileCounts {
+		count += v
+	}
+
+	return count
+}
+
+// Summarize reads the metadata of a backup. Manifest.db of an encrypted backup is decrypted with password to count its
+// files. Without a password, or if it is wrong, the files of an encrypted backup are not counted
+func Summarize(src Source, password string) (*Summary, error) {
+	info, err := ReadInfo(src)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := ReadStatus(src)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := ReadManifest(src)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{
+		DeviceName:     info.DeviceName,
+		ProductType:    info.ProductType,
+		ProductVersion: info.ProductVersion,
+		BuildVersion:   info.BuildVersion,
+		BackupDate:     status.Date,
+		IsEncrypted:    manifest.IsEncrypted,
+		IsFullBackup:   status.IsFullBackup,
+	}
+
+	if summary.BackupDate.IsZero() {
+		summary.BackupDate = info.LastBackupDate
+	}
+
+	// Fall back to Info.plist if Manifest.plist lists no apps
+	for bundleID := range manifest.Applications {
+		summary.Applications = append(summary.Applications, bundleID)
+	}
+	if len(summary.Applications) == 0 {
+		summary.Applications = info.InstalledApplications
+	}
+	sort.Strings(summary.Applications)
+
+	if manifest.IsEncrypted && password == "" {
+		return summary, nil
+	}
+
+	db, err := OpenDB(src, password)
+	if manifest.IsEncrypted && err != nil {
+		return summary, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	summary.DomainFileCounts, err = db.DomainFileCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
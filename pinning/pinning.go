@@ -0,0 +1,246 @@
+// Package pinning is a client for the IPFS Pinning Services API, see https://ipfs.github.io/pinning-services-api-spec/
+package pinning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Status is the status of a pin request
+type Status string
+
+const (
+	Queued  Status = "queued"
+	Pinning Status = "pinning"
+	Pinned  Status = "pinned"
+	Failed  Status = "failed"
+)
+
+// Pin is an object to pin
+type Pin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus is a pin request and its status
+type PinStatus struct {
+	RequestID string    `json:"requestid"`
+	Status    Status    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       Pin       `json:"pin"`
+	// Delegates are the addresses of the nodes that will pin the object. Connecting to them speeds up pinning
+	Delegates []string               `json:"delegates"`
+	Info      map[string]interface{} `json:"info,omitempty"`
+}
+
+// Reason explains why a pin request failed, if the pinning service said why
+func (s *PinStatus) Reason() string {
+	if s.Status != Failed {
+		return ""
+	}
+
+	if details, ok := s.Info["status_details"].(string); ok {
+		return details
+	}
+
+	return "Pinning failed"
+}
+
+// Error is an error returned by a pinning service
+type Error struct {
+	StatusCode int
+	Reason     string
+	Details    string
+}
+
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("Pinning service returned %d %s: %s", e.StatusCode, e.Reason, e.Details)
+	}
+
+	return fmt.Sprintf("Pinning service returned %d %s", e.StatusCode, e.Reason)
+}
+
+// IsNotFound returns true if err is a pinning service error for a pin request that does not exist
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Client makes requests to a pinning service
+type Client struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+// NewClient creates a client for the pinning service at endpoint, authenticated with an access token
+func NewClient(endpoint string, token string) *Client {
+	return &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		http:     &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Add asks the service to pin an object
+func (c *Client) Add(ctx context.Context, pin Pin) (*PinStatus, error) {
+	status := &PinStatus{}
+	if err := c.do(ctx, http.MethodPost, "/pins", nil, pin, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Get gets a pin request by its ID
+func (c *Client) Get(ctx context.Context, requestID string) (*PinStatus, error) {
+	status := &PinStatus{}
+	if err := c.do(ctx, http.MethodGet, "/pins/"+url.PathEscape(requestID), nil, nil, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Check gets the status of a pin request. A request the service no longer has is reported as failed
+func (c *Client) Check(ctx context.Context, requestID string) (*PinStatus, error) {
+	status, err := c.Get(ctx, requestID)
+	if IsNotFound(err) {
+		return &PinStatus{
+			RequestID: requestID,
+			Status:    Failed,
+			Info:      map[string]interface{}{"status_details": "Pin request was removed from the pinning service"},
+		}, nil
+	}
+
+	return status, err
+}
+
+// Ensure asks the service to pin an object, unless it already has a request for its CID that has not failed, e.g.
+// made by another node with the same service. It returns the status of the request and true if a new one was made
+func (c *Client) Ensure(ctx context.Context, pin Pin) (*PinStatus, bool, error) {
+	found, err := c.Find(ctx, pin.Cid, Queued, Pinning, Pinned)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(found) > 0 {
+		return found[0], false, nil
+	}
+
+	status, err := c.Add(ctx, pin)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return status, true, nil
+}
+
+// Find lists the pin requests for a CID with one of statuses, newest first
+func (c *Client) Find(ctx context.Context, cid string, statuses ...Status) ([]*PinStatus, error) {
+	query := url.Values{}
+	query.Set("cid", cid)
+	if len(statuses) > 0 {
+		s := make([]string, len(statuses))
+		for i, v := range statuses {
+			s[i] = string(v)
+		}
+		query.Set("status", strings.Join(s, ","))
+	}
+
+	results := &struct {
+		Count   int          `json:"count"`
+		Results []*PinStatus `json:"results"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/pins", query, nil, results); err != nil {
+		return nil, err
+	}
+
+	return results.Results, nil
+}
+
+// Remove asks the service to remove a pin
+func (c *Client) Remove(ctx context.Context, requestID string) error {
+	return c.do(ctx, http.MethodDelete, "/pins/"+url.PathEscape(requestID), nil, nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, result interface{}) error {
+	u := c.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := &struct {
+			Error struct {
+				Reason  string `json:"reason"`
+				Details string `json:"details"`
+			} `json:"error"`
+		}{}
+		json.Unmarshal(b, e)
+
+		if e.Error.Reason == "" {
+			e.Error.Reason = http.StatusText(resp.StatusCode)
+		}
+
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Reason:     e.Error.Reason,
+			Details:    e.Error.Details,
+		}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(b, result); err != nil {
+		return fmt.Errorf("Invalid response from pinning service: %s", err)
+	}
+
+	return nil
+}
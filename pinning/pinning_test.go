@@ -0,0 +1,337 @@
+package pinning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "secret-token"
+
+// fakeService is a pinning service that keeps its pin requests in memory
+type fakeService struct {
+	lock     sync.Mutex
+	pins     map[string]*PinStatus
+	next     int
+	requests []string
+}
+
+func newFakeService(t *testing.T) (*fakeService, *Client) {
+	f := &fakeService{pins: map[string]*PinStatus{}}
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	// A trailing slash is ignored
+	return f, NewClient(server.URL+"/", testToken)
+}
+
+// setStatus changes the status of a pin request, as the service would while it pins the object
+func (f *fakeService) setStatus(requestID string, status Status, details string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pins[requestID].Status = status
+	if details != "" {
+		f.pins[requestID].Info = map[string]interface{}{"status_details": details}
+	}
+}
+
+func (f *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid access token")
+		return
+	}
+
+	requestID := strings.TrimPrefix(r.URL.Path, "/pins/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pins":
+		pin := Pin{}
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil || pin.Cid == "" {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", "Invalid pin")
+			return
+		}
+
+		f.next++
+		status := &PinStatus{
+			RequestID: fmt.Sprintf("request-%d", f.next),
+			Status:    Queued,
+			Created:   time.Date(2020, time.June, 17, 12, f.next, 0, 0, time.UTC),
+			Pin:       pin,
+			Delegates: []string{"/ip4/203.0.113.1/tcp/4001/p2p/QmDelegate"},
+		}
+		f.pins[status.RequestID] = status
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	case r.Method == http.MethodGet && r.URL.Path == "/pins":
+		statuses := map[string]bool{}
+		if s := r.URL.Query().Get("status"); s != "" {
+			for _, v := range strings.Split(s, ",") {
+				statuses[v] = true
+			}
+		}
+
+		results := []*PinStatus{}
+		for _, status := range f.pins {
+			if status.Pin.Cid == r.URL.Query().Get("cid") && (len(statuses) == 0 || statuses[string(status.Status)]) {
+				results = append(results, status)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(results), "results": results})
+	case r.Method == http.MethodGet:
+		status, ok := f.pins[requestID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "")
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.pins[requestID]; !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "")
+			return
+		}
+		delete(f.pins, requestID)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, reason string, details string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"reason": %q, "details": %q}}`, reason, details)
+}
+
+func TestClient(t *testing.T) {
+	f, client := newFakeService(t)
+	ctx := context.Background()
+
+	pin := Pin{
+		Cid:     "QmBackup",
+		Name:    "backup",
+		Origins: []string{"/ip4/198.51.100.1/tcp/4001/p2p/QmNode"},
+	}
+
+	added, err := client.Add(ctx, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.RequestID == "" || added.Status != Queued || !reflect.DeepEqual(added.Pin, pin) || len(added.Delegates) != 1 {
+		t.Errorf("Add returned %+v", added)
+	}
+
+	got, err := client.Get(ctx, added.RequestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, added) {
+		t.Errorf("Get returned %+v, want %+v", got, added)
+	}
+
+	if _, err := client.Add(ctx, Pin{Cid: "QmOther"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := client.Find(ctx, "QmBackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].RequestID != added.RequestID {
+		t.Errorf("Find returned %v, want only %s", found, added.RequestID)
+	}
+
+	found, err = client.Find(ctx, "QmBackup", Pinning, Pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("Find of pinning and pinned returned the queued request %v", found)
+	}
+
+	if err := client.Remove(ctx, added.RequestID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get(ctx, added.RequestID)
+	if !IsNotFound(err) {
+		t.Errorf("Get of a removed request returned %v, want not found", err)
+	}
+
+	if err := client.Remove(ctx, added.RequestID); !IsNotFound(err) {
+		t.Errorf("Remove of a removed request returned %v, want not found", err)
+	}
+
+	want := []string{"POST /pins", "GET /pins/request-1", "POST /pins", "GET /pins", "GET /pins", "DELETE /pins/request-1", "GET /pins/request-1", "DELETE /pins/request-1"}
+	if !reflect.DeepEqual(f.requests, want) {
+		t.Errorf("requests were %v, want %v", f.requests, want)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, client := newFakeService(t)
+	ctx := context.Background()
+
+	_, err := client.Add(ctx, Pin{})
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadRequest || e.Reason != "BAD_REQUEST" || e.Details != "Invalid pin" {
+		t.Errorf("Add of an invalid pin returned %#v", err)
+	}
+	if IsNotFound(err) {
+		t.Error("a bad request is not a missing pin request")
+	}
+
+	unauthorized := NewClient(client.endpoint, "wrong-token")
+	_, err = unauthorized.Find(ctx, "QmBackup")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Find with a wrong token returned %#v", err)
+	}
+	if err.Error() != "Pinning service returned 401 UNAUTHORIZED: Invalid access token" {
+		t.Errorf("error is %q", err)
+	}
+
+	// A service that does not return an error object
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err = NewClient(server.URL, "").Get(ctx, "request-1")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusInternalServerError || e.Reason != "Internal Server Error" {
+		t.Errorf("Get returned %#v", err)
+	}
+}
+
+func TestCheckStatusTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is applied to the pin request on the service before it is checked
+		change     func(f *fakeService, requestID string)
+		wantStatus Status
+		wantReason string
+	}{
+		{
+			name:       "queued",
+			change:     func(f *fakeService, requestID string) {},
+			wantStatus: Queued,
+		},
+		{
+			name:       "queued to pinning",
+			change:     func(f *fakeService, requestID string) { f.setStatus(requestID, Pinning, "") },
+			wantStatus: Pinning,
+		},
+		{
+			name:       "pinning to pinned",
+			change:     func(f *fakeService, requestID string) { f.setStatus(requestID, Pinned, "") },
+			wantStatus: Pinned,
+		},
+		{
+			name:       "failed with details",
+			change:     func(f *fakeService, requestID string) { f.setStatus(requestID, Failed, "Could not find the backup") },
+			wantStatus: Failed,
+			wantReason: "Could not find the backup",
+		},
+		{
+			name:       "failed without details",
+			change:     func(f *fakeService, requestID string) { f.setStatus(requestID, Failed, "") },
+			wantStatus: Failed,
+			wantReason: "Pinning failed",
+		},
+		{
+			name: "removed from the service",
+			change: func(f *fakeService, requestID string) {
+				f.lock.Lock()
+				delete(f.pins, requestID)
+				f.lock.Unlock()
+			},
+			wantStatus: Failed,
+			wantReason: "Pin request was removed from the pinning service",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, client := newFakeService(t)
+			ctx := context.Background()
+
+			added, err := client.Add(ctx, Pin{Cid: "QmBackup"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.change(f, added.RequestID)
+
+			status, err := client.Check(ctx, added.RequestID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status.RequestID != added.RequestID || status.Status != test.wantStatus || status.Reason() != test.wantReason {
+				t.Errorf("Check returned %s %s %q, want %s %s %q", status.RequestID, status.Status, status.Reason(), added.RequestID, test.wantStatus, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestCheckReturnsOtherErrors(t *testing.T) {
+	_, client := newFakeService(t)
+
+	unauthorized := NewClient(client.endpoint, "wrong-token")
+	if _, err := unauthorized.Check(context.Background(), "request-1"); err == nil {
+		t.Error("Check with a wrong token succeeded")
+	}
+}
+
+func TestEnsure(t *testing.T) {
+	f, client := newFakeService(t)
+	ctx := context.Background()
+
+	pin := Pin{Cid: "QmBackup", Name: "backup"}
+
+	first, added, err := client.Ensure(ctx, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("Ensure did not add a pin request for a new CID")
+	}
+
+	// The request may have been made by another node, and is reused while it has not failed
+	for _, status := range []Status{Queued, Pinning, Pinned} {
+		f.setStatus(first.RequestID, status, "")
+
+		again, added, err := client.Ensure(ctx, pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added || again.RequestID != first.RequestID || again.Status != status {
+			t.Errorf("Ensure of a %s pin returned %s %s, added %v", status, again.RequestID, again.Status, added)
+		}
+	}
+
+	// A failed request is made again
+	f.setStatus(first.RequestID, Failed, "Could not find the backup")
+
+	retried, added, err := client.Ensure(ctx, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added || retried.RequestID == first.RequestID || retried.Status != Queued {
+		t.Errorf("Ensure of a failed pin returned %s %s, added %v", retried.RequestID, retried.Status, added)
+	}
+
+	if len(f.pins) != 2 {
+		t.Errorf("service has %d pin requests, want 2", len(f.pins))
+	}
+}